@@ -0,0 +1,328 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveWriter writes files to compressed tar archive
+type archiveWriter struct {
+	storage Storage
+
+	// Name of archive file or of its first volume
+	fileName string
+
+	// Archive file writer if archive is not split into volumes
+	object ObjectWriter
+
+	// Archive file or volumes writer
+	out io.WriteCloser
+
+	// Volumes writer if archive is split into volumes
+	volumes *volumeWriter
+
+	codec       *Codec
+	compression *CompressionConfig
+	encryption  *EncryptionConfig
+
+	// Encrypting writer
+	encrypted io.WriteCloser
+
+	compressor io.WriteCloser
+	tarWriter  *tar.Writer
+
+	// Tar data writer, switched to new compressor at restart points
+	tarOut switchWriter
+
+	// Number of the last volume starting with new encryption and
+	// compression streams, entries can be read starting from it
+	restartVolume int
+
+	// Number of added files
+	fileCount int
+
+	// SHA-256 checksums of added files in sha256sum format
+	checksums bytes.Buffer
+}
+
+const (
+	// PAX record marking the entry with checksums of archived files
+	paxChecksumsRecord = "BACKUPER.checksums"
+
+	checksumsEntryName = "BACKUPER.sha256sums"
+)
+
+// newArchiveWriter creates new archive file compressed with codec and encrypted
+// according to encryption settings.
+// If maxVolumeSize is positive, archive is split into volumes of that size.
+func newArchiveWriter(storage Storage, baseName string, codec *Codec, config *CompressionConfig, maxVolumeSize int64, encryption *EncryptionConfig) (*archiveWriter, error) {
+	w := &archiveWriter{storage: storage, codec: codec, compression: config, encryption: encryption, restartVolume: 1}
+
+	if maxVolumeSize > 0 {
+		volumes, err := newVolumeWriter(storage, baseName, codec.Ext, maxVolumeSize)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при создании файла архива: %v", err)
+		}
+
+		w.fileName = volumes.fileNames[0]
+		w.out = volumes
+		w.volumes = volumes
+	} else {
+		w.fileName = baseName + codec.Ext
+
+		object, err := storage.Put(w.fileName)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при создании файла архива: %v", err)
+		}
+
+		w.object = object
+		w.out = object
+	}
+
+	err := w.startStream()
+	if err != nil {
+		w.remove()
+		return nil, err
+	}
+
+	w.tarWriter = tar.NewWriter(&w.tarOut)
+
+	return w, nil
+}
+
+// switchWriter writes data to replaceable writer
+type switchWriter struct {
+	w io.Writer
+
+	// Bytes written since the last flush
+	pending int64
+}
+
+func (sw *switchWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.pending += int64(n)
+
+	return n, err
+}
+
+// startStream starts new encryption and compression streams
+func (w *archiveWriter) startStream() error {
+	encrypted, err := w.encryption.newEncryptWriter(w.out)
+	if err != nil {
+		return fmt.Errorf("ошибка при инициализации шифрования: %v", err)
+	}
+
+	compressor, err := w.codec.NewWriter(encrypted, w.compression)
+	if err != nil {
+		return fmt.Errorf("ошибка при создании инициализации архиватора: %v", err)
+	}
+
+	w.encrypted = encrypted
+	w.compressor = compressor
+	w.tarOut.w = compressor
+	w.tarOut.pending = 0
+
+	return nil
+}
+
+// restartMargin returns free space of volume, below which new volume is
+// started at the next entry boundary
+func restartMargin(maxVolumeSize int64) int64 {
+	return maxVolumeSize / 32
+}
+
+// flush writes buffered data to volumes
+func (w *archiveWriter) flush() error {
+	err := w.tarWriter.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, writer := range []io.Writer{w.compressor, w.encrypted} {
+		if flusher, ok := writer.(interface{ Flush() error }); ok {
+			err = flusher.Flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	w.tarOut.pending = 0
+
+	return nil
+}
+
+// restart ends encryption and compression streams and starts new ones in the
+// next volume, so entries added later can be read without previous volumes
+func (w *archiveWriter) restart() error {
+	err := w.tarWriter.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = w.compressor.Close()
+	if err != nil {
+		return err
+	}
+
+	err = w.encrypted.Close()
+	if err != nil {
+		return err
+	}
+
+	if w.volumes.written > 0 {
+		err = w.volumes.nextVolume()
+		if err != nil {
+			return err
+		}
+	}
+	w.restartVolume = w.volumes.volume
+
+	return w.startStream()
+}
+
+// nextEntryLocation returns name of the archive file from which the next
+// entry can be read and PAX records to be written into the entry header.
+// Streams of archives split into volumes are restarted in a new volume when
+// the current one is nearly full. Buffered data is flushed only near the
+// volume end, size of uncompressed data is used as an upper estimate.
+func (w *archiveWriter) nextEntryLocation() (string, map[string]string, error) {
+	if w.volumes == nil {
+		return path.Base(w.fileName), nil, nil
+	}
+
+	margin := restartMargin(w.volumes.maxSize)
+	if w.volumes.maxSize-w.volumes.written-w.tarOut.pending < margin {
+		err := w.flush()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if w.volumes.maxSize-w.volumes.written < margin {
+		err := w.restart()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return path.Base(volumeFileName(w.volumes.baseName, w.restartVolume, w.volumes.ext)), map[string]string{paxVolumeRecord: strconv.Itoa(w.restartVolume)}, nil
+}
+
+// addChecksum records checksum of added file.
+// Files with line breaks in names are not listed.
+func (w *archiveWriter) addChecksum(filePath, digest string) {
+	if strings.ContainsAny(filePath, "\r\n") {
+		return
+	}
+
+	fmt.Fprintf(&w.checksums, "%s  %s\n", digest, filePath)
+}
+
+// writeChecksums writes checksums of added files as the last archive entry
+func (w *archiveWriter) writeChecksums() error {
+	header := &tar.Header{
+		Format:     tar.FormatPAX,
+		Name:       checksumsEntryName,
+		Size:       int64(w.checksums.Len()),
+		Mode:       0644,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{paxChecksumsRecord: "sha256"}}
+
+	err := w.tarWriter.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.tarWriter.Write(w.checksums.Bytes())
+
+	return err
+}
+
+// parseChecksums parses checksums entry: file path - hex SHA-256
+func parseChecksums(data []byte) (map[string]string, error) {
+	checksums := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		digest, filePath, found := strings.Cut(scanner.Text(), "  ")
+		if !found {
+			return nil, fmt.Errorf("invalid checksum line %q", scanner.Text())
+		}
+
+		checksums[filePath] = digest
+	}
+
+	return checksums, scanner.Err()
+}
+
+// Close finalizes archive. Archive file is removed on error.
+func (w *archiveWriter) Close() error {
+	if w.checksums.Len() > 0 {
+		err := w.writeChecksums()
+		if err != nil {
+			w.compressor.Close()
+			w.remove()
+			return fmt.Errorf("write checksums error: %v", err)
+		}
+	}
+
+	err := w.tarWriter.Close()
+	if err != nil {
+		w.compressor.Close()
+		w.remove()
+		return fmt.Errorf("close tar file error: %v", err)
+	}
+
+	err = w.compressor.Close()
+	if err != nil {
+		w.remove()
+		return fmt.Errorf("close compressor error: %v", err)
+	}
+
+	err = w.encrypted.Close()
+	if err != nil {
+		w.remove()
+		return fmt.Errorf("close encryption error: %v", err)
+	}
+
+	err = w.out.Close()
+	if err != nil {
+		w.remove()
+		return fmt.Errorf("close file error: %v", err)
+	}
+
+	return nil
+}
+
+// fileNames returns names of archive file or of all its volumes
+func (w *archiveWriter) fileNames() []string {
+	if w.volumes != nil {
+		return w.volumes.fileNames
+	}
+
+	return []string{w.fileName}
+}
+
+// Abort closes and removes partially written archive
+func (w *archiveWriter) Abort() {
+	w.compressor.Close()
+	w.remove()
+}
+
+// remove closes and deletes archive file or all its volumes
+func (w *archiveWriter) remove() {
+	if w.volumes != nil {
+		w.volumes.Remove()
+		return
+	}
+
+	w.object.Abort()
+	w.storage.Delete(w.fileName)
+}
@@ -2,94 +2,143 @@ package main
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"time"
-
-	"github.com/klauspost/compress/zstd"
 )
 
-func (b *Config) fileList(fileNames chan FileInfo) {
+func (b *Config) fileList(fileNames chan FileInfo, report *Report) {
 	errorCount := 0
+	now := time.Now()
+
+	// handleError регистрирует ошибку и возвращает её, если обработку нужно остановить
+	handleError := func(format string, err error) error {
+		errorCount++
+		b.logf(Error, format+"\n", err)
+		if b.StopOnAnyError {
+			return fmt.Errorf(format, err)
+		}
+
+		return nil
+	}
+
+	// Files already matched by previous patterns: normalized path - pattern
+	matchedFiles := make(map[string]*Pattern)
 
 	for _, mask := range b.Patterns {
-		if mask.Recursive {
-			err := filepath.WalkDir(mask.Path, func(path string, d fs.DirEntry, err error) error {
-				if err != nil {
-					errorCount++
-					b.logf(Error, "Ошибка при поиске файлов: %v\n", err)
-					if b.StopOnAnyError {
-						return fmt.Errorf("ошибка при переборе файлов: %v", err)
-					}
-					return nil
+		var rootDevice uint64
+		if mask.OneFileSystem {
+			info, err := os.Stat(mask.Path)
+			if err != nil {
+				if err := handleError("get object info error: %v", err); err != nil {
+					report.Stop(err)
+					break
 				}
+				continue
+			}
+
+			var ok bool
+			rootDevice, ok = deviceID(info)
+			if !ok {
+				b.logf(Warn, "Device IDs are not supported, file system boundaries will be crossed.")
+			}
+		}
 
-				if d.IsDir() {
-					return nil
+		ignoreRules := make(map[string]*IgnoreRules) // directory path - rules
+		err := filepath.WalkDir(mask.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return handleError("ошибка при переборе файлов: %v", err)
+			}
+
+			if d.IsDir() {
+				if mask.MaxDepth >= 0 && pathDepth(mask.Path, path) > mask.MaxDepth {
+					return fs.SkipDir
 				}
 
-				path = filepath.ToSlash(path)
+				skip, err := b.skipDir(mask, path, d, rootDevice)
+				if err != nil {
+					if err := handleError("get object info error: %v", err); err != nil {
+						return err
+					}
+				}
+				if skip {
+					return fs.SkipDir
+				}
 
-				if !mask.Recursive && filepath.Dir(path) != mask.Path {
-					return nil
+				parentRules := ignoreRules[filepath.Dir(path)]
+				if path != mask.Path && parentRules.Ignored(path, true) {
+					b.logf(Debug, "Skipping ignored directory %s...", path)
+					return fs.SkipDir
 				}
 
-				if isFilePathMatchPatterns(mask.FilePathPatternList, path) && isFileNameMatchPatterns(mask.FileNamePatternList, path) {
-					if !isFilePathMatchPatterns(b.GlobalExcludeFilePathPatterns, path) && !isFileNameMatchPatterns(b.GlobalExcludeFileNamePatterns, path) {
-						info, err := os.Stat(path)
-						if err != nil {
-							errorCount++
-							b.logf(Error, "get file info error: %v", err)
-							if b.StopOnAnyError {
-								return fmt.Errorf("get file info error: %v", err)
-							}
-							
-							return nil
-						}
-
-						file := FileInfo{
-							filePath:         path,
-							ModificationTime: info.ModTime(),
-							fileSize:         info.Size()}
-						fileNames <- file
+				rules, err := loadIgnoreRules(path, b.IgnoreFileName, parentRules)
+				if err != nil {
+					if err := handleError("read ignore file error: %v", err); err != nil {
+						return err
 					}
 				}
+				ignoreRules[path] = rules
+
 				return nil
-			})
-			if err != nil {
-				b.logf(Error, "get file list error: %v\n", err)
 			}
-		} else {
-			allFilesAndDirs, err := filepath.Glob(filepath.Join(mask.Path, "*"))
+
+			if ignoreRules[filepath.Dir(path)].Ignored(path, false) {
+				return nil
+			}
+
+			slashPath := filepath.ToSlash(filepath.Clean(path))
+
+			if !mask.FilePathPatternList.Match(slashPath) || !mask.FileNamePatternList.MatchName(slashPath) {
+				return nil
+			}
+
+			if b.GlobalExcludeFilePathPatterns.Match(slashPath) || b.GlobalExcludeFileNamePatterns.MatchName(slashPath) {
+				return nil
+			}
+
+			// Stat follows symlinks
+			info, err := os.Stat(path)
 			if err != nil {
-				errorCount++
-				b.logf(Error, "get file list error: %v\n", err)
+				return handleError("get file info error: %v", err)
 			}
 
-			for _, fileOrDirPath := range allFilesAndDirs {
-				info, err := os.Stat(fileOrDirPath)
-				if err != nil {
-					errorCount++
-					b.logf(Error, "get object info error: %v\n", err)
-					continue
-				}
+			if info.IsDir() {
+				return nil
+			}
 
-				if info.IsDir() {
-					continue
+			skip, err := b.skipFile(mask, slashPath, info, now, report)
+			if err != nil {
+				if err := handleError("filter file error: %v", err); err != nil {
+					return err
 				}
+			}
+			if skip {
+				return nil
+			}
 
-				if isFilePathMatchPatterns(mask.FilePathPatternList, fileOrDirPath) && isFileNameMatchPatterns(mask.FileNamePatternList, fileOrDirPath) {
-					if !isFilePathMatchPatterns(b.GlobalExcludeFilePathPatterns, fileOrDirPath) && !isFileNameMatchPatterns(b.GlobalExcludeFileNamePatterns, fileOrDirPath) {
-						file := FileInfo{
-							filePath:         fileOrDirPath,
-							ModificationTime: info.ModTime()}
-						fileNames <- file
-					}
-				}
+			if firstMask, exists := matchedFiles[slashPath]; exists {
+				b.logf(Debug, "File %s is already matched by pattern %s.", slashPath, firstMask.Path)
+				report.AddOverlap(firstMask, mask)
+				return nil
 			}
+			matchedFiles[slashPath] = mask
+
+			fileNames <- FileInfo{
+				filePath:         slashPath,
+				ModificationTime: info.ModTime(),
+				fileSize:         info.Size()}
+
+			return nil
+		})
+		if err != nil {
+			b.logf(Error, "get file list error: %v\n", err)
+			report.Stop(err)
+			break
 		}
 	}
 
@@ -100,8 +149,63 @@ func (b *Config) fileList(fileNames chan FileInfo) {
 	close(fileNames)
 }
 
+// skipFile reports whether file should be skipped by size, age or type filters
+func (b *Config) skipFile(mask *Pattern, path string, info fs.FileInfo, now time.Time, report *Report) (bool, error) {
+	for _, filter := range []*FileFilter{&mask.FileFilter, &b.FileFilter} {
+		reason, err := filter.skipReason(path, info, now)
+		if err != nil {
+			return true, err
+		}
+
+		if reason != "" {
+			b.logf(Debug, "Skipping file %s: %s.", path, reason)
+			report.AddSkippedFile(path, reason)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// skipDir reports whether directory should be skipped without descending into it
+func (b *Config) skipDir(mask *Pattern, path string, d fs.DirEntry, rootDevice uint64) (bool, error) {
+	if path == mask.Path {
+		return false, nil
+	}
+
+	slashPath := filepath.ToSlash(filepath.Clean(path))
+	if mask.ExcludeDirPatternList.Match(slashPath) || b.GlobalExcludeFilePathPatterns.MatchDir(slashPath) {
+		b.logf(Debug, "Skipping excluded directory %s...", path)
+		return true, nil
+	}
+
+	if mask.OneFileSystem {
+		info, err := d.Info()
+		if err != nil {
+			return true, err
+		}
+
+		if device, ok := deviceID(info); ok && device != rootDevice {
+			b.logf(Debug, "Skipping directory %s on another file system...", path)
+			return true, nil
+		}
+	}
+
+	if mask.SkipCacheDirs && isCacheDir(path) {
+		b.logf(Debug, "Skipping cache directory %s...", path)
+		return true, nil
+	}
+
+	return false, nil
+}
+
 func (b *Config) FullBackup() error {
-	return b.doBackup(make(Index))
+	err := b.doBackup(make(Index))
+	if err != nil {
+		return err
+	}
+
+	return b.Resync()
 }
 
 func (b *Config) IncrementalBackup() error {
@@ -110,10 +214,17 @@ func (b *Config) IncrementalBackup() error {
 		return err
 	}
 
-	return b.doBackup(index)
+	err = b.doBackup(index)
+	if err != nil {
+		return err
+	}
+
+	return b.Resync()
 }
 
 func (b *Config) doBackup(index Index) error {
+	b.warnLegacyPatterns()
+
 	var suffix string
 	if len(index) == 0 {
 		suffix = "f" // Full backup - полный бекап
@@ -121,94 +232,297 @@ func (b *Config) doBackup(index Index) error {
 		suffix = "i" // Инкрементальный бекап
 	}
 
-	filePath := filepath.Join(filepath.Dir(b.filePath), b.FileName+"_"+time.Now().Local().Format(defaulFileNameTimeFormat)+suffix+defaultExt)
-
-	var err error
-	filePath, err = filepath.Abs(filePath)
+	codec, err := b.archiveCodec()
 	if err != nil {
-		return fmt.Errorf("ошибка при создании файла архива: %v", err)
+		return err
 	}
-	b.logf(Info, "Creating new file %s...", filepath.Base(filePath))
 
-	resultArchiveFile, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("ошибка при создании файла архива: %v", err)
+	// Архивы записываются на подключённый сменный носитель, его метка сохраняется в индексе
+	var mediaLabel string
+	if b.Media.Enabled() {
+		mediaLabel, err = b.mountedMedia()
+		if err != nil {
+			return err
+		}
+		b.logf(Info, "Writing archives to media %s...", mediaLabel)
 	}
 
-	compressor, err := zstd.NewWriter(resultArchiveFile, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	baseName := b.FileName + "_" + time.Now().Local().Format(defaulFileNameTimeFormat) + suffix
+
+	if b.Format == formatChunked {
+		return b.doChunkedBackup(index, baseName)
+	}
+
+	var report Report
+
+	files := b.planChan(index, &report)
+
+	if codec.Name == "zstd" && b.Compression.TrainDictionary {
+		files, err = b.prepareDictionary(files, suffix == "f")
+		if err != nil {
+			b.logf(Error, "prepare dictionary error: %v", err)
+			if b.StopOnAnyError {
+				return err
+			}
+		}
+	}
+
+	archive, err := newArchiveWriter(b.storage(), baseName, codec, &b.Compression, int64(b.MaxVolumeSize), &b.Encryption)
 	if err != nil {
-		return fmt.Errorf("ошибка при создании инициализации архиватора: %v", err)
+		return err
 	}
+	b.logf(Info, "Creating new file %s...", archive.fileName)
+
+	// Архив для несжимаемых файлов, создаётся при необходимости
+	var storeArchive *archiveWriter
 
-	tarWriter := tar.NewWriter(compressor)
+	abort := func() {
+		archive.Abort()
+		if storeArchive != nil {
+			storeArchive.Abort()
+		}
+	}
 
 	b.log(Info, "Copying files...")
 
 	addedFileIndex := make(Index)
 
+	// Архивированные копии содержимого файлов для дедупликации
+	contents := newContentIndex(index)
+
+	// Сигнатуры блоков новых версий больших файлов, сохраняются после индекса
+	blockSignatures := make(map[string]*blockSignature)
+
 	i := 0              // processed file count
 	addSize := int64(0) // added bytes
-	for k := range b.planChan(index) {
+	duplicateCount, duplicateSize := 0, int64(0)
+	deltaCount := 0
+	for k := range files {
 		i++
 		addSize += k.fileSize
-		err := b.addFileToTarWriter(k.filePath, tarWriter)
+
+		location, duplicate, err := b.duplicateLocation(k, contents)
+		if err != nil {
+			b.logf(Error, "calculate checksum error %s: %v\n", k.filePath, err)
+		}
+
+		if duplicate {
+			archiveFileName, paxRecords, err := archive.nextEntryLocation()
+			if err != nil {
+				abort()
+				return fmt.Errorf("flush archive error: %v", err)
+			}
+
+			err = b.addLinkToTarWriter(k.filePath, location, archive.tarWriter, paxRecords)
+			if err != nil {
+				abort()
+				return fmt.Errorf("add file error: %v", err)
+			}
+			archive.addChecksum(k.filePath, location.Digest)
+			archive.fileCount++
+			duplicateCount++
+			duplicateSize += k.fileSize
+			addedFileIndex.AddFileInfo(k.filePath, FileInfo{ArchiveFileName: archiveFileName, ModificationTime: k.ModificationTime, Digest: location.Digest, fileSize: k.fileSize})
+			continue
+		}
+
+		if base := b.deltaBase(k, index); base != nil {
+			archiveFileName, paxRecords, err := archive.nextEntryLocation()
+			if err != nil {
+				abort()
+				return fmt.Errorf("flush archive error: %v", err)
+			}
+
+			signature, err := b.addDeltaToTarWriter(k.filePath, base, archive.tarWriter, paxRecords)
+			if err != nil {
+				b.logf(Error, "add file error %s: %v\n", k.filePath, err)
+				if b.StopOnAnyError {
+					abort()
+					return fmt.Errorf("add file error: %v", err)
+				}
+				continue
+			}
+			signature.Archive = archiveFileName
+			blockSignatures[k.filePath] = signature
+
+			archive.addChecksum(k.filePath, signature.Digest)
+			archive.fileCount++
+			deltaCount++
+			addedFileIndex.AddFileInfo(k.filePath, FileInfo{ArchiveFileName: archiveFileName, ModificationTime: k.ModificationTime, Digest: signature.Digest, fileSize: k.fileSize})
+			continue
+		}
+
+		w := archive
+		if codec.Name != "none" {
+			store, err := b.Compression.shouldStore(k.filePath, k.fileSize)
+			if err != nil {
+				b.logf(Error, "compressibility check error %s: %v\n", k.filePath, err)
+			}
+
+			if store {
+				if storeArchive == nil {
+					storeArchive, err = newArchiveWriter(b.storage(), baseName, storeCodec, &b.Compression, int64(b.MaxVolumeSize), &b.Encryption)
+					if err != nil {
+						abort()
+						return err
+					}
+					b.logf(Info, "Creating new file %s for incompressible files...", storeArchive.fileName)
+				}
+
+				w = storeArchive
+			}
+		}
+
+		archiveFileName, paxRecords, err := w.nextEntryLocation()
 		if err != nil {
+			abort()
+			return fmt.Errorf("flush archive error: %v", err)
+		}
+
+		var signatureBuilder *blockSignatureBuilder
+		var contentWriters []io.Writer
+		if b.Delta.applies(k.fileSize) {
+			signatureBuilder = newBlockSignatureBuilder(b.Delta.blockSize())
+			contentWriters = append(contentWriters, signatureBuilder)
+		}
+
+		digest, err := b.addFileToTarWriter(k.filePath, w.tarWriter, paxRecords, contentWriters...)
+		if err == nil {
+			w.addChecksum(k.filePath, digest)
+			b.addContent(contents, k, archiveFileName, digest)
+			if signatureBuilder != nil {
+				signature := signatureBuilder.Finish()
+				signature.Archive = archiveFileName
+				blockSignatures[k.filePath] = signature
+			}
+		} else {
 			b.logf(Error, "add file error %s: %v\n", k.filePath, err)
 			if b.StopOnAnyError {
-				compressor.Close()
-				resultArchiveFile.Close()
-				os.Remove(filePath)
-				return fmt.Errorf("add file error: %v", err) // TODO: организовать закрытие и удаление частичного файла
+				abort()
+				return fmt.Errorf("add file error: %v", err)
 			}
 		}
-		addedFileIndex.AddFile(k.filePath, filepath.Base(filePath), k.ModificationTime)
+		w.fileCount++
+		addedFileIndex.AddFileInfo(k.filePath, FileInfo{ArchiveFileName: archiveFileName, ModificationTime: k.ModificationTime, Digest: digest, fileSize: k.fileSize})
 	}
 
-	err = tarWriter.Close()
-	if err != nil {
-		compressor.Close()
-		resultArchiveFile.Close()
-		os.Remove(filePath)
-		return fmt.Errorf("close tar file error: %v", err)
+	if err := report.Err(); err != nil {
+		abort()
+		return fmt.Errorf("get file list error: %v", err)
 	}
 
-	err = compressor.Close()
-	if err != nil {
-		resultArchiveFile.Close()
-		os.Remove(filePath)
-		return fmt.Errorf("close compressor error: %v", err)
+	for _, w := range []*archiveWriter{archive, storeArchive} {
+		if w == nil {
+			continue
+		}
+
+		err = w.Close()
+		if err != nil {
+			abort()
+			return err
+		}
+
+		// если в архив не было добавлено файлов, удалить пустой файл
+		if w.fileCount == 0 {
+			w.remove()
+		}
+	}
+
+	var fileNames []string
+	for _, w := range []*archiveWriter{archive, storeArchive} {
+		if w != nil && w.fileCount > 0 {
+			fileNames = append(fileNames, w.fileNames()...)
+		}
 	}
 
-	err = resultArchiveFile.Close()
+	b.logAdded(i, addSize)
+	if storeArchive != nil {
+		b.logf(Info, "%d incompressible files stored without compression.", storeArchive.fileCount)
+	}
+	if duplicateCount > 0 {
+		b.logf(Info, "%d duplicate files stored as references, %s saved.", duplicateCount, sizeToApproxHuman(duplicateSize))
+	}
+	if deltaCount > 0 {
+		b.logf(Info, "%d modified files stored as delta.", deltaCount)
+	}
+	b.logReport(&report)
+
+	addedFileIndex.setMediaLabel(mediaLabel)
+
+	err = b.commitBackup(index, addedFileIndex, baseName, fileNames)
 	if err != nil {
-		return fmt.Errorf("close file error: %v", err)
+		return err
 	}
 
-	if i == 0 {
+	// Сигнатуры описывают версии из индекса, поэтому сохраняются после него
+	for filePath, signature := range blockSignatures {
+		err = b.writeBlockSignature(filePath, signature)
+		if err != nil {
+			b.logf(Error, "write block signature error %s: %v", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+// logAdded logs number and size of added files
+func (b *Config) logAdded(count int, addSize int64) {
+	if count == 0 {
 		b.logf(Info, "No new or updated files found.")
-	} else if i == 1 {
-		b.logf(Info, "%d file added, %s.", i, sizeToApproxHuman(addSize))
+	} else if count == 1 {
+		b.logf(Info, "%d file added, %s.", count, sizeToApproxHuman(addSize))
 	} else {
-		b.logf(Info, "%d files added, %s.", i, sizeToApproxHuman(addSize))
+		b.logf(Info, "%d files added, %s.", count, sizeToApproxHuman(addSize))
 	}
+}
 
-	// если не было обновлений, удалить пустой файл
-	if i == 0 {
-		err = os.Remove(filePath)
-		if err != nil {
-			return err
+// logReport logs files skipped by filters and overlapping patterns
+func (b *Config) logReport(report *Report) {
+	if len(report.SkippedFiles) > 0 {
+		b.logf(Info, "%d files skipped by filters:", len(report.SkippedFiles))
+		for _, skippedFile := range report.SkippedFiles {
+			b.logf(Info, "\t%s: %s", skippedFile.FilePath, skippedFile.Reason)
 		}
 	}
 
+	for _, overlap := range report.Overlaps {
+		b.logf(Warn, "Patterns %s and %s overlap, %d files matched by both are added once.", overlap.First.Path, overlap.Second.Path, overlap.FileCount)
+	}
+}
+
+// commitBackup adds file versions stored by backup run to index, saves index
+// and signs files created by the run. Additional repository files updated by
+// the run are signed along with the index.
+func (b *Config) commitBackup(index, addedFileIndex Index, baseName string, fileNames []string, indexFileNames ...string) error {
 	// если были обновления - обновить индексный файл
-	if i > 0 {
-		for fileName, fileHistory := range addedFileIndex {
-			for _, historyItem := range fileHistory {
-				index.AddFile(fileName, historyItem.ArchiveFileName, historyItem.ModificationTime)
-			}
+	if len(addedFileIndex) == 0 {
+		return nil
+	}
+
+	for fileName, fileHistory := range addedFileIndex {
+		for _, historyItem := range fileHistory {
+			index.AddFileInfo(fileName, historyItem)
+		}
+	}
+
+	// Словарь сохраняется только вместе с архивами, сжатыми с ним
+	if b.Compression.dictionaryTrained {
+		err := b.writeDictionary(baseName+dictExt, b.Compression.dictionary)
+		if err != nil {
+			return err
 		}
+		b.Compression.dictionaryTrained = false
+		fileNames = append(fileNames, baseName+dictExt)
+	}
 
-		err = index.Save(filepath.Join(filepath.Dir(b.filePath), indexFileName))
+	err := index.Save(b.storage(), b.indexFileName(), &b.Encryption, b.indexEncoderOptions()...)
+	if err != nil {
+		return err
+	}
+	b.catalog = nil
+
+	if b.Signing.Enabled() {
+		err = b.signBackup(baseName, fileNames, append([]string{b.indexFileName()}, indexFileNames...))
 		if err != nil {
 			return err
 		}
@@ -217,18 +531,20 @@ func (b *Config) doBackup(index Index) error {
 	return nil
 }
 
-func (b *Config) addFileToTarWriter(filePath string, tarWriter *tar.Writer) error {
+// addFileToTarWriter adds file to archive and returns hex SHA-256 of its content.
+// File content is also written to contentWriters.
+func (b *Config) addFileToTarWriter(filePath string, tarWriter *tar.Writer, paxRecords map[string]string, contentWriters ...io.Writer) (string, error) {
 	b.logf(Debug, "Adding file %s...\n", filePath)
 
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("Could not open file '%s', got error '%s'", filePath, err.Error())
+		return "", fmt.Errorf("Could not open file '%s', got error '%s'", filePath, err.Error())
 	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("Could not get stat for file '%s', got error '%s'", filePath, err.Error())
+		return "", fmt.Errorf("Could not get stat for file '%s', got error '%s'", filePath, err.Error())
 	}
 
 	header := &tar.Header{
@@ -237,15 +553,21 @@ func (b *Config) addFileToTarWriter(filePath string, tarWriter *tar.Writer) erro
 		Size:    stat.Size(),
 		ModTime: stat.ModTime()}
 
+	if paxRecords != nil {
+		header.Format = tar.FormatPAX
+		header.PAXRecords = paxRecords
+	}
+
 	err = tarWriter.WriteHeader(header)
 	if err != nil {
-		return fmt.Errorf("Could not write header for file '%s', got error '%s'", filePath, err.Error())
+		return "", fmt.Errorf("Could not write header for file '%s', got error '%s'", filePath, err.Error())
 	}
 
-	_, err = io.Copy(tarWriter, file)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(append([]io.Writer{tarWriter, h}, contentWriters...)...), file)
 	if err != nil {
-		return fmt.Errorf("Could not copy the file '%s' data to the tarball, got error '%s'", filePath, err.Error())
+		return "", fmt.Errorf("Could not copy the file '%s' data to the tarball, got error '%s'", filePath, err.Error())
 	}
 
-	return nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileListMaxDepth(t *testing.T) {
+	root := t.TempDir()
+	for _, filePath := range []string{"a.txt", "sub/b.txt", "sub/deep/c.txt"} {
+		filePath = filepath.Join(root, filePath)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+	}
+
+	tests := []struct {
+		maxDepth int
+		expected []string
+	}{
+		{0, []string{"a.txt"}},
+		{1, []string{"a.txt", "sub/b.txt"}},
+		{-1, []string{"a.txt", "sub/b.txt", "sub/deep/c.txt"}},
+	}
+
+	for _, test := range tests {
+		config := &Config{
+			LogLevel: Error,
+			Patterns: []*Pattern{{
+				Path:                root,
+				FileNamePatternList: PatternList{"*"},
+				FilePathPatternList: PatternList{"**"},
+				MaxDepth:            test.maxDepth}}}
+
+		fileNames := make(chan FileInfo, 16)
+		config.fileList(fileNames, nil)
+
+		var got []string
+		for file := range fileNames {
+			relPath, err := filepath.Rel(root, file.filePath)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(4), file.fileSize)
+			got = append(got, filepath.ToSlash(relPath))
+		}
+		sort.Strings(got)
+
+		assert.Equal(t, test.expected, got, "MaxDepth = %d", test.maxDepth)
+	}
+}
+
+func TestFileListOverlappingPatterns(t *testing.T) {
+	root := t.TempDir()
+	for _, filePath := range []string{"a.conf", "nginx/nginx.conf", "nginx/mime.types"} {
+		filePath = filepath.Join(root, filePath)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+	}
+
+	config := &Config{
+		LogLevel: Error,
+		Patterns: []*Pattern{
+			{Path: root, FileNamePatternList: PatternList{"*.conf"}, FilePathPatternList: PatternList{"**"}, MaxDepth: -1},
+			{Path: filepath.Join(root, "nginx") + string(filepath.Separator), FileNamePatternList: PatternList{"*"}, FilePathPatternList: PatternList{"**"}}}}
+
+	var report Report
+	fileNames := make(chan FileInfo, 16)
+	config.fileList(fileNames, &report)
+
+	count := 0
+	for range fileNames {
+		count++
+	}
+
+	assert.Equal(t, 3, count)
+	assert.Len(t, report.Overlaps, 1)
+	assert.Equal(t, config.Patterns[0], report.Overlaps[0].First)
+	assert.Equal(t, config.Patterns[1], report.Overlaps[0].Second)
+	assert.Equal(t, 1, report.Overlaps[0].FileCount)
+}
+
+func TestBackupDestination(t *testing.T) {
+	root := t.TempDir()
+	filePath := filepath.ToSlash(filepath.Join(root, "a.txt"))
+	assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+
+	configDir := t.TempDir()
+	config := &Config{
+		FileName:    "backup",
+		LogLevel:    Error,
+		Destination: filepath.Join("archives", "disk1"),
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(configDir, "config.toml")}
+
+	assert.Equal(t, filepath.Join(configDir, "archives", "disk1"), config.destination())
+	assert.NoError(t, config.FullBackup())
+
+	archives, err := filepath.Glob(filepath.Join(configDir, "archives", "disk1", "backup_*"+archiveExtMask))
+	assert.NoError(t, err)
+	assert.Len(t, archives, 1)
+	assert.FileExists(t, filepath.Join(configDir, "archives", "disk1", "backup"+indexFileExt))
+
+	// Index is rebuilt from the destination directory
+	assert.NoError(t, os.Remove(config.indexFilePath()))
+	index, err := config.index(true)
+	assert.NoError(t, err)
+	assert.Contains(t, index, filePath)
+
+	toDir := t.TempDir()
+	plan, err := config.extractionPlan("*", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, config.extract(plan, toDir))
+	assert.FileExists(t, filepath.Join(toDir, clean(filePath)))
+
+	config.Destination = t.TempDir()
+	assert.Equal(t, config.Destination, config.destination())
+}
+
+func TestFileListExcludedDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, filePath := range []string{"a.txt", "build/b.txt", "sub/build/c.txt", "sub/d.txt"} {
+		filePath = filepath.Join(root, filePath)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+	}
+
+	mask := &Pattern{
+		Path:                root,
+		FileNamePatternList: PatternList{"*"},
+		FilePathPatternList: PatternList{"**"},
+		MaxDepth:            -1}
+	config := &Config{
+		LogLevel:                      Error,
+		GlobalExcludeFilePathPatterns: PatternList{"**/build/**"},
+		Patterns:                      []*Pattern{mask}}
+
+	entries, err := os.ReadDir(root)
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		skip, err := config.skipDir(mask, filepath.Join(root, entry.Name()), entry, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, entry.Name() == "build", skip, entry.Name())
+	}
+
+	fileNames := make(chan FileInfo, 16)
+	config.fileList(fileNames, nil)
+
+	var got []string
+	for file := range fileNames {
+		relPath, err := filepath.Rel(root, file.filePath)
+		assert.NoError(t, err)
+		got = append(got, filepath.ToSlash(relPath))
+	}
+	sort.Strings(got)
+
+	assert.Equal(t, []string{"a.txt", "sub/d.txt"}, got)
+}
+
+func TestFileListOneFileSystem(t *testing.T) {
+	root := t.TempDir()
+	filePath := filepath.Join(root, "sub", "a.txt")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+	assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+
+	mask := &Pattern{
+		Path:                root,
+		FileNamePatternList: PatternList{"*"},
+		FilePathPatternList: PatternList{"**"},
+		MaxDepth:            -1,
+		OneFileSystem:       true}
+	config := &Config{LogLevel: Error, Patterns: []*Pattern{mask}}
+
+	// Directories on the same file system are scanned
+	fileNames := make(chan FileInfo, 16)
+	config.fileList(fileNames, nil)
+	count := 0
+	for range fileNames {
+		count++
+	}
+	assert.Equal(t, 1, count)
+
+	// Directories on other file systems are skipped
+	info, err := os.Stat(root)
+	assert.NoError(t, err)
+	if device, ok := deviceID(info); ok {
+		entries, err := os.ReadDir(root)
+		assert.NoError(t, err)
+		skip, err := config.skipDir(mask, filepath.Join(root, "sub"), entries[0], device+1)
+		assert.NoError(t, err)
+		assert.True(t, skip)
+	}
+
+	// Missing root stops file list only with StopOnAnyError
+	missing := *mask
+	missing.Path = filepath.Join(root, "missing")
+	config.Patterns = []*Pattern{&missing, mask}
+	for _, stop := range []bool{false, true} {
+		config.StopOnAnyError = stop
+
+		var report Report
+		fileNames := make(chan FileInfo, 16)
+		config.fileList(fileNames, &report)
+		count := 0
+		for range fileNames {
+			count++
+		}
+
+		if stop {
+			assert.Error(t, report.Err())
+			assert.Zero(t, count)
+		} else {
+			assert.NoError(t, report.Err())
+			assert.Equal(t, 1, count)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	defaultMinChunkSize     = 256 << 10
+	defaultAverageChunkSize = 1 << 20
+	defaultMaxChunkSize     = 4 << 20
+	defaultPackSize         = 16 << 20
+)
+
+// ChunkingConfig contains settings of content-defined chunking
+type ChunkingConfig struct {
+	// Minimal chunk size
+	MinChunkSize FileSize
+
+	// Average chunk size, must be a power of two
+	AverageChunkSize FileSize
+
+	// Maximal chunk size
+	MaxChunkSize FileSize
+
+	// Size of pack files containing chunks
+	PackSize FileSize
+}
+
+// sizes returns chunk sizes with defaults applied
+func (config *ChunkingConfig) sizes() (min, average, max int) {
+	min, average, max = int(config.MinChunkSize), int(config.AverageChunkSize), int(config.MaxChunkSize)
+	if min == 0 {
+		min = defaultMinChunkSize
+	}
+	if average == 0 {
+		average = defaultAverageChunkSize
+	}
+	if max == 0 {
+		max = defaultMaxChunkSize
+	}
+
+	return min, average, max
+}
+
+// packSize returns pack file size with default applied
+func (config *ChunkingConfig) packSize() int64 {
+	if config.PackSize == 0 {
+		return defaultPackSize
+	}
+
+	return int64(config.PackSize)
+}
+
+// Validate checks chunk sizes
+func (config *ChunkingConfig) Validate() error {
+	min, average, max := config.sizes()
+
+	if bits.OnesCount(uint(average)) != 1 {
+		return fmt.Errorf("average chunk size %d is not a power of two", average)
+	}
+
+	if min <= 0 || min >= average || average >= max {
+		return fmt.Errorf("chunk sizes must satisfy 0 < min < average < max, got %d, %d, %d", min, average, max)
+	}
+
+	return nil
+}
+
+// gearTable contains random values for gear rolling hash.
+// Values are generated with a fixed seed, so chunk boundaries are stable.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+
+	// splitmix64
+	state := uint64(0x6261636b75706572)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}()
+
+// chunker splits stream into content-defined chunks. A chunk boundary is
+// placed where gear rolling hash of the last bytes has enough zero bits, so
+// inserting or removing data changes only the chunks around the change.
+type chunker struct {
+	r io.Reader
+
+	min, max int
+	mask     uint64
+
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func newChunker(r io.Reader, min, average, max int) *chunker {
+	// Use high bits of the hash, they depend on more input bytes
+	mask := uint64(average-1) << (64 - bits.Len(uint(average-1)))
+
+	return &chunker{r: r, min: min, max: max, mask: mask, buf: make([]byte, max)}
+}
+
+// Next returns next chunk or io.EOF at the end of stream.
+// Returned slice is valid until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	n := c.end - c.start
+	if n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := n
+	if n > c.min {
+		var hash uint64
+		for i := c.min; i < n; i++ {
+			hash = (hash << 1) + gearTable[c.buf[c.start+i]]
+			if hash&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+
+	return chunk, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+
+	c := newChunker(bytes.NewReader(data), 256, 1024, 4096)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+
+		chunks = append(chunks, append([]byte{}, chunk...))
+	}
+
+	return chunks
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, data)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.GreaterOrEqual(t, len(chunk), 256)
+		assert.LessOrEqual(t, len(chunk), 4096)
+	}
+
+	// Inserted byte changes only chunks around the change
+	modified := append(append(append([]byte{}, data[:1000]...), 'x'), data[1000:]...)
+	modifiedChunks := chunkAll(t, modified)
+
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range modifiedChunks {
+		if !known[string(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+
+	assert.Empty(t, chunkAll(t, nil))
+}
+
+func TestChunkingConfigValidate(t *testing.T) {
+	assert.NoError(t, (&ChunkingConfig{}).Validate())
+	assert.Error(t, (&ChunkingConfig{AverageChunkSize: 1000}).Validate())
+	assert.Error(t, (&ChunkingConfig{MinChunkSize: 4 << 20}).Validate())
+}
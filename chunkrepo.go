@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunked repository layout in the repository storage:
+//
+//	<FileName>.chunks/chunks.csv.zst - chunk index: id;pack;offset;length
+//	<FileName>.chunks/packs/*.pack   - pack files with chunks
+//	<FileName>_<time><f|i>.snap      - snapshot with chunk lists of files added by run
+//
+// Pack file is zstd compressed and encrypted with the archive key. Its
+// content is a sequence of records: chunk SHA-256 (32 bytes) | big-endian
+// uint32 chunk length | chunk data, so the chunk index can be rebuilt from
+// packs. Chunk index is encrypted with the index key, so incremental
+// backups can deduplicate chunks without the archive private key.
+const (
+	formatTar     = "tar"
+	formatChunked = "chunked"
+
+	chunkRepositoryDirExt = ".chunks"
+	chunkIndexFileName    = "chunks.csv.zst"
+	packDirName           = "packs"
+	packExt               = ".pack"
+
+	chunkIDSize         = sha256.Size
+	packRecordHeaderLen = chunkIDSize + 4
+
+	// Number of decoded packs kept in memory during restore
+	packCacheSize = 8
+)
+
+// chunkLocation describes position of chunk data in uncompressed pack content
+type chunkLocation struct {
+	Pack   string
+	Offset int64
+	Length int64
+}
+
+// chunkRepository stores chunks addressed by their SHA-256 in pack files
+type chunkRepository struct {
+	storage Storage
+
+	// Object name prefix of repository files
+	prefix string
+
+	encryption *EncryptionConfig
+	options    []zstd.EOption
+	packSize   int64
+
+	minChunkSize, averageChunkSize, maxChunkSize int
+
+	// Chunk id (hex SHA-256) - location
+	chunks map[string]chunkLocation
+
+	// Pack being written
+	pack *packWriter
+
+	// Names of packs created since the repository was opened
+	newPacks []string
+
+	// Recently read packs, the most recently used is the last
+	packCache []cachedPack
+}
+
+// cachedPack is decoded content of pack
+type cachedPack struct {
+	name string
+	data []byte
+}
+
+// packWriter writes chunks to new pack file
+type packWriter struct {
+	name       string
+	object     ObjectWriter
+	encrypted  io.WriteCloser
+	compressor *zstd.Encoder
+
+	// Bytes of uncompressed content written
+	size int64
+}
+
+// chunkRepositoryPrefix returns object name prefix of chunked repository
+func (b *Config) chunkRepositoryPrefix() string {
+	return b.FileName + chunkRepositoryDirExt
+}
+
+// openChunkRepository opens chunked repository. If chunk index is lost, it is rebuilt from pack files.
+func (b *Config) openChunkRepository() (*chunkRepository, error) {
+	repo := &chunkRepository{
+		storage:    b.storage(),
+		prefix:     b.chunkRepositoryPrefix(),
+		encryption: &b.Encryption,
+		options:    b.indexEncoderOptions(),
+		packSize:   b.Chunking.packSize(),
+		chunks:     make(map[string]chunkLocation)}
+	repo.minChunkSize, repo.averageChunkSize, repo.maxChunkSize = b.Chunking.sizes()
+
+	err := repo.loadIndex()
+	if errors.Is(err, fs.ErrNotExist) {
+		err = repo.rebuildIndex()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read chunk index: %v", err)
+	}
+
+	return repo, nil
+}
+
+// loadIndex reads chunk index file
+func (repo *chunkRepository) loadIndex() error {
+	f, err := repo.storage.Get(repo.prefix+"/"+chunkIndexFileName, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decrypted, err := repo.encryption.newIndexDecryptReader(f)
+	if err != nil {
+		return err
+	}
+
+	dec, err := zstd.NewReader(decrypted)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	csvReader := csv.NewReader(dec)
+	csvReader.Comma = ';'
+	csvReader.FieldsPerRecord = 4
+	for {
+		data, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		offset, err := strconv.ParseInt(data[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		length, err := strconv.ParseInt(data[3], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		repo.chunks[data[0]] = chunkLocation{Pack: data[1], Offset: offset, Length: length}
+	}
+
+	return nil
+}
+
+// rebuildIndex reads all pack files and restores chunk index
+func (repo *chunkRepository) rebuildIndex() error {
+	packs, err := repo.storage.List(repo.prefix + "/" + packDirName + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range packs {
+		name := path.Base(pack.Name)
+		if path.Ext(name) != packExt {
+			continue
+		}
+
+		data, err := repo.readPack(name)
+		if err != nil {
+			return err
+		}
+
+		err = parsePack(data, func(id string, location chunkLocation) {
+			location.Pack = name
+			repo.chunks[id] = location
+		})
+		if err != nil {
+			return fmt.Errorf("pack %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// parsePack calls fn for every chunk record of pack content
+func parsePack(data []byte, fn func(id string, location chunkLocation)) error {
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < packRecordHeaderLen {
+			return errors.New("truncated chunk header")
+		}
+
+		id := hex.EncodeToString(data[offset : offset+chunkIDSize])
+		length := int(binary.BigEndian.Uint32(data[offset+chunkIDSize:]))
+		offset += packRecordHeaderLen
+
+		if len(data)-offset < length {
+			return errors.New("truncated chunk")
+		}
+
+		fn(id, chunkLocation{Offset: int64(offset), Length: int64(length)})
+		offset += length
+	}
+
+	return nil
+}
+
+// saveIndex writes chunk index file
+func (repo *chunkRepository) saveIndex() error {
+	f, err := repo.storage.Put(repo.prefix + "/" + chunkIndexFileName)
+	if err != nil {
+		return err
+	}
+
+	err = repo.writeIndex(f)
+	if err != nil {
+		f.Abort()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (repo *chunkRepository) writeIndex(w io.Writer) error {
+	encrypted, err := repo.encryption.newIndexEncryptWriter(w)
+	if err != nil {
+		return err
+	}
+
+	enc, err := zstd.NewWriter(encrypted, repo.options...)
+	if err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(enc)
+	csvWriter.Comma = ';'
+	for id, location := range repo.chunks {
+		err = csvWriter.Write([]string{id, location.Pack, strconv.FormatInt(location.Offset, 10), strconv.FormatInt(location.Length, 10)})
+		if err != nil {
+			enc.Close()
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		enc.Close()
+		return err
+	}
+
+	err = enc.Close()
+	if err != nil {
+		return err
+	}
+
+	return encrypted.Close()
+}
+
+// AddFile splits file into chunks, stores new chunks and returns snapshot entry
+func (repo *chunkRepository) AddFile(file FileInfo) (SnapshotEntry, error) {
+	entry := SnapshotEntry{Path: file.filePath, ModificationTime: file.ModificationTime}
+
+	f, err := os.Open(file.filePath)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	fileHash := sha256.New()
+	c := newChunker(io.TeeReader(f, fileHash), repo.minChunkSize, repo.averageChunkSize, repo.maxChunkSize)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entry, err
+		}
+
+		id := sha256.Sum256(chunk)
+		hexID := hex.EncodeToString(id[:])
+
+		if _, exists := repo.chunks[hexID]; !exists {
+			err = repo.writeChunk(id[:], chunk)
+			if err != nil {
+				return entry, err
+			}
+		}
+
+		entry.Chunks = append(entry.Chunks, hexID)
+		entry.Size += int64(len(chunk))
+	}
+
+	entry.Digest = hex.EncodeToString(fileHash.Sum(nil))
+
+	return entry, nil
+}
+
+// writeChunk appends chunk to current pack, starting new pack if needed
+func (repo *chunkRepository) writeChunk(id []byte, chunk []byte) error {
+	if repo.pack == nil {
+		err := repo.newPack()
+		if err != nil {
+			return err
+		}
+	}
+
+	header := make([]byte, packRecordHeaderLen)
+	copy(header, id)
+	binary.BigEndian.PutUint32(header[chunkIDSize:], uint32(len(chunk)))
+
+	for _, data := range [][]byte{header, chunk} {
+		_, err := repo.pack.compressor.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	repo.chunks[hex.EncodeToString(id)] = chunkLocation{
+		Pack:   repo.pack.name,
+		Offset: repo.pack.size + packRecordHeaderLen,
+		Length: int64(len(chunk))}
+	repo.pack.size += int64(packRecordHeaderLen + len(chunk))
+
+	if repo.pack.size >= repo.packSize {
+		return repo.closePack()
+	}
+
+	return nil
+}
+
+func (repo *chunkRepository) newPack() error {
+	name := make([]byte, 16)
+	_, err := rand.Read(name)
+	if err != nil {
+		return err
+	}
+
+	pack := &packWriter{name: hex.EncodeToString(name) + packExt}
+	pack.object, err = repo.storage.Put(repo.packFileName(pack.name))
+	if err != nil {
+		return fmt.Errorf("create pack: %v", err)
+	}
+
+	pack.encrypted, err = repo.encryption.newEncryptWriter(pack.object)
+	if err != nil {
+		pack.object.Abort()
+		return err
+	}
+
+	pack.compressor, err = zstd.NewWriter(pack.encrypted, repo.options...)
+	if err != nil {
+		pack.object.Abort()
+		return err
+	}
+
+	repo.pack = pack
+
+	return nil
+}
+
+func (repo *chunkRepository) closePack() error {
+	pack := repo.pack
+	repo.pack = nil
+
+	err := pack.compressor.Close()
+	if err == nil {
+		err = pack.encrypted.Close()
+	}
+	if err != nil {
+		pack.object.Abort()
+		return fmt.Errorf("close pack error: %v", err)
+	}
+
+	err = pack.object.Close()
+	if err != nil {
+		return fmt.Errorf("close pack error: %v", err)
+	}
+	repo.newPacks = append(repo.newPacks, repo.packFileName(pack.name))
+
+	return nil
+}
+
+// Close finishes current pack and saves chunk index
+func (repo *chunkRepository) Close() error {
+	if repo.pack != nil {
+		err := repo.closePack()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(repo.newPacks) == 0 {
+		return nil
+	}
+
+	return repo.saveIndex()
+}
+
+// Abort removes packs created since the repository was opened
+func (repo *chunkRepository) Abort() {
+	if repo.pack != nil {
+		repo.pack.compressor.Close()
+		repo.pack.object.Abort()
+		repo.pack = nil
+	}
+
+	for _, name := range repo.newPacks {
+		repo.storage.Delete(name)
+	}
+}
+
+// packFileName returns object name of pack
+func (repo *chunkRepository) packFileName(name string) string {
+	return repo.prefix + "/" + packDirName + "/" + name
+}
+
+// readPack reads and decodes whole pack content. Recently read packs are
+// cached, so files with chunks interleaved across several packs do not
+// read the same packs again.
+func (repo *chunkRepository) readPack(name string) ([]byte, error) {
+	for i, pack := range repo.packCache {
+		if pack.name == name {
+			copy(repo.packCache[i:], repo.packCache[i+1:])
+			repo.packCache[len(repo.packCache)-1] = pack
+			return pack.data, nil
+		}
+	}
+
+	f, err := repo.storage.Get(repo.packFileName(name), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decrypted, err := repo.encryption.newDecryptReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	data, err := io.ReadAll(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(repo.packCache) == packCacheSize {
+		repo.packCache = repo.packCache[1:]
+	}
+	repo.packCache = append(repo.packCache, cachedPack{name: name, data: data})
+
+	return data, nil
+}
+
+// ReadChunk returns chunk data checked against its id
+func (repo *chunkRepository) ReadChunk(id string) ([]byte, error) {
+	location, exists := repo.chunks[id]
+	if !exists {
+		return nil, fmt.Errorf("chunk %s is missing", id)
+	}
+
+	data, err := repo.readPack(location.Pack)
+	if err != nil {
+		return nil, fmt.Errorf("read pack %s: %v", location.Pack, err)
+	}
+
+	if location.Offset+location.Length > int64(len(data)) {
+		return nil, fmt.Errorf("chunk %s is out of pack %s bounds", id, location.Pack)
+	}
+
+	chunk := data[location.Offset : location.Offset+location.Length]
+
+	digest := sha256.Sum256(chunk)
+	if !strings.EqualFold(hex.EncodeToString(digest[:]), id) {
+		return nil, fmt.Errorf("chunk %s is corrupted", id)
+	}
+
+	return chunk, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig contains archive compression settings
+type CompressionConfig struct {
+	// Codec name: zstd, gzip, s2, snappy or none
+	Codec string
+
+	// Codec specific compression level, 0 - codec default.
+	// zstd: 1-22, gzip: 1-9, s2: 1 - fast, 2 - better, 3 - best
+	Level int
+
+	// Number of encoder goroutines, 0 - codec default
+	Concurrency int
+
+	// Window (block) size, 0 - codec default
+	WindowSize FileSize
+
+	// Store incompressible files without compression in separate .tar archive
+	StoreIncompressible bool
+
+	// Extensions of incompressible files, default list is used if empty
+	StoreExtensions []string
+
+	// Detect incompressible files by probing their content
+	ProbeCompressibility bool
+
+	// Train zstd dictionary from a sample of files on full backup
+	TrainDictionary bool
+
+	// Maximal dictionary size
+	DictionarySize FileSize
+
+	// Total size of files sample used for dictionary training
+	DictionarySampleSize FileSize
+
+	// Only files not larger than this size are used for dictionary training
+	DictionaryMaxFileSize FileSize
+
+	// Dictionary used by encoder
+	dictionary []byte
+
+	// Dictionary is trained by the current backup run and is not stored yet
+	dictionaryTrained bool
+}
+
+// Codec describes archive compression format
+type Codec struct {
+	// Codec name used in config
+	Name string
+
+	// Archive file extension
+	Ext string
+
+	// Magic bytes of compressed stream
+	Magic []byte
+
+	// Maximal compression level, levels start from 1. Zero if codec has no levels.
+	MaxLevel int
+
+	newWriter func(w io.Writer, config *CompressionConfig) (io.WriteCloser, error)
+	newReader func(r io.Reader, dicts [][]byte) (io.ReadCloser, error)
+}
+
+var codecs = []*Codec{
+	{
+		Name:     "zstd",
+		Ext:      ".tar.zst",
+		Magic:    []byte{0x28, 0xb5, 0x2f, 0xfd},
+		MaxLevel: 22,
+		newWriter: func(w io.Writer, config *CompressionConfig) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstdEncoderOptions(config)...)
+		},
+		newReader: func(r io.Reader, dicts [][]byte) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderDicts(dicts...))
+			if err != nil {
+				return nil, err
+			}
+
+			return decoder.IOReadCloser(), nil
+		}},
+	{
+		Name:     "gzip",
+		Ext:      ".tar.gz",
+		Magic:    []byte{0x1f, 0x8b},
+		MaxLevel: 9,
+		newWriter: func(w io.Writer, config *CompressionConfig) (io.WriteCloser, error) {
+			level := gzip.DefaultCompression
+			if config.Level != 0 {
+				level = config.Level
+			}
+
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader, dicts [][]byte) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}},
+	{
+		Name:     "s2",
+		Ext:      ".tar.s2",
+		Magic:    []byte("\xff\x06\x00\x00S2sTwO"),
+		MaxLevel: 3,
+		newWriter: func(w io.Writer, config *CompressionConfig) (io.WriteCloser, error) {
+			return s2.NewWriter(w, s2WriterOptions(config)...), nil
+		},
+		newReader: newS2Reader},
+	{
+		Name:     "snappy",
+		Ext:      ".tar.sz",
+		Magic:    []byte("\xff\x06\x00\x00sNaPpY"),
+		MaxLevel: 3,
+		newWriter: func(w io.Writer, config *CompressionConfig) (io.WriteCloser, error) {
+			return s2.NewWriter(w, append(s2WriterOptions(config), s2.WriterSnappyCompat())...), nil
+		},
+		newReader: newS2Reader},
+	{
+		Name: "none",
+		Ext:  ".tar",
+		newWriter: func(w io.Writer, config *CompressionConfig) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		newReader: func(r io.Reader, dicts [][]byte) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		}},
+}
+
+// codecByName returns codec by its config name
+func codecByName(name string) (*Codec, error) {
+	for _, codec := range codecs {
+		if strings.EqualFold(codec.Name, name) {
+			return codec, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// codecByFileName returns codec by archive file extension or nil if extension is unknown
+func codecByFileName(fileName string) *Codec {
+	for _, codec := range codecs {
+		if strings.HasSuffix(fileName, codec.Ext) {
+			return codec
+		}
+	}
+
+	return nil
+}
+
+// ValidateLevel checks compression level, 0 means codec default
+func (codec *Codec) ValidateLevel(level int) error {
+	if level == 0 {
+		return nil
+	}
+
+	if codec.MaxLevel == 0 {
+		return fmt.Errorf("codec %s has no compression levels", codec.Name)
+	}
+
+	if level < 1 || level > codec.MaxLevel {
+		return fmt.Errorf("level %d is out of range 1-%d of codec %s", level, codec.MaxLevel, codec.Name)
+	}
+
+	return nil
+}
+
+// NewWriter returns compressing writer
+func (codec *Codec) NewWriter(w io.Writer, config *CompressionConfig) (io.WriteCloser, error) {
+	return codec.newWriter(w, config)
+}
+
+// NewReader returns decompressing reader.
+// Dictionaries are used by codecs which support them.
+func (codec *Codec) NewReader(r io.Reader, dicts [][]byte) (io.ReadCloser, error) {
+	return codec.newReader(r, dicts)
+}
+
+// newArchiveReader returns decompressing reader for archive.
+// Codec is detected by archive file extension or by stream header.
+func newArchiveReader(r io.Reader, fileName string, dicts [][]byte) (io.ReadCloser, error) {
+	codec, r := detectArchiveCodec(r, fileName)
+	if codec == nil {
+		return io.NopCloser(r), nil
+	}
+
+	return codec.NewReader(r, dicts)
+}
+
+// detectArchiveCodec returns archive codec detected by file extension or by
+// stream header and reader of the whole stream. Nil codec is returned for
+// streams without known header.
+func detectArchiveCodec(r io.Reader, fileName string) (*Codec, io.Reader) {
+	if codec := codecByFileName(fileName); codec != nil {
+		return codec, r
+	}
+
+	bufReader := bufio.NewReader(r)
+	for _, codec := range codecs {
+		if len(codec.Magic) == 0 {
+			continue
+		}
+
+		header, _ := bufReader.Peek(len(codec.Magic))
+		if bytes.Equal(header, codec.Magic) {
+			return codec, bufReader
+		}
+	}
+
+	return nil, bufReader
+}
+
+func zstdEncoderOptions(config *CompressionConfig) []zstd.EOption {
+	level := zstd.SpeedBestCompression
+	if config.Level != 0 {
+		level = zstd.EncoderLevelFromZstd(config.Level)
+	}
+
+	options := []zstd.EOption{zstd.WithEncoderLevel(level)}
+	if config.Concurrency > 0 {
+		options = append(options, zstd.WithEncoderConcurrency(config.Concurrency))
+	}
+	if config.WindowSize > 0 {
+		options = append(options, zstd.WithWindowSize(int(config.WindowSize)))
+	}
+	if config.dictionary != nil {
+		options = append(options, zstd.WithEncoderDict(config.dictionary))
+	}
+
+	return options
+}
+
+func s2WriterOptions(config *CompressionConfig) []s2.WriterOption {
+	var options []s2.WriterOption
+
+	switch {
+	case config.Level == 2:
+		options = append(options, s2.WriterBetterCompression())
+	case config.Level >= 3:
+		options = append(options, s2.WriterBestCompression())
+	}
+	if config.Concurrency > 0 {
+		options = append(options, s2.WriterConcurrency(config.Concurrency))
+	}
+	if config.WindowSize > 0 {
+		options = append(options, s2.WriterBlockSize(int(config.WindowSize)))
+	}
+
+	return options
+}
+
+func newS2Reader(r io.Reader, dicts [][]byte) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(r)), nil
+}
+
+// nopWriteCloser adds no-op Close method to io.Writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("backuper test data "), 1000)
+
+	for _, codec := range codecs {
+		var buf bytes.Buffer
+
+		w, err := codec.NewWriter(&buf, &CompressionConfig{Concurrency: 1})
+		assert.NoError(t, err, codec.Name)
+		_, err = w.Write(data)
+		assert.NoError(t, err, codec.Name)
+		assert.NoError(t, w.Close(), codec.Name)
+
+		// Detection by file extension
+		r, err := newArchiveReader(bytes.NewReader(buf.Bytes()), "backup"+codec.Ext, nil)
+		assert.NoError(t, err, codec.Name)
+		got, err := io.ReadAll(r)
+		assert.NoError(t, err, codec.Name)
+		assert.NoError(t, r.Close(), codec.Name)
+		assert.Equal(t, data, got, codec.Name)
+
+		// Detection by stream header
+		r, err = newArchiveReader(bytes.NewReader(buf.Bytes()), "backup", nil)
+		assert.NoError(t, err, codec.Name)
+		got, err = io.ReadAll(r)
+		assert.NoError(t, err, codec.Name)
+		assert.Equal(t, data, got, codec.Name)
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	codec, err := codecByName("ZSTD")
+	assert.NoError(t, err)
+	assert.Equal(t, ".tar.zst", codec.Ext)
+
+	_, err = codecByName("lzma")
+	assert.Error(t, err)
+
+	assert.Equal(t, "gzip", codecByFileName("backup_2023-01-01_00-00-00f.tar.gz").Name)
+	assert.Nil(t, codecByFileName("backup.zip"))
+}
+
+func TestCodecValidateLevel(t *testing.T) {
+	tests := []struct {
+		codec string
+		level int
+		valid bool
+	}{
+		{"zstd", 0, true},
+		{"zstd", 22, true},
+		{"zstd", 23, false},
+		{"gzip", 9, true},
+		{"gzip", 10, false},
+		{"gzip", -1, false},
+		{"s2", 3, true},
+		{"s2", 7, false},
+		{"snappy", 4, false},
+		{"none", 0, true},
+		{"none", 1, false},
+	}
+
+	for _, test := range tests {
+		codec, err := codecByName(test.codec)
+		assert.NoError(t, err)
+
+		err = codec.ValidateLevel(test.level)
+		if test.valid {
+			assert.NoError(t, err, "%s %d", test.codec, test.level)
+		} else {
+			assert.Error(t, err, "%s %d", test.codec, test.level)
+		}
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/tidwall/match"
+	"github.com/klauspost/compress/zstd"
 
 	"github.com/BurntSushi/toml"
 )
@@ -20,18 +20,75 @@ type Config struct {
 	Patterns []*Pattern
 
 	// Маски файлов для исключения
-	GlobalExcludeFileNamePatterns []string
+	GlobalExcludeFileNamePatterns PatternList
 
 	// Маски путей для исключения
-	GlobalExcludeFilePathPatterns []string
+	GlobalExcludeFilePathPatterns PatternList
+
+	// Глобальные фильтры по размеру, возрасту и типу файлов
+	FileFilter
 
 	// Останавливать обработку при любой ошибке
 	StopOnAnyError bool
 
+	// Имя файлов со списком исключений (синтаксис .gitignore)
+	IgnoreFileName string
+
+	// Максимальный размер тома архива, 0 - без разбиения на тома
+	MaxVolumeSize FileSize
+
+	// Каталог для архивов и индекса, абсолютный или относительно файла настроек.
+	// По умолчанию - каталог файла настроек
+	Destination string
+
+	// Имя индексного файла, по умолчанию <FileName>.index.csv.zst
+	IndexFileName string
+
+	// Настройки хранилища архивов и индекса
+	Storage StorageConfig
+
+	// Настройки хранения архивов на сменных носителях
+	Media MediaConfig
+
+	// Копии хранилища, получающие новые архивы и индекс после каждого бекапа
+	Replicas []*ReplicaConfig
+
+	// Формат хранилища: "tar" (по умолчанию) - сжатые tar-архивы,
+	// "chunked" - дедуплицированное хранилище блоков
+	Format string
+
+	// Настройки разбиения файлов на блоки для формата "chunked"
+	Chunking ChunkingConfig
+
+	// Настройки сжатия архивов
+	Compression CompressionConfig
+
+	// Настройки дедупликации файлов с одинаковым содержимым
+	Deduplication DeduplicationConfig
+
+	// Настройки хранения изменённых больших файлов в виде разницы с предыдущей версией
+	Delta DeltaConfig
+
+	// Настройки шифрования архивов и индекса
+	Encryption EncryptionConfig
+
+	// Настройки подписи архивов и индекса
+	Signing SigningConfig
+
 	// Уровень логирования
 	LogLevel LogLevel
 
 	filePath string
+
+	// Хранилище, создаётся при первом обращении
+	storageBackend Storage
+
+	// Каталог архивов на сменных носителях, читается из индекса при первом обращении
+	catalog MediaCatalog
+
+	// Словари задания, читаются при первом открытии архива zstd
+	dicts       [][]byte
+	dictsLoaded bool
 }
 
 func (config *Config) Save(filepath string) error {
@@ -63,9 +120,78 @@ func LoadConfig(filePath string) (*Config, error) {
 		return nil, fmt.Errorf("decode file: %v", err)
 	}
 
+	switch config.Format {
+	case "", formatTar:
+	case formatChunked:
+		if err := config.Chunking.Validate(); err != nil {
+			return nil, fmt.Errorf("chunking: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", config.Format)
+	}
+
+	codec, err := config.archiveCodec()
+	if err != nil {
+		return nil, fmt.Errorf("compression: %v", err)
+	}
+	if err := codec.ValidateLevel(config.Compression.Level); err != nil {
+		return nil, fmt.Errorf("compression: %v", err)
+	}
+
+	if err := config.Encryption.Validate(); err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+
+	if err := config.Storage.Validate(); err != nil {
+		return nil, fmt.Errorf("storage: %v", err)
+	}
+
+	if err := config.Media.Validate(&config.Storage, config.Format); err != nil {
+		return nil, fmt.Errorf("media: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, replica := range config.Replicas {
+		if err := replica.Validate(); err != nil {
+			return nil, fmt.Errorf("replica %s: %v", replica.Name, err)
+		}
+		if names[replica.Name] {
+			return nil, fmt.Errorf("duplicate replica name %s", replica.Name)
+		}
+		names[replica.Name] = true
+	}
+
+	if err := config.Delta.Validate(); err != nil {
+		return nil, fmt.Errorf("delta: %v", err)
+	}
+
+	if err := config.Signing.Validate(); err != nil {
+		return nil, fmt.Errorf("signing: %v", err)
+	}
+
+	if config.IgnoreFileName == "" {
+		config.IgnoreFileName = defaultIgnoreFileName
+	}
+
 	for _, mask := range config.Patterns {
+		if mask.Recursive && mask.MaxDepth == 0 {
+			mask.MaxDepth = -1
+		}
+
 		if len(mask.FilePathPatternList) == 0 {
-			mask.FilePathPatternList = []string{"*"}
+			mask.FilePathPatternList = PatternList{"**"}
+		}
+
+		for _, patterns := range []PatternList{mask.FileNamePatternList, mask.FilePathPatternList, mask.ExcludeDirPatternList} {
+			if err := patterns.Validate(); err != nil {
+				return nil, fmt.Errorf("pattern %s: %v", mask.Path, err)
+			}
+		}
+	}
+
+	for _, patterns := range []PatternList{config.GlobalExcludeFileNamePatterns, config.GlobalExcludeFilePathPatterns} {
+		if err := patterns.Validate(); err != nil {
+			return nil, fmt.Errorf("global exclude: %v", err)
 		}
 	}
 
@@ -78,12 +204,67 @@ func LoadConfig(filePath string) (*Config, error) {
 	return &config, nil
 }
 
+// destination возвращает каталог для архивов и индекса
+func (b *Config) destination() string {
+	return b.resolvePath(b.Destination)
+}
+
+// resolvePath возвращает путь относительно каталога файла настроек,
+// для пустого пути - сам каталог
+func (b *Config) resolvePath(path string) string {
+	if path == "" {
+		return filepath.Dir(b.filePath)
+	}
+
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+
+	return filepath.Join(filepath.Dir(b.filePath), path)
+}
+
+// indexFileName возвращает имя индексного файла задания
+func (b *Config) indexFileName() string {
+	if b.IndexFileName != "" {
+		return b.IndexFileName
+	}
+
+	return b.FileName + indexFileExt
+}
+
+// indexFilePath возвращает путь к индексному файлу задания
+func (b *Config) indexFilePath() string {
+	return filepath.Join(b.destination(), b.indexFileName())
+}
+
+// archiveCodec возвращает кодек для создания архивов
+func (b *Config) archiveCodec() (*Codec, error) {
+	if b.Compression.Codec == "" {
+		return codecByName(defaultCodec)
+	}
+
+	return codecByName(b.Compression.Codec)
+}
+
+// indexEncoderOptions возвращает настройки сжатия индексного файла.
+// Индекс всегда сжимается zstd без словаря, уровень берётся из настроек, если для архивов выбран тот же кодек.
+func (b *Config) indexEncoderOptions() []zstd.EOption {
+	if codec, err := b.archiveCodec(); err == nil && codec.Name == "zstd" {
+		compression := b.Compression
+		compression.dictionary = nil
+
+		return zstdEncoderOptions(&compression)
+	}
+
+	return nil
+}
+
 // planChan возвращает канал, в который засылает список файлов для добавления/обновления
-func (b *Config) planChan(index Index) chan FileInfo {
+func (b *Config) planChan(index Index, report *Report) chan FileInfo {
 	allFilesChan := make(chan FileInfo, 64) // TODO: размер очереди?
 	addFilesChan := make(chan FileInfo, 64) // TODO: размер очереди?
 
-	go func() { b.fileList(allFilesChan) }()
+	go func() { b.fileList(allFilesChan, report) }()
 
 	go func() {
 		for file := range allFilesChan {
@@ -118,12 +299,18 @@ func (b *Config) FindAll(pattern string) (Index, error) {
 		return nil, fmt.Errorf("index: %v", err)
 	}
 
+	// Поиск не зависит от регистра
+	patterns := searchPatterns(strings.ToLower(pattern))
+	if err := patterns.Validate(); err != nil {
+		return nil, err
+	}
+
 	result := make(Index)
 
 	for path, info := range index {
-		if match.Match(strings.ToLower(path), pattern) {
+		if patterns.Match(strings.ToLower(path)) {
 			for _, historyItem := range info {
-				result.AddFile(path, historyItem.ArchiveFileName, historyItem.ModificationTime)
+				result.AddFileInfo(path, historyItem)
 			}
 		}
 	}
@@ -1,8 +1,11 @@
 package main
 
 const (
-	// Расширение для файлов архивов
-	defaultExt = ".tar.zst"
+	// Маска расширений файлов архивов всех кодеков
+	archiveExtMask = ".tar*"
+
+	// Кодек сжатия архивов по умолчанию
+	defaultCodec = "zstd"
 
 	// Формат времени для сообщений
 	defaultTimeFormat = "02.01.06 15:04"
@@ -10,6 +13,13 @@ const (
 	// Формат времени для файлов
 	defaulFileNameTimeFormat = "2006-01-02_15-04-05"
 
-	//
-	indexFileName = "index.csv.zst"
+	// Имя файлов со списком исключений по умолчанию
+	defaultIgnoreFileName = ".backupignore"
+
+	// Расширение индексного файла задания: <FileName>.index.csv.zst
+	indexFileExt = ".index.csv.zst"
+
+	// Общий индексный файл предыдущих версий, из него читаются записи
+	// архивов задания, пока не будет сохранён индекс задания
+	legacyIndexFileName = "index.csv.zst"
 )
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PAX record with name of the archive containing content of hard link entry target.
+// Files with content already stored are written as hard links to the stored copy.
+const paxLinkArchiveRecord = "BACKUPER.linkarchive"
+
+// DeduplicationConfig contains settings of whole-file deduplication
+type DeduplicationConfig struct {
+	// Store files with already archived content as references
+	Enabled bool
+
+	// Smaller files are always stored, their content is not hashed in advance
+	MinFileSize FileSize
+}
+
+// contentLocation describes archived copy of file content
+type contentLocation struct {
+	ArchiveFileName string
+	FilePath        string
+	Digest          string
+}
+
+// contentIndex contains archived copies of file contents
+type contentIndex struct {
+	// Content digest - archived copy
+	locations map[string]contentLocation
+
+	// Sizes of archived contents, only files of these sizes are hashed
+	sizes map[int64]bool
+
+	// Index of older version contains contents of unknown size,
+	// all files are hashed until the next full backup
+	unknownSizes bool
+}
+
+// newContentIndex returns locations of file contents with known digests
+func newContentIndex(index Index) *contentIndex {
+	contents := &contentIndex{locations: make(map[string]contentLocation), sizes: make(map[int64]bool)}
+
+	for filePath, fileHistory := range index {
+		for _, fileInfo := range fileHistory {
+			if fileInfo.Digest == "" || isSnapshotFile(fileInfo.ArchiveFileName) {
+				continue
+			}
+
+			if fileInfo.fileSize < 0 {
+				contents.unknownSizes = true
+			} else {
+				contents.sizes[fileInfo.fileSize] = true
+			}
+
+			// Earlier archives are preferred, so references do not form chains
+			if location, exists := contents.locations[fileInfo.Digest]; exists && archiveBaseName(location.ArchiveFileName) <= archiveBaseName(fileInfo.ArchiveFileName) {
+				continue
+			}
+
+			contents.locations[fileInfo.Digest] = contentLocation{ArchiveFileName: fileInfo.ArchiveFileName, FilePath: filePath, Digest: fileInfo.Digest}
+		}
+	}
+
+	return contents
+}
+
+// duplicateLocation returns archived copy of file content if the file is a
+// duplicate. Only files of the same size as some archived content are hashed.
+func (b *Config) duplicateLocation(file FileInfo, contents *contentIndex) (contentLocation, bool, error) {
+	if !b.Deduplication.Enabled || file.fileSize == 0 || file.fileSize < int64(b.Deduplication.MinFileSize) {
+		return contentLocation{}, false, nil
+	}
+
+	if !contents.sizes[file.fileSize] && !contents.unknownSizes {
+		return contentLocation{}, false, nil
+	}
+
+	_, digest, err := fileDigest(file.filePath)
+	if err != nil {
+		return contentLocation{}, false, err
+	}
+
+	location, exists := contents.locations[digest]
+
+	return location, exists, nil
+}
+
+// addContent remembers location of archived file content
+func (b *Config) addContent(contents *contentIndex, file FileInfo, archiveFileName, digest string) {
+	if !b.Deduplication.Enabled || digest == "" || file.fileSize == 0 || file.fileSize < int64(b.Deduplication.MinFileSize) {
+		return
+	}
+
+	if _, exists := contents.locations[digest]; !exists {
+		contents.locations[digest] = contentLocation{ArchiveFileName: archiveFileName, FilePath: file.filePath, Digest: digest}
+		contents.sizes[file.fileSize] = true
+	}
+}
+
+// addLinkToTarWriter adds reference to archived copy of file content
+func (b *Config) addLinkToTarWriter(filePath string, target contentLocation, tarWriter *tar.Writer, paxRecords map[string]string) error {
+	b.logf(Debug, "Adding file %s as reference to %s...\n", filePath, target.FilePath)
+
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("Could not get stat for file '%s', got error '%s'", filePath, err.Error())
+	}
+
+	records := map[string]string{paxLinkArchiveRecord: target.ArchiveFileName}
+	for key, value := range paxRecords {
+		records[key] = value
+	}
+
+	header := &tar.Header{
+		Typeflag:   tar.TypeLink,
+		Format:     tar.FormatPAX,
+		Name:       filepath.ToSlash(filePath),
+		Linkname:   target.FilePath,
+		ModTime:    stat.ModTime(),
+		PAXRecords: records}
+
+	err = tarWriter.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf("Could not write header for file '%s', got error '%s'", filePath, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// archiveLinks returns hard link entries of archive: name - link target
+func archiveLinks(t *testing.T, config *Config, archiveFileName string) map[string]string {
+	f, err := openArchiveFile(config.storage(), archiveFileName)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	decoder, err := config.newArchiveReader(f, archiveFileName)
+	assert.NoError(t, err)
+	defer decoder.Close()
+
+	links := make(map[string]string)
+
+	tarReader := tar.NewReader(decoder)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+
+		if header.Typeflag == tar.TypeLink {
+			links[header.Name] = header.Linkname
+		}
+	}
+
+	return links
+}
+
+func TestDeduplication(t *testing.T) {
+	root := t.TempDir()
+	filePath := func(name string) string {
+		return filepath.ToSlash(filepath.Join(root, name))
+	}
+
+	data := make([]byte, 32<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.NoError(t, os.WriteFile(filePath("a.bin"), data, 0644))
+	assert.NoError(t, os.WriteFile(filePath("copy.bin"), data, 0644))
+	assert.NoError(t, os.WriteFile(filePath("small.txt"), []byte("small"), 0644))
+	assert.NoError(t, os.WriteFile(filePath("small copy.txt"), []byte("small"), 0644))
+
+	config := &Config{
+		FileName:      "backup",
+		LogLevel:      Error,
+		Deduplication: DeduplicationConfig{Enabled: true, MinFileSize: 1 << 10},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(t.TempDir(), "config.toml")}
+
+	assert.NoError(t, config.FullBackup())
+
+	index, err := config.indexFromFile()
+	assert.NoError(t, err)
+	fullArchive := index[filePath("a.bin")][0].ArchiveFileName
+	assert.Equal(t, int64(len(data)), index[filePath("a.bin")][0].fileSize)
+
+	links := archiveLinks(t, config, fullArchive)
+	assert.Len(t, links, 1)
+	for name, target := range links {
+		assert.ElementsMatch(t, []string{filePath("a.bin"), filePath("copy.bin")}, []string{name, target})
+	}
+
+	// Copy in the next run refers to the full backup
+	time.Sleep(time.Second) // archive names contain time with seconds
+	assert.NoError(t, os.WriteFile(filePath("later.bin"), data, 0644))
+	assert.NoError(t, config.IncrementalBackup())
+
+	index, err = config.indexFromFile()
+	assert.NoError(t, err)
+	incrementalArchive := index[filePath("later.bin")][0].ArchiveFileName
+	assert.NotEqual(t, fullArchive, incrementalArchive)
+	assert.Len(t, archiveLinks(t, config, incrementalArchive), 1)
+	assert.Equal(t, index[filePath("a.bin")][0].Digest, index[filePath("later.bin")][0].Digest)
+
+	problems, err := config.Verify(true)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	plan, err := config.extractionPlan("*", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	toDir := t.TempDir()
+	assert.NoError(t, config.extract(plan, toDir))
+
+	for _, name := range []string{"a.bin", "copy.bin", "later.bin", "small.txt", "small copy.txt"} {
+		expected, err := os.ReadFile(filePath(name))
+		assert.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(toDir, clean(filePath(name))))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, got, name)
+	}
+
+	// Missing link target is an error
+	targets := restoreTargets{filePath("missing.bin"): {filepath.Join(toDir, "missing.bin")}}
+	err = config.extractArchive(fullArchive, targets, make(map[string]restoreTargets), make(map[string]restoreTargets))
+	assert.ErrorContains(t, err, "files not found in archive "+fullArchive+": "+filePath("missing.bin"))
+}
+
+func TestDeduplicationSizes(t *testing.T) {
+	index := Index{
+		"/a.bin": {{ArchiveFileName: "backup_f.tar.zst", Digest: "aa", fileSize: 10}},
+		"/b.bin": {{ArchiveFileName: "backup_f.tar.zst", Digest: "bb", fileSize: 20}}}
+
+	contents := newContentIndex(index)
+	assert.Equal(t, map[int64]bool{10: true, 20: true}, contents.sizes)
+	assert.False(t, contents.unknownSizes)
+
+	// Files of other sizes are not hashed, so missing file is not read
+	config := &Config{Deduplication: DeduplicationConfig{Enabled: true}}
+	_, duplicate, err := config.duplicateLocation(FileInfo{filePath: "/missing", fileSize: 15}, contents)
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+	_, _, err = config.duplicateLocation(FileInfo{filePath: "/missing", fileSize: 10}, contents)
+	assert.Error(t, err)
+
+	// Index of older version has no sizes
+	index["/c.bin"] = FileHistory{{ArchiveFileName: "backup_f.tar.zst", Digest: "cc", fileSize: -1}}
+	contents = newContentIndex(index)
+	assert.True(t, contents.unknownSizes)
+	_, _, err = config.duplicateLocation(FileInfo{filePath: "/missing", fileSize: 15}, contents)
+	assert.Error(t, err)
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Large modified files can be stored as binary delta against the previously
+// archived version. Block signatures of the latest archived version of every
+// such file are kept in <FileName>.signatures directory, encrypted with the
+// index key. Delta entry has the same name as the file and PAX record with
+// the archive containing the base version.
+//
+// Delta stream format:
+//
+//	magic | ops
+//
+// where op is 'C' offset length (copy from base version), 'D' length data
+// (literal data) or 'E' (end), numbers are unsigned varints.
+const (
+	paxDeltaArchiveRecord = "BACKUPER.deltaarchive"
+
+	deltaMagic          = "BKPDELTA"
+	blockSignatureMagic = "BKPBSIG1"
+
+	signatureDirExt   = ".signatures"
+	blockSignatureExt = ".bsig"
+
+	defaultDeltaMinFileSize    = 16 << 20
+	defaultDeltaBlockSize      = 64 << 10
+	defaultMaxDeltaChainLength = 8
+
+	// Literal data is flushed to delta stream in parts of this size
+	deltaLiteralFlushSize = 1 << 20
+)
+
+const (
+	deltaOpCopy byte = 'C'
+	deltaOpData byte = 'D'
+	deltaOpEnd  byte = 'E'
+)
+
+// DeltaConfig contains settings of binary delta encoding of modified files
+type DeltaConfig struct {
+	// Store modified large files as delta against previous version
+	Enabled bool
+
+	// Smaller files are always stored in full
+	MinFileSize FileSize
+
+	// Size of blocks matched between versions
+	BlockSize FileSize
+
+	// Maximal number of deltas since the last full copy of file,
+	// file is stored in full when the chain reaches this length
+	MaxChainLength int
+}
+
+func (config *DeltaConfig) minFileSize() int64 {
+	if config.MinFileSize == 0 {
+		return defaultDeltaMinFileSize
+	}
+
+	return int64(config.MinFileSize)
+}
+
+func (config *DeltaConfig) blockSize() int {
+	if config.BlockSize == 0 {
+		return defaultDeltaBlockSize
+	}
+
+	return int(config.BlockSize)
+}
+
+func (config *DeltaConfig) maxChainLength() int {
+	if config.MaxChainLength == 0 {
+		return defaultMaxDeltaChainLength
+	}
+
+	return config.MaxChainLength
+}
+
+// Validate checks delta settings
+func (config *DeltaConfig) Validate() error {
+	if config.BlockSize < 0 {
+		return fmt.Errorf("invalid block size %d", config.BlockSize)
+	}
+
+	if config.MaxChainLength < 0 {
+		return fmt.Errorf("invalid max chain length %d", config.MaxChainLength)
+	}
+
+	return nil
+}
+
+// applies reports whether delta encoding is used for file of given size
+func (config *DeltaConfig) applies(size int64) bool {
+	return config.Enabled && size >= config.minFileSize()
+}
+
+// blockSignature contains rsync-style checksums of blocks of archived file version
+type blockSignature struct {
+	// Archive containing the version
+	Archive string
+
+	// Hex SHA-256 of the version
+	Digest string
+
+	// Number of deltas since the last full copy
+	ChainLength int
+
+	BlockSize int
+	FileSize  int64
+
+	Weak   []uint32
+	Strong [][sha256.Size]byte
+}
+
+// blockSignatureBuilder calculates block signature and digest of written data
+type blockSignatureBuilder struct {
+	signature *blockSignature
+	block     []byte
+	digest    hash.Hash
+}
+
+func newBlockSignatureBuilder(blockSize int) *blockSignatureBuilder {
+	return &blockSignatureBuilder{
+		signature: &blockSignature{BlockSize: blockSize},
+		block:     make([]byte, 0, blockSize),
+		digest:    sha256.New()}
+}
+
+func (builder *blockSignatureBuilder) Write(p []byte) (int, error) {
+	n := len(p)
+	builder.digest.Write(p)
+	builder.signature.FileSize += int64(n)
+
+	for len(p) > 0 {
+		l := min(len(p), builder.signature.BlockSize-len(builder.block))
+		builder.block = append(builder.block, p[:l]...)
+		p = p[l:]
+
+		if len(builder.block) == builder.signature.BlockSize {
+			builder.addBlock()
+		}
+	}
+
+	return n, nil
+}
+
+func (builder *blockSignatureBuilder) addBlock() {
+	builder.signature.Weak = append(builder.signature.Weak, newWeakChecksum(builder.block).Sum())
+	builder.signature.Strong = append(builder.signature.Strong, sha256.Sum256(builder.block))
+	builder.block = builder.block[:0]
+}
+
+// Finish returns signature of all written data
+func (builder *blockSignatureBuilder) Finish() *blockSignature {
+	if len(builder.block) > 0 {
+		builder.addBlock()
+	}
+	builder.signature.Digest = hex.EncodeToString(builder.digest.Sum(nil))
+
+	return builder.signature
+}
+
+// weakChecksum is rsync rolling checksum of a block
+type weakChecksum struct {
+	a, b uint32
+	size uint32
+}
+
+func newWeakChecksum(block []byte) *weakChecksum {
+	c := &weakChecksum{size: uint32(len(block))}
+	for i, x := range block {
+		c.a += uint32(x)
+		c.b += (c.size - uint32(i)) * uint32(x)
+	}
+
+	return c
+}
+
+// Roll moves the block one byte forward
+func (c *weakChecksum) Roll(out, in byte) {
+	c.a = c.a - uint32(out) + uint32(in)
+	c.b = c.b - c.size*uint32(out) + c.a
+}
+
+func (c *weakChecksum) Sum() uint32 {
+	return c.a&0xffff | c.b<<16
+}
+
+// deltaWriter writes delta stream operations
+type deltaWriter struct {
+	w *bufio.Writer
+
+	// Pending copy operation, merged with the following adjacent ones
+	copyOffset, copyLength int64
+}
+
+func newDeltaWriter(w io.Writer) (*deltaWriter, error) {
+	dw := &deltaWriter{w: bufio.NewWriter(w)}
+	_, err := dw.w.WriteString(deltaMagic)
+
+	return dw, err
+}
+
+func (dw *deltaWriter) writeOp(op byte, values ...int64) error {
+	buf := []byte{op}
+	for _, v := range values {
+		buf = binary.AppendUvarint(buf, uint64(v))
+	}
+
+	_, err := dw.w.Write(buf)
+
+	return err
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyLength == 0 {
+		return nil
+	}
+
+	err := dw.writeOp(deltaOpCopy, dw.copyOffset, dw.copyLength)
+	dw.copyLength = 0
+
+	return err
+}
+
+func (dw *deltaWriter) Copy(offset, length int64) error {
+	if dw.copyLength > 0 && dw.copyOffset+dw.copyLength == offset {
+		dw.copyLength += length
+		return nil
+	}
+
+	err := dw.flushCopy()
+	if err != nil {
+		return err
+	}
+	dw.copyOffset, dw.copyLength = offset, length
+
+	return nil
+}
+
+func (dw *deltaWriter) Data(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	err := dw.flushCopy()
+	if err != nil {
+		return err
+	}
+
+	err = dw.writeOp(deltaOpData, int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	_, err = dw.w.Write(data)
+
+	return err
+}
+
+func (dw *deltaWriter) Close() error {
+	err := dw.flushCopy()
+	if err != nil {
+		return err
+	}
+
+	err = dw.writeOp(deltaOpEnd)
+	if err != nil {
+		return err
+	}
+
+	return dw.w.Flush()
+}
+
+// writeDelta writes delta of data read from r against base version described by signature
+func writeDelta(base *blockSignature, r io.Reader, w io.Writer) error {
+	blockSize := base.BlockSize
+
+	// Full blocks of base version: weak checksum - block numbers
+	blocks := make(map[uint32][]int)
+	for i, weak := range base.Weak {
+		if int64(i+1)*int64(blockSize) <= base.FileSize {
+			blocks[weak] = append(blocks[weak], i)
+		}
+	}
+
+	dw, err := newDeltaWriter(w)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+
+	// Pending literal data followed by current block
+	var buf []byte
+	windowStart := 0
+
+	// readBlock reads next block after match, returns false at the end of data
+	readBlock := func() (bool, error) {
+		buf = append(buf[:0], make([]byte, blockSize)...)
+		n, err := io.ReadFull(br, buf)
+		buf = buf[:n]
+		windowStart = 0
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	ok, err := readBlock()
+	if err != nil {
+		return err
+	}
+
+	var weak *weakChecksum
+	if ok {
+		weak = newWeakChecksum(buf)
+	}
+
+	for ok {
+		window := buf[windowStart : windowStart+blockSize]
+
+		matched := -1
+		if candidates, exists := blocks[weak.Sum()]; exists {
+			strong := sha256.Sum256(window)
+			for _, i := range candidates {
+				if base.Strong[i] == strong {
+					matched = i
+					break
+				}
+			}
+		}
+
+		if matched >= 0 {
+			err = dw.Data(buf[:windowStart])
+			if err == nil {
+				err = dw.Copy(int64(matched)*int64(blockSize), int64(blockSize))
+			}
+			if err != nil {
+				return err
+			}
+
+			ok, err = readBlock()
+			if err != nil {
+				return err
+			}
+			if ok {
+				weak = newWeakChecksum(buf)
+			}
+			continue
+		}
+
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		weak.Roll(buf[windowStart], c)
+		buf = append(buf, c)
+		windowStart++
+
+		if windowStart >= deltaLiteralFlushSize {
+			err = dw.Data(buf[:windowStart])
+			if err != nil {
+				return err
+			}
+			buf = append(buf[:0], buf[windowStart:]...)
+			windowStart = 0
+		}
+	}
+
+	err = dw.Data(buf)
+	if err != nil {
+		return err
+	}
+
+	return dw.Close()
+}
+
+// applyDelta writes file version restored from base version and delta
+func applyDelta(base io.ReaderAt, delta io.Reader, w io.Writer) error {
+	br := bufio.NewReader(delta)
+
+	magic := make([]byte, len(deltaMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != deltaMagic {
+		return errors.New("invalid delta header")
+	}
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("read delta: %v", err)
+		}
+
+		switch op {
+		case deltaOpCopy:
+			offset, err := binary.ReadUvarint(br)
+			if err != nil {
+				return fmt.Errorf("read delta: %v", err)
+			}
+			length, err := binary.ReadUvarint(br)
+			if err != nil {
+				return fmt.Errorf("read delta: %v", err)
+			}
+
+			n, err := io.Copy(w, io.NewSectionReader(base, int64(offset), int64(length)))
+			if err != nil {
+				return err
+			}
+			if n != int64(length) {
+				return errors.New("delta refers to data out of base version")
+			}
+		case deltaOpData:
+			length, err := binary.ReadUvarint(br)
+			if err != nil {
+				return fmt.Errorf("read delta: %v", err)
+			}
+
+			_, err = io.CopyN(w, br, int64(length))
+			if err != nil {
+				return fmt.Errorf("read delta: %v", err)
+			}
+		case deltaOpEnd:
+			return nil
+		default:
+			return fmt.Errorf("unknown delta operation %q", op)
+		}
+	}
+}
+
+// blockSignatureFileName returns name of signature file of the latest archived version of file
+func (b *Config) blockSignatureFileName(filePath string) string {
+	name := sha256.Sum256([]byte(filePath))
+
+	return b.FileName + signatureDirExt + "/" + hex.EncodeToString(name[:]) + blockSignatureExt
+}
+
+// readBlockSignature reads signature of the latest archived version of file
+func (b *Config) readBlockSignature(filePath string) (*blockSignature, error) {
+	f, err := b.storage().Get(b.blockSignatureFileName(filePath), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decrypted, err := b.Encryption.newIndexDecryptReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	r := bufio.NewReader(dec)
+
+	magic := make([]byte, len(blockSignatureMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != blockSignatureMagic {
+		return nil, errors.New("invalid block signature header")
+	}
+
+	signature := &blockSignature{}
+
+	readString := func() (string, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		s := make([]byte, l)
+		_, err = io.ReadFull(r, s)
+
+		return string(s), err
+	}
+
+	var values [4]uint64
+	signature.Archive, err = readString()
+	if err == nil {
+		signature.Digest, err = readString()
+	}
+	for i := 0; i < len(values) && err == nil; i++ {
+		values[i], err = binary.ReadUvarint(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read block signature: %v", err)
+	}
+	signature.ChainLength, signature.BlockSize, signature.FileSize = int(values[0]), int(values[1]), int64(values[2])
+	blockCount := int(values[3])
+
+	signature.Weak = make([]uint32, blockCount)
+	signature.Strong = make([][sha256.Size]byte, blockCount)
+	for i := 0; i < blockCount; i++ {
+		err = binary.Read(r, binary.BigEndian, &signature.Weak[i])
+		if err == nil {
+			_, err = io.ReadFull(r, signature.Strong[i][:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read block signature: %v", err)
+		}
+	}
+
+	return signature, nil
+}
+
+// writeBlockSignature saves signature of the latest archived version of file
+func (b *Config) writeBlockSignature(filePath string, signature *blockSignature) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(blockSignatureMagic)
+	for _, s := range []string{signature.Archive, signature.Digest} {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+		buf.WriteString(s)
+	}
+	for _, v := range []int64{int64(signature.ChainLength), int64(signature.BlockSize), signature.FileSize, int64(len(signature.Weak))} {
+		buf.Write(binary.AppendUvarint(nil, uint64(v)))
+	}
+	for i := range signature.Weak {
+		binary.Write(&buf, binary.BigEndian, signature.Weak[i])
+		buf.Write(signature.Strong[i][:])
+	}
+
+	f, err := b.storage().Put(b.blockSignatureFileName(filePath))
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := b.Encryption.newIndexEncryptWriter(f)
+	if err != nil {
+		f.Abort()
+		return err
+	}
+
+	enc, err := zstd.NewWriter(encrypted, b.indexEncoderOptions()...)
+	if err == nil {
+		_, err = enc.Write(buf.Bytes())
+		if closeErr := enc.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = encrypted.Close()
+	}
+	if err != nil {
+		f.Abort()
+		return err
+	}
+
+	return f.Close()
+}
+
+// deltaBase returns signature of the latest archived version of file if
+// the file can be stored as delta against it
+func (b *Config) deltaBase(file FileInfo, index Index) *blockSignature {
+	if !b.Delta.applies(file.fileSize) {
+		return nil
+	}
+
+	fileHistory, exists := index[file.filePath]
+	if !exists {
+		return nil
+	}
+	latest := fileHistory.Latest()
+
+	signature, err := b.readBlockSignature(file.filePath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			b.logf(Warn, "read block signature error %s: %v", file.filePath, err)
+		}
+		return nil
+	}
+
+	if signature.Digest != latest.Digest || signature.Archive != latest.ArchiveFileName {
+		b.logf(Debug, "Block signature of %s does not match the latest version.", file.filePath)
+		return nil
+	}
+
+	if signature.ChainLength >= b.Delta.maxChainLength() {
+		return nil
+	}
+
+	return signature
+}
+
+// addDeltaToTarWriter adds delta of file against base version to archive
+// and returns signature of the new version
+func (b *Config) addDeltaToTarWriter(filePath string, base *blockSignature, tarWriter *tar.Writer, paxRecords map[string]string) (*blockSignature, error) {
+	b.logf(Debug, "Adding file %s as delta...\n", filePath)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open file '%s', got error '%s'", filePath, err.Error())
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get stat for file '%s', got error '%s'", filePath, err.Error())
+	}
+
+	// Size of delta must be known before writing header, delta is kept encrypted
+	deltaFile, err := newEncryptedTempFile("backuper-delta-*")
+	if err != nil {
+		return nil, err
+	}
+	defer deltaFile.Close()
+
+	builder := newBlockSignatureBuilder(b.Delta.blockSize())
+	err = writeDelta(base, io.TeeReader(file, builder), deltaFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not calculate delta of file '%s', got error '%s'", filePath, err.Error())
+	}
+
+	deltaSize := deltaFile.size
+	delta, err := deltaFile.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]string{paxDeltaArchiveRecord: base.Archive}
+	for key, value := range paxRecords {
+		records[key] = value
+	}
+
+	header := &tar.Header{
+		Format:     tar.FormatPAX,
+		Name:       filepath.ToSlash(filePath),
+		Size:       deltaSize,
+		ModTime:    stat.ModTime(),
+		PAXRecords: records}
+
+	err = tarWriter.WriteHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("Could not write header for file '%s', got error '%s'", filePath, err.Error())
+	}
+
+	_, err = io.Copy(tarWriter, delta)
+	if err != nil {
+		return nil, fmt.Errorf("Could not copy the file '%s' data to the tarball, got error '%s'", filePath, err.Error())
+	}
+
+	signature := builder.Finish()
+	signature.ChainLength = base.ChainLength + 1
+
+	b.logf(Debug, "File %s stored as delta of %s, %s of %s.", filePath, base.Archive, sizeToApproxHuman(deltaSize), sizeToApproxHuman(signature.FileSize))
+
+	return signature, nil
+}
+
+// deltaVersions keeps base and next versions of file restored from deltas
+// in temporary files next to the restored file
+type deltaVersions struct {
+	base, next *os.File
+}
+
+// newDeltaVersions creates temporary files in dir and copies base version read from r
+func newDeltaVersions(dir string, r io.Reader) (*deltaVersions, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := &deltaVersions{}
+	for _, f := range []**os.File{&versions.base, &versions.next} {
+		*f, err = os.CreateTemp(dir, ".backuper-delta-*")
+		if err != nil {
+			versions.Close()
+			return nil, err
+		}
+	}
+
+	_, err = io.Copy(versions.base, r)
+	if err != nil {
+		versions.Close()
+		return nil, fmt.Errorf("restore base version: %v", err)
+	}
+
+	return versions, nil
+}
+
+// Close removes temporary files
+func (versions *deltaVersions) Close() {
+	for _, f := range []*os.File{versions.base, versions.next} {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// restoreDelta restores file version applying chain of deltas, the newest
+// first, to base version. Every delta archive is opened after the previous
+// one is closed, so media with archives can be changed.
+func (b *Config) restoreDelta(chain []archiveEntry, versions *deltaVersions, resultFilePaths []string, digest string) error {
+	for i := len(chain) - 1; i >= 0; i-- {
+		err := b.readArchiveEntry(chain[i], func(header *tar.Header, delta io.Reader) error {
+			if _, ok := header.PAXRecords[paxDeltaArchiveRecord]; !ok {
+				return fmt.Errorf("file %s in %s is not a delta", chain[i].FilePath, chain[i].ArchiveFileName)
+			}
+
+			if i > 0 {
+				err := versions.next.Truncate(0)
+				if err == nil {
+					_, err = versions.next.Seek(0, io.SeekStart)
+				}
+				if err != nil {
+					return err
+				}
+
+				return applyDelta(versions.base, delta, versions.next)
+			}
+
+			pr, pw := io.Pipe()
+			go func() {
+				pw.CloseWithError(applyDelta(versions.base, delta, pw))
+			}()
+
+			err := writeVerifiedFiles(resultFilePaths, pr, digest)
+			pr.CloseWithError(err)
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		versions.base, versions.next = versions.next, versions.base
+	}
+
+	return nil
+}
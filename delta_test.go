@@ -0,0 +1,146 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	base := make([]byte, 100<<10)
+	r.Read(base)
+
+	inserted := make([]byte, 3000)
+	r.Read(inserted)
+
+	modified := append([]byte{}, base[:10000]...)
+	modified = append(modified, inserted...)
+	modified = append(modified, base[10000:50000]...)
+	modified = append(modified, base[60000:]...)
+	modified = append(modified, inserted...)
+
+	for _, data := range [][]byte{modified, base, base[:100], nil} {
+		builder := newBlockSignatureBuilder(4 << 10)
+		builder.Write(base)
+		signature := builder.Finish()
+
+		var delta bytes.Buffer
+		assert.NoError(t, writeDelta(signature, bytes.NewReader(data), &delta))
+
+		var restored bytes.Buffer
+		assert.NoError(t, applyDelta(bytes.NewReader(base), &delta, &restored))
+		assert.Equal(t, len(data), restored.Len())
+		assert.True(t, bytes.Equal(data, restored.Bytes()))
+	}
+
+	// Unchanged blocks are copied from base version
+	builder := newBlockSignatureBuilder(4 << 10)
+	builder.Write(base)
+	var delta bytes.Buffer
+	assert.NoError(t, writeDelta(builder.Finish(), bytes.NewReader(modified), &delta))
+	assert.Less(t, delta.Len(), 20<<10)
+}
+
+// archiveDeltas returns delta entries of archive: name - base archive
+func archiveDeltas(t *testing.T, config *Config, archiveFileName string) map[string]string {
+	f, err := openArchiveFile(config.storage(), archiveFileName)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	decoder, err := config.newArchiveReader(f, archiveFileName)
+	assert.NoError(t, err)
+	defer decoder.Close()
+
+	deltas := make(map[string]string)
+
+	tarReader := tar.NewReader(decoder)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+
+		if baseArchive, ok := header.PAXRecords[paxDeltaArchiveRecord]; ok {
+			deltas[header.Name] = baseArchive
+		}
+	}
+
+	return deltas
+}
+
+func TestDeltaBackup(t *testing.T) {
+	root := t.TempDir()
+	filePath := filepath.ToSlash(filepath.Join(root, "disk.img"))
+
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 256<<10)
+	r.Read(data)
+	assert.NoError(t, os.WriteFile(filePath, data, 0644))
+
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		Delta:    DeltaConfig{Enabled: true, MinFileSize: 64 << 10, BlockSize: 4 << 10, MaxChainLength: 2},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(t.TempDir(), "config.toml")}
+
+	assert.NoError(t, config.FullBackup())
+
+	// Two deltas, then full copy when the chain reaches its maximal length
+	var archives []string
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Second) // archive names contain time with seconds
+		r.Read(data[i*50000 : i*50000+100])
+		assert.NoError(t, os.WriteFile(filePath, data, 0644))
+		assert.NoError(t, os.Chtimes(filePath, time.Now(), time.Now().Add(time.Duration(i+1)*time.Minute)))
+		assert.NoError(t, config.IncrementalBackup())
+
+		index, err := config.indexFromFile()
+		assert.NoError(t, err)
+		assert.Len(t, index[filePath], i+2)
+		archives = append(archives, index[filePath].Latest().ArchiveFileName)
+	}
+
+	assert.Len(t, archiveDeltas(t, config, archives[0]), 1)
+	assert.Len(t, archiveDeltas(t, config, archives[1]), 1)
+	assert.Empty(t, archiveDeltas(t, config, archives[2]))
+
+	problems, err := config.Verify(true)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Restore the version at the end of delta chain
+	index, err := config.indexFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, archives[1], index[filePath][2].ArchiveFileName)
+	expected := index[filePath][2].Digest
+
+	toDir := t.TempDir()
+	assert.NoError(t, config.extract(ExtractionPlan{archives[1]: {filePath}}, toDir))
+
+	_, digest, err := fileDigest(filepath.Join(toDir, clean(filePath)))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, digest)
+
+	// Temporary files of intermediate versions are removed
+	tempFiles, err := filepath.Glob(filepath.Join(filepath.Dir(filepath.Join(toDir, clean(filePath))), ".backuper-delta-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, tempFiles)
+
+	// Restored content is checked against index digest
+	err = config.restoreFileVersion(archives[1], filePath, []string{filepath.Join(t.TempDir(), "disk.img")}, index[filePath][1].Digest)
+	assert.ErrorContains(t, err, "does not match digest")
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// deviceID returns ID of the device containing the file.
+// Device IDs are not supported on this platform.
+func deviceID(info fs.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Расширение файлов словарей
+	dictExt = ".zdict"
+
+	defaultDictionarySize        = 112 << 10
+	defaultDictionarySampleSize  = 16 << 20
+	defaultDictionaryMaxFileSize = 64 << 10
+)
+
+// dictionaryFiles возвращает отсортированный по времени создания список файлов словарей
+func (b *Config) dictionaryFiles() ([]string, error) {
+	return b.jobFiles(dictExt)
+}
+
+// dictionaries возвращает содержимое всех словарей задания.
+// Нужный словарь выбирается декодером по ID, записанному в заголовке архива.
+// Словари читаются один раз, нечитаемые пропускаются с предупреждением:
+// ошибку получит только декодер архива, которому нужен такой словарь.
+func (b *Config) dictionaries() ([][]byte, error) {
+	if b.dictsLoaded {
+		return b.dicts, nil
+	}
+
+	files, err := b.dictionaryFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var dicts [][]byte
+	for _, file := range files {
+		data, err := b.readDictionary(file)
+		if err == nil {
+			_, err = zstd.InspectDictionary(data)
+		}
+		if err != nil {
+			b.logf(Warn, "Skipping dictionary %s: %v", file, err)
+			continue
+		}
+
+		dicts = append(dicts, data)
+	}
+
+	b.dicts, b.dictsLoaded = dicts, true
+
+	return dicts, nil
+}
+
+// readDictionary читает и расшифровывает файл словаря
+func (b *Config) readDictionary(fileName string) ([]byte, error) {
+	f, err := b.storage().Get(fileName, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("read dictionary: %v", err)
+	}
+	defer f.Close()
+
+	decrypted, err := b.Encryption.newIndexDecryptReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("read dictionary: %v", err)
+	}
+
+	data, err := io.ReadAll(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("read dictionary: %v", err)
+	}
+
+	return data, nil
+}
+
+// writeDictionary шифрует и сохраняет файл словаря.
+// Словарь шифруется ключом индекса, т.к. нужен для инкрементальных бекапов.
+func (b *Config) writeDictionary(fileName string, dictionary []byte) error {
+	f, err := b.storage().Put(fileName)
+	if err != nil {
+		return fmt.Errorf("save dictionary: %v", err)
+	}
+
+	encrypted, err := b.Encryption.newIndexEncryptWriter(f)
+	if err == nil {
+		_, err = encrypted.Write(dictionary)
+	}
+	if err == nil {
+		err = encrypted.Close()
+	}
+	if err != nil {
+		f.Abort()
+		return fmt.Errorf("save dictionary: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Новый словарь будет прочитан при следующем открытии архива
+	b.dicts, b.dictsLoaded = nil, false
+
+	return nil
+}
+
+// newArchiveReader возвращает расшифровывающий и распаковывающий reader для архива с учётом словарей
+func (b *Config) newArchiveReader(r io.Reader, archiveFileName string) (io.ReadCloser, error) {
+	decrypted, err := b.Encryption.newDecryptReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, decrypted := detectArchiveCodec(decrypted, archiveFileName)
+	if codec == nil {
+		return io.NopCloser(decrypted), nil
+	}
+
+	// Словари нужны только архивам zstd
+	var dicts [][]byte
+	if codec.Name == "zstd" {
+		dicts, err = b.dictionaries()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codec.NewReader(decrypted, dicts)
+}
+
+// prepareDictionary подготавливает словарь для сжатия архива и возвращает
+// канал с файлами бекапа. При полном бекапе словарь обучается заново на выборке
+// из списка файлов бекапа и сохраняется при фиксации бекапа, при
+// инкрементальном используется последний сохранённый словарь.
+func (b *Config) prepareDictionary(files chan FileInfo, full bool) (chan FileInfo, error) {
+	if !full {
+		dictionaryFiles, err := b.dictionaryFiles()
+		if err != nil {
+			return files, err
+		}
+		if len(dictionaryFiles) == 0 {
+			return files, nil
+		}
+
+		b.Compression.dictionary, err = b.readDictionary(dictionaryFiles[len(dictionaryFiles)-1])
+		if err != nil {
+			return files, err
+		}
+		b.logf(Debug, "Using dictionary %s.", dictionaryFiles[len(dictionaryFiles)-1])
+
+		return files, nil
+	}
+
+	// Список файлов вычитывается полностью до начала записи архива
+	var fileList []FileInfo
+	for file := range files {
+		fileList = append(fileList, file)
+	}
+
+	planned := make(chan FileInfo, 64)
+	go func() {
+		for _, file := range fileList {
+			planned <- file
+		}
+		close(planned)
+	}()
+
+	b.log(Info, "Training dictionary...")
+
+	dictionary, err := b.trainDictionary(fileList)
+	if err != nil {
+		return planned, err
+	}
+	b.Compression.dictionary = dictionary
+	b.Compression.dictionaryTrained = true
+
+	return planned, nil
+}
+
+// trainDictionary обучает словарь на выборке файлов для бекапа
+func (b *Config) trainDictionary(files []FileInfo) ([]byte, error) {
+	dictionarySize := int(b.Compression.DictionarySize)
+	if dictionarySize == 0 {
+		dictionarySize = defaultDictionarySize
+	}
+	sampleSize := int64(b.Compression.DictionarySampleSize)
+	if sampleSize == 0 {
+		sampleSize = defaultDictionarySampleSize
+	}
+	maxFileSize := int64(b.Compression.DictionaryMaxFileSize)
+	if maxFileSize == 0 {
+		maxFileSize = defaultDictionaryMaxFileSize
+	}
+
+	var samples [][]byte
+	totalSize := int64(0)
+
+	for _, file := range files {
+		if totalSize >= sampleSize {
+			break
+		}
+		if file.fileSize == 0 || file.fileSize > maxFileSize {
+			continue
+		}
+
+		data, err := os.ReadFile(file.filePath)
+		if err != nil {
+			b.logf(Error, "read sample file error: %v", err)
+			continue
+		}
+
+		samples = append(samples, data)
+		totalSize += int64(len(data))
+	}
+
+	b.logf(Debug, "Dictionary sample: %d files, %s.", len(samples), sizeToApproxHuman(totalSize))
+
+	dictionary, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: dictionarySize, HashBytes: 6})
+	if err != nil {
+		return nil, fmt.Errorf("train dictionary: %v", err)
+	}
+
+	return dictionary, nil
+}
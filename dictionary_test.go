@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDictionaryRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	srcDir := filepath.Join(dir, "src")
+	assert.NoError(t, os.Mkdir(srcDir, 0755))
+
+	for i := 0; i < 200; i++ {
+		data := fmt.Sprintf("[server]\nname = \"host%d\"\nport = %d\nlog_level = \"info\"\n", i, 8000+i)
+		assert.NoError(t, os.WriteFile(filepath.Join(srcDir, fmt.Sprintf("%d.conf", i)), []byte(data), 0644))
+	}
+
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		Compression: CompressionConfig{
+			TrainDictionary: true,
+			DictionarySize:  4 << 10},
+		Patterns: []*Pattern{{
+			Path:                srcDir,
+			FileNamePatternList: PatternList{"*.conf"},
+			FilePathPatternList: PatternList{"**"}}},
+		filePath: filepath.Join(dir, "config.toml")}
+
+	files, err := config.prepareDictionary(config.planChan(make(Index), nil), true)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, config.Compression.dictionary)
+
+	// Files sampled for training are passed on for backup
+	count := 0
+	for range files {
+		count++
+	}
+	assert.Equal(t, 200, count)
+
+	// Dictionary is stored only when backup is committed
+	dictionaryFiles, err := config.dictionaryFiles()
+	assert.NoError(t, err)
+	assert.Empty(t, dictionaryFiles)
+
+	codec, err := codecByName("zstd")
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	w, err := codec.NewWriter(&buf, &config.Compression)
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("[server]\nname = \"host1000\"\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	// Without dictionary archive can not be decoded
+	r, err := newArchiveReader(bytes.NewReader(buf.Bytes()), "backup.tar.zst", nil)
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.Error(t, err)
+
+	assert.NoError(t, config.writeDictionary("backup_2023-01-01_00-00-00f"+dictExt, config.Compression.dictionary))
+	r, err = config.newArchiveReader(bytes.NewReader(buf.Bytes()), "backup.tar.zst")
+	assert.NoError(t, err)
+	got, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "[server]\nname = \"host1000\"\n", string(got))
+
+	// Incremental backup uses the latest dictionary
+	config.Compression.dictionaryTrained = false
+	assert.NoError(t, config.FullBackup())
+	dictionaryFiles, err = config.dictionaryFiles()
+	assert.NoError(t, err)
+	assert.Len(t, dictionaryFiles, 2)
+
+	dictionary := config.Compression.dictionary
+	config.Compression.dictionary = nil
+	files = make(chan FileInfo)
+	got2, err := config.prepareDictionary(files, false)
+	assert.NoError(t, err)
+	assert.Equal(t, files, got2)
+	assert.Equal(t, dictionary, config.Compression.dictionary)
+}
+
+func TestDictionaryCache(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		filePath: filepath.Join(dir, "config.toml")}
+
+	dictionary, err := dict.BuildZstdDict([][]byte{
+		[]byte("[server]\nname = \"host1\"\nport = 8001\n"),
+		[]byte("[server]\nname = \"host2\"\nport = 8002\n"),
+		[]byte("[server]\nname = \"host3\"\nport = 8003\n")}, dict.Options{MaxDictSize: 4 << 10, HashBytes: 6})
+	assert.NoError(t, err)
+	assert.NoError(t, config.writeDictionary("backup_2023-01-01_00-00-00f"+dictExt, dictionary))
+
+	// Corrupt dictionary is skipped
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "backup_2023-01-02_00-00-00f"+dictExt), []byte("corrupt"), 0644))
+
+	compress := func(codecName string, compression *CompressionConfig) []byte {
+		codec, err := codecByName(codecName)
+		assert.NoError(t, err)
+
+		var buf bytes.Buffer
+		w, err := codec.NewWriter(&buf, compression)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte("data"))
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		return buf.Bytes()
+	}
+	zstdArchive := compress("zstd", &CompressionConfig{dictionary: dictionary})
+	gzipArchive := compress("gzip", &CompressionConfig{})
+
+	storage := &countingStorage{Storage: config.storage()}
+	config.storageBackend = storage
+
+	// Dictionaries are not read for other codecs
+	r, err := config.newArchiveReader(bytes.NewReader(gzipArchive), "backup.tar.gz")
+	assert.NoError(t, err)
+	got, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(got))
+	assert.Zero(t, storage.gets)
+
+	// Dictionaries are read once
+	for i := 0; i < 3; i++ {
+		r, err = config.newArchiveReader(bytes.NewReader(zstdArchive), "backup.tar.zst")
+		assert.NoError(t, err)
+		got, err = io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "data", string(got))
+	}
+	assert.Equal(t, 2, storage.gets)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// DriftReport contains differences between source files and their latest backed up versions
+type DriftReport struct {
+	// Files not backed up yet
+	New []string
+
+	// Files with modification time differing from the backed up version
+	Modified []string
+
+	// Backed up files missing in the source
+	Deleted []string
+
+	// Files with the same modification time but different content,
+	// filled only if hashes are compared
+	Corrupted []string
+
+	// Number of files which content was not compared because
+	// the backed up version has no checksum
+	Unverified int
+}
+
+// Drift walks configured patterns and compares found files with the latest
+// backed up versions in the index. If compareHashes is set, content of files
+// with unchanged modification time is compared with stored checksums.
+func (b *Config) Drift(compareHashes bool) (*DriftReport, error) {
+	index, err := b.index(true)
+	if err != nil {
+		return nil, fmt.Errorf("index: %v", err)
+	}
+
+	report := &DriftReport{}
+	seen := make(map[string]bool)
+
+	fileNames := make(chan FileInfo, 64)
+	go b.fileList(fileNames, nil)
+
+	for file := range fileNames {
+		seen[file.filePath] = true
+
+		fileHistory, exists := index[file.filePath]
+		if !exists {
+			report.New = append(report.New, file.filePath)
+			continue
+		}
+
+		latest := fileHistory.Latest()
+		if !file.ModificationTime.Truncate(time.Second).Equal(latest.ModificationTime.Truncate(time.Second)) {
+			report.Modified = append(report.Modified, file.filePath)
+			continue
+		}
+
+		if !compareHashes {
+			continue
+		}
+
+		if latest.Digest == "" {
+			report.Unverified++
+			continue
+		}
+
+		_, digest, err := fileDigest(file.filePath)
+		if err != nil {
+			b.logf(Error, "calculate checksum error %s: %v", file.filePath, err)
+			report.Unverified++
+			continue
+		}
+
+		if digest != latest.Digest {
+			report.Corrupted = append(report.Corrupted, file.filePath)
+		}
+	}
+
+	for filePath := range index {
+		if !seen[filePath] {
+			report.Deleted = append(report.Deleted, filePath)
+		}
+	}
+
+	for _, list := range [][]string{report.New, report.Modified, report.Deleted, report.Corrupted} {
+		sort.Strings(list)
+	}
+
+	return report, nil
+}
+
+// Write prints report, one file per line with change kind prefix
+func (report *DriftReport) Write(w io.Writer) error {
+	for _, section := range []struct {
+		kind  string
+		files []string
+	}{
+		{"new", report.New},
+		{"modified", report.Modified},
+		{"deleted", report.Deleted},
+		{"corrupted", report.Corrupted},
+	} {
+		for _, filePath := range section.files {
+			_, err := fmt.Fprintf(w, "%-9s %s\n", section.kind, filePath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrift(t *testing.T) {
+	root := t.TempDir()
+	filePath := func(name string) string {
+		return filepath.ToSlash(filepath.Join(root, name))
+	}
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{"same.txt", "modified.txt", "deleted.txt", "corrupted.txt"} {
+		assert.NoError(t, os.WriteFile(filePath(name), []byte(name), 0644))
+		assert.NoError(t, os.Chtimes(filePath(name), modTime, modTime))
+	}
+
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(t.TempDir(), "config.toml")}
+
+	assert.NoError(t, config.FullBackup())
+
+	assert.NoError(t, os.WriteFile(filePath("new.txt"), nil, 0644))
+	assert.NoError(t, os.Chtimes(filePath("modified.txt"), modTime.Add(time.Minute), modTime.Add(time.Minute)))
+	assert.NoError(t, os.Remove(filePath("deleted.txt")))
+	assert.NoError(t, os.WriteFile(filePath("corrupted.txt"), []byte("CORRUPTED.txt"), 0644))
+	assert.NoError(t, os.Chtimes(filePath("corrupted.txt"), modTime, modTime))
+
+	report, err := config.Drift(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filePath("new.txt")}, report.New)
+	assert.Equal(t, []string{filePath("modified.txt")}, report.Modified)
+	assert.Equal(t, []string{filePath("deleted.txt")}, report.Deleted)
+	assert.Empty(t, report.Corrupted)
+
+	report, err = config.Drift(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filePath("corrupted.txt")}, report.Corrupted)
+	assert.Zero(t, report.Unverified)
+
+	// Checksums are restored when index is rebuilt from archives
+	assert.NoError(t, os.Remove(config.indexFilePath()))
+	report, err = config.Drift(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filePath("corrupted.txt")}, report.Corrupted)
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted stream format:
+//
+//	magic (8 bytes) | key stanza type (1 byte) | key stanza | chunks
+//
+// Key stanza contains the random file key wrapped for the reader. Data is
+// split into chunks encrypted with ChaCha20-Poly1305 using the file key.
+// Every chunk is prefixed with 4-byte big-endian ciphertext length, the
+// highest bit of which marks the final chunk. Chunk nonce is an 11-byte
+// counter followed by the final chunk flag, so reordering, truncation and
+// appending are detected.
+const (
+	encryptionMagic = "BKPCRYPT"
+
+	// Passphrase stanza: log2(N) (1 byte) | salt | wrapped file key
+	stanzaScrypt byte = 1
+
+	// Public key stanza: ephemeral X25519 public key | wrapped file key
+	stanzaX25519 byte = 2
+
+	encryptionChunkSize = 64 << 10
+	encryptionFinalFlag = 1 << 31
+
+	fileKeySize    = chacha20poly1305.KeySize
+	scryptSaltSize = 16
+	scryptLogN     = 15
+)
+
+// EncryptionConfig contains archive encryption settings.
+// Encryption is enabled if any passphrase source or recipient public key is set.
+// If recipient is set, it is used instead of passphrase for new files.
+type EncryptionConfig struct {
+	// Name of environment variable containing passphrase
+	PassphraseEnv string
+
+	// Path of file containing passphrase
+	PassphraseFile string
+
+	// Command printing passphrase to stdout, run by shell
+	PassphraseCommand string
+
+	// Recipient public key for archives. Only the owner of the private
+	// key can read archives, backup host needs only the public key.
+	Recipient string
+
+	// Private key file for archives, needed for restore only.
+	// Can be overridden with BACKUPER_IDENTITY_FILE environment variable.
+	IdentityFile string
+
+	// Recipient public key for index and dictionaries, Recipient is used if empty
+	IndexRecipient string
+
+	// Private key file for index and dictionaries
+	IndexIdentityFile string
+
+	// Do not encrypt index and dictionaries
+	PlaintextIndex bool
+
+	// Read files written before encryption was enabled. Otherwise files
+	// without encryption header are rejected.
+	AllowUnencrypted bool
+
+	// Passphrase read from the source
+	passphrase []byte
+
+	// Wrapping keys derived from passphrase by scrypt parameters and salt
+	wrappingKeys map[string][]byte
+}
+
+// Enabled reports whether encryption is configured
+func (config *EncryptionConfig) Enabled() bool {
+	return config != nil && (config.passphraseEnabled() || config.Recipient != "")
+}
+
+func (config *EncryptionConfig) passphraseEnabled() bool {
+	return config.PassphraseEnv != "" || config.PassphraseFile != "" || config.PassphraseCommand != ""
+}
+
+// Validate checks configured public keys. In public key mode the index must
+// stay readable on the backup host for incremental backups, so it needs
+// its own key pair or must be stored unencrypted.
+func (config *EncryptionConfig) Validate() error {
+	for _, recipient := range []string{config.Recipient, config.IndexRecipient} {
+		if recipient == "" {
+			continue
+		}
+
+		if _, err := parsePublicKey(recipient); err != nil {
+			return err
+		}
+	}
+
+	if config.Recipient != "" && !config.PlaintextIndex && (config.IndexRecipient == "" || config.IndexIdentityFile == "") {
+		return errors.New("Recipient requires IndexRecipient with IndexIdentityFile or PlaintextIndex, otherwise index can not be read by incremental backups")
+	}
+
+	return nil
+}
+
+// identities returns private keys available for decryption
+func (config *EncryptionConfig) identities() ([]*ecdh.PrivateKey, error) {
+	var identities []*ecdh.PrivateKey
+
+	for _, filePath := range []string{os.Getenv(identityFileEnv), config.IdentityFile, config.IndexIdentityFile} {
+		if filePath == "" {
+			continue
+		}
+
+		identity, err := readPrivateKey(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// Passphrase reads passphrase from configured source
+func (config *EncryptionConfig) Passphrase() ([]byte, error) {
+	if config.passphrase != nil {
+		return config.passphrase, nil
+	}
+
+	var passphrase string
+
+	switch {
+	case config.PassphraseEnv != "":
+		var ok bool
+		passphrase, ok = os.LookupEnv(config.PassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", config.PassphraseEnv)
+		}
+	case config.PassphraseFile != "":
+		b, err := os.ReadFile(config.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase file: %v", err)
+		}
+		passphrase = string(b)
+	case config.PassphraseCommand != "":
+		cmd := shellCommand(config.PassphraseCommand)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("run passphrase command: %v", err)
+		}
+		passphrase = string(b)
+	default:
+		return nil, errors.New("passphrase source is not configured")
+	}
+
+	passphrase = strings.TrimRight(passphrase, "\r\n")
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+
+	config.passphrase = []byte(passphrase)
+
+	return config.passphrase, nil
+}
+
+// newEncryptWriter returns writer encrypting archive data to w.
+// If encryption is disabled, data is written as is.
+func (config *EncryptionConfig) newEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	if !config.Enabled() {
+		return nopWriteCloser{w}, nil
+	}
+
+	return config.encryptWriter(w, config.Recipient)
+}
+
+// newIndexEncryptWriter returns writer encrypting index data to w.
+// Index is encrypted for IndexRecipient so it stays searchable with a
+// separate key, or is not encrypted at all if PlaintextIndex is set.
+func (config *EncryptionConfig) newIndexEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	if !config.Enabled() || config.PlaintextIndex {
+		return nopWriteCloser{w}, nil
+	}
+
+	if config.IndexRecipient != "" {
+		return config.encryptWriter(w, config.IndexRecipient)
+	}
+
+	return config.encryptWriter(w, config.Recipient)
+}
+
+// encryptWriter returns writer encrypting data for recipient public key
+// or with passphrase if recipient is empty
+func (config *EncryptionConfig) encryptWriter(w io.Writer, recipient string) (io.WriteCloser, error) {
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	if recipient != "" {
+		publicKey, err := parsePublicKey(recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		stanza, err := wrapKeyForRecipient(publicKey, fileKey)
+		if err != nil {
+			return nil, err
+		}
+
+		header := append([]byte(encryptionMagic), stanzaX25519)
+
+		return newStreamWriter(w, append(header, stanza...), fileKey)
+	}
+
+	passphrase, err := config.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, scryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	wrappingKey, err := scrypt.Key(passphrase, salt, 1<<scryptLogN, 8, 1, fileKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := wrapKey(wrappingKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.WriteString(encryptionMagic)
+	header.WriteByte(stanzaScrypt)
+	header.WriteByte(scryptLogN)
+	header.Write(salt)
+	header.Write(wrappedKey)
+
+	return newStreamWriter(w, header.Bytes(), fileKey)
+}
+
+// newDecryptReader returns reader decrypting archive data from r.
+// Unencrypted data is returned as is if encryption is disabled or
+// AllowUnencrypted is set.
+func (config *EncryptionConfig) newDecryptReader(r io.Reader) (io.Reader, error) {
+	return config.decryptReader(r, !config.Enabled() || config.AllowUnencrypted)
+}
+
+// newIndexDecryptReader returns reader decrypting index data from r.
+// Unencrypted index is also read if PlaintextIndex is set.
+func (config *EncryptionConfig) newIndexDecryptReader(r io.Reader) (io.Reader, error) {
+	return config.decryptReader(r, !config.Enabled() || config.AllowUnencrypted || config.PlaintextIndex)
+}
+
+func (config *EncryptionConfig) decryptReader(r io.Reader, allowUnencrypted bool) (io.Reader, error) {
+	bufReader := bufio.NewReader(r)
+
+	magic, _ := bufReader.Peek(len(encryptionMagic))
+	if string(magic) != encryptionMagic {
+		if !allowUnencrypted {
+			return nil, errors.New("data is not encrypted (set AllowUnencrypted to read files written before encryption was enabled)")
+		}
+		return bufReader, nil
+	}
+
+	fileKey, err := config.readHeader(bufReader)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamReader(bufReader, fileKey, config)
+}
+
+// readHeader reads encryption header and returns file key
+func (config *EncryptionConfig) readHeader(bufReader *bufio.Reader) ([]byte, error) {
+	magic := make([]byte, len(encryptionMagic))
+	_, err := io.ReadFull(bufReader, magic)
+	if err != nil || string(magic) != encryptionMagic {
+		return nil, errors.New("encryption header is not found")
+	}
+
+	stanzaType, err := bufReader.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("read encryption header: %v", err)
+	}
+
+	var fileKey []byte
+
+	switch stanzaType {
+	case stanzaScrypt:
+		if config == nil || !config.passphraseEnabled() {
+			return nil, errors.New("data is encrypted, passphrase is not configured")
+		}
+
+		passphrase, err := config.Passphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		stanza := make([]byte, 1+scryptSaltSize+fileKeySize+chacha20poly1305.Overhead)
+		_, err = io.ReadFull(bufReader, stanza)
+		if err != nil {
+			return nil, fmt.Errorf("read encryption header: %v", err)
+		}
+
+		logN, salt, wrappedKey := stanza[0], stanza[1:1+scryptSaltSize], stanza[1+scryptSaltSize:]
+		if logN > 30 {
+			return nil, fmt.Errorf("invalid scrypt parameter: %d", logN)
+		}
+
+		wrappingKey, err := config.wrappingKey(passphrase, logN, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		fileKey, err = unwrapKey(wrappingKey, wrappedKey)
+		if err != nil {
+			return nil, errors.New("wrong passphrase or corrupted data")
+		}
+	case stanzaX25519:
+		stanza := make([]byte, x25519KeySize+fileKeySize+chacha20poly1305.Overhead)
+		_, err = io.ReadFull(bufReader, stanza)
+		if err != nil {
+			return nil, fmt.Errorf("read encryption header: %v", err)
+		}
+
+		var identities []*ecdh.PrivateKey
+		if config != nil {
+			identities, err = config.identities()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(identities) == 0 {
+			return nil, fmt.Errorf("data is encrypted with public key, private key is not supplied (set IdentityFile or %s)", identityFileEnv)
+		}
+
+		for _, identity := range identities {
+			fileKey, err = unwrapKeyWithIdentity(identity, stanza)
+			if err == nil {
+				break
+			}
+		}
+		if fileKey == nil {
+			return nil, errors.New("no matching private key or corrupted data")
+		}
+	default:
+		return nil, fmt.Errorf("unknown key stanza type %d", stanzaType)
+	}
+
+	return fileKey, nil
+}
+
+// wrappingKey derives key from passphrase. Keys are cached, so files
+// encrypted by the same writer settings are read without running scrypt again.
+func (config *EncryptionConfig) wrappingKey(passphrase []byte, logN byte, salt []byte) ([]byte, error) {
+	cacheKey := string(append([]byte{logN}, salt...))
+	if key, ok := config.wrappingKeys[cacheKey]; ok {
+		return key, nil
+	}
+
+	key, err := scrypt.Key(passphrase, salt, 1<<logN, 8, 1, fileKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.wrappingKeys == nil {
+		config.wrappingKeys = make(map[string][]byte)
+	}
+	config.wrappingKeys[cacheKey] = key
+
+	return key, nil
+}
+
+// wrapKey encrypts file key with wrapping key. Wrapping key must be unique
+// for every file, so zero nonce is used.
+func wrapKey(wrappingKey, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+// unwrapKey decrypts file key encrypted by wrapKey
+func unwrapKey(wrappingKey, wrappedKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, make([]byte, aead.NonceSize()), wrappedKey, nil)
+}
+
+// streamNonce returns nonce of chunk with specified number
+func streamNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// streamWriter encrypts data by chunks
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+// newStreamWriter writes header and returns writer encrypting data with fileKey
+func newStreamWriter(w io.Writer, header, fileKey []byte) (*streamWriter, error) {
+	aead, err := chacha20poly1305.New(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{w: w, aead: aead, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+
+	for len(p) > 0 {
+		if len(w.buf) == encryptionChunkSize {
+			err := w.writeChunk(false)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		chunk := p
+		if len(chunk) > encryptionChunkSize-len(w.buf) {
+			chunk = chunk[:encryptionChunkSize-len(w.buf)]
+		}
+
+		w.buf = append(w.buf, chunk...)
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// Flush writes buffered data as a chunk
+func (w *streamWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	return w.writeChunk(false)
+}
+
+// Close writes the final chunk. Underlying writer is not closed.
+func (w *streamWriter) Close() error {
+	return w.writeChunk(true)
+}
+
+func (w *streamWriter) writeChunk(final bool) error {
+	ciphertext := w.aead.Seal(nil, streamNonce(w.counter, final), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+
+	length := uint32(len(ciphertext))
+	if final {
+		length |= encryptionFinalFlag
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], length)
+
+	_, err := w.w.Write(header[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(ciphertext)
+	return err
+}
+
+// streamReader decrypts data written by streamWriter
+type streamReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	final   bool
+
+	// Config used to read headers of following streams
+	config *EncryptionConfig
+}
+
+func newStreamReader(r *bufio.Reader, fileKey []byte, config *EncryptionConfig) (*streamReader, error) {
+	aead, err := chacha20poly1305.New(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{r: r, aead: aead, config: config}, nil
+}
+
+// nextStream starts reading of the stream following the final chunk.
+// Archives split into volumes contain several concatenated streams.
+func (r *streamReader) nextStream() error {
+	magic, err := r.r.Peek(len(encryptionMagic))
+	if len(magic) == 0 && err != nil {
+		return err
+	}
+	if string(magic) != encryptionMagic {
+		return errors.New("unexpected data after encrypted stream end")
+	}
+
+	fileKey, err := r.config.readHeader(r.r)
+	if err != nil {
+		return err
+	}
+
+	r.aead, err = chacha20poly1305.New(fileKey)
+	if err != nil {
+		return err
+	}
+	r.counter = 0
+	r.final = false
+
+	return nil
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			err := r.nextStream()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		err := r.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *streamReader) readChunk() error {
+	var header [4]byte
+	_, err := io.ReadFull(r.r, header[:])
+	if err == io.EOF {
+		return errors.New("encrypted data is truncated")
+	}
+	if err != nil {
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	final := length&encryptionFinalFlag != 0
+	length &^= encryptionFinalFlag
+
+	if length > encryptionChunkSize+uint32(r.aead.Overhead()) {
+		return errors.New("invalid encrypted chunk size")
+	}
+
+	ciphertext := make([]byte, length)
+	_, err = io.ReadFull(r.r, ciphertext)
+	if err != nil {
+		return errors.New("encrypted data is truncated")
+	}
+
+	r.buf, err = r.aead.Open(ciphertext[:0], streamNonce(r.counter, final), ciphertext, nil)
+	if err != nil {
+		return errors.New("encrypted data authentication failed")
+	}
+	r.counter++
+	r.final = final
+
+	return nil
+}
+
+// encryptedTempFile keeps data in temporary file encrypted with random key
+// held in memory only, so file content does not leak to temporary directory
+type encryptedTempFile struct {
+	file *os.File
+	key  []byte
+	w    *streamWriter
+
+	// Bytes of plaintext written
+	size int64
+}
+
+func newEncryptedTempFile(pattern string) (*encryptedTempFile, error) {
+	key := make([]byte, fileKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newStreamWriter(file, nil, key)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &encryptedTempFile{file: file, key: key, w: w}, nil
+}
+
+func (f *encryptedTempFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Reader finishes writing and returns reader of written data
+func (f *encryptedTempFile) Reader() (io.Reader, error) {
+	err := f.w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStreamReader(bufio.NewReader(f.file), f.key, nil)
+}
+
+// Close removes temporary file
+func (f *encryptedTempFile) Close() error {
+	f.file.Close()
+
+	return os.Remove(f.file.Name())
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encrypt(t *testing.T, config *EncryptionConfig, data []byte) []byte {
+	var buf bytes.Buffer
+
+	w, err := config.newEncryptWriter(&buf)
+	assert.NoError(t, err)
+	_, err = w.Write(data[:len(data)/2])
+	assert.NoError(t, err)
+	assert.NoError(t, w.(*streamWriter).Flush())
+	_, err = w.Write(data[len(data)/2:])
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func decrypt(config *EncryptionConfig, data []byte) ([]byte, error) {
+	r, err := config.newDecryptReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	t.Setenv("BACKUPER_TEST_PASSPHRASE", "secret")
+	config := &EncryptionConfig{PassphraseEnv: "BACKUPER_TEST_PASSPHRASE"}
+
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	encrypted := encrypt(t, config, data)
+	assert.Equal(t, encryptionMagic, string(encrypted[:len(encryptionMagic)]))
+	assert.False(t, bytes.Contains(encrypted, []byte("0123456789")))
+
+	got, err := decrypt(config, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Unencrypted data is rejected unless allowed
+	_, err = decrypt(config, data)
+	assert.ErrorContains(t, err, "AllowUnencrypted")
+	got, err = decrypt(&EncryptionConfig{PassphraseEnv: config.PassphraseEnv, AllowUnencrypted: true}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+	got, err = decrypt(&EncryptionConfig{}, data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Wrapping key is derived once for every salt
+	assert.Len(t, config.wrappingKeys, 1)
+	_, err = decrypt(config, encrypted)
+	assert.NoError(t, err)
+	assert.Len(t, config.wrappingKeys, 1)
+
+	// Missing passphrase
+	_, err = decrypt(&EncryptionConfig{}, encrypted)
+	assert.Error(t, err)
+
+	// Wrong passphrase
+	passphraseFilePath := filepath.Join(t.TempDir(), "passphrase")
+	assert.NoError(t, os.WriteFile(passphraseFilePath, []byte("wrong\n"), 0600))
+	_, err = decrypt(&EncryptionConfig{PassphraseFile: passphraseFilePath}, encrypted)
+	assert.Error(t, err)
+
+	// Truncated data
+	_, err = decrypt(config, encrypted[:len(encrypted)-100])
+	assert.Error(t, err)
+
+	// Modified data
+	modified := append([]byte{}, encrypted...)
+	modified[len(modified)/2] ^= 1
+	_, err = decrypt(config, modified)
+	assert.Error(t, err)
+
+	// Appended data
+	_, err = decrypt(config, append(append([]byte{}, encrypted...), 0))
+	assert.Error(t, err)
+
+	// Concatenated streams
+	got, err = decrypt(config, append(append([]byte{}, encrypted...), encrypt(t, config, data)...))
+	assert.NoError(t, err)
+	assert.Equal(t, append(append([]byte{}, data...), data...), got)
+}
+
+func TestEncryptionPassphraseCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("quoting differs in cmd.exe")
+	}
+
+	config := &EncryptionConfig{PassphraseCommand: "echo 'secret  with spaces'"}
+
+	passphrase, err := config.Passphrase()
+	assert.NoError(t, err)
+	assert.Equal(t, "secret  with spaces", string(passphrase))
+}
+
+func TestEncryptionPublicKey(t *testing.T) {
+	dir := t.TempDir()
+
+	archiveIdentityFilePath := filepath.Join(dir, "archive.key")
+	archiveRecipient, err := generateKeyPair(archiveIdentityFilePath)
+	assert.NoError(t, err)
+
+	indexIdentityFilePath := filepath.Join(dir, "index.key")
+	indexRecipient, err := generateKeyPair(indexIdentityFilePath)
+	assert.NoError(t, err)
+
+	// Backup host knows only public keys and the index private key
+	backupConfig := &EncryptionConfig{Recipient: archiveRecipient, IndexRecipient: indexRecipient, IndexIdentityFile: indexIdentityFilePath}
+	assert.NoError(t, backupConfig.Validate())
+
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+
+	var archive bytes.Buffer
+	w, err := backupConfig.newEncryptWriter(&archive)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	var index bytes.Buffer
+	w, err = backupConfig.newIndexEncryptWriter(&index)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	got, err := decrypt(backupConfig, index.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = decrypt(backupConfig, archive.Bytes())
+	assert.Error(t, err)
+
+	// Private key is supplied at restore time
+	t.Setenv(identityFileEnv, archiveIdentityFilePath)
+	got, err = decrypt(backupConfig, archive.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Plaintext index
+	plaintextConfig := &EncryptionConfig{Recipient: archiveRecipient, PlaintextIndex: true}
+	index.Reset()
+	w, err = plaintextConfig.newIndexEncryptWriter(&index)
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, data, index.Bytes())
+
+	assert.Error(t, (&EncryptionConfig{Recipient: "invalid"}).Validate())
+}
+
+func TestEncryptionPublicKeyBackup(t *testing.T) {
+	dir := t.TempDir()
+
+	archiveRecipient, err := generateKeyPair(filepath.Join(dir, "archive.key"))
+	assert.NoError(t, err)
+
+	indexIdentityFilePath := filepath.Join(dir, "index.key")
+	indexRecipient, err := generateKeyPair(indexIdentityFilePath)
+	assert.NoError(t, err)
+
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644))
+
+	tests := []struct {
+		encryption EncryptionConfig
+		valid      bool
+	}{
+		{EncryptionConfig{Recipient: archiveRecipient}, false},
+		{EncryptionConfig{Recipient: archiveRecipient, IndexRecipient: indexRecipient}, false},
+		{EncryptionConfig{Recipient: archiveRecipient, IndexRecipient: indexRecipient, IndexIdentityFile: indexIdentityFilePath}, true},
+		{EncryptionConfig{Recipient: archiveRecipient, PlaintextIndex: true}, true},
+	}
+
+	for _, test := range tests {
+		config := &Config{
+			FileName:    "backup",
+			LogLevel:    Error,
+			Destination: t.TempDir(),
+			Encryption:  test.encryption,
+			Patterns: []*Pattern{{
+				Path:                root,
+				FileNamePatternList: PatternList{"*"},
+				FilePathPatternList: PatternList{"**"},
+				MaxDepth:            -1}},
+			filePath: filepath.Join(t.TempDir(), "config.toml")}
+
+		err := config.Encryption.Validate()
+		assert.NoError(t, config.FullBackup())
+		assert.NoError(t, os.WriteFile(filepath.Join(root, "a.txt"), []byte("b"), 0644))
+		if test.valid {
+			assert.NoError(t, err)
+			assert.NoError(t, config.IncrementalBackup())
+		} else {
+			// Index written by the full backup can not be read
+			assert.Error(t, err)
+			assert.Error(t, config.IncrementalBackup())
+		}
+	}
+}
+
+func TestEncryptedTempFile(t *testing.T) {
+	f, err := newEncryptedTempFile("backuper-test-*")
+	assert.NoError(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	_, err = f.Write(data)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), f.size)
+
+	r, err := f.Reader()
+	assert.NoError(t, err)
+
+	stored, err := os.ReadFile(f.file.Name())
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(stored, []byte("0123456789")))
+
+	got, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	assert.NoError(t, f.Close())
+	assert.NoFileExists(t, f.file.Name())
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
-
-	"github.com/klauspost/compress/zstd"
 )
 
 type ExtractionPlan map[string][]string // filepath - array of internal paths
@@ -25,64 +27,342 @@ func (b *Config) extractionPlan(mask string, t time.Time) (ExtractionPlan, error
 		return nil, fmt.Errorf("extractionPlan: %v", err)
 	}
 
-	plan := make(ExtractionPlan)
-
+	// Файлы из томов одного архива извлекаются за один проход,
+	// начиная с первого нужного тома
+	firstVolumes := make(map[string]string) // archive set - first needed volume
+	setFiles := make(map[string][]string)   // archive set - files
 	for _, file := range files {
-		plan[file.ArchiveFileName] = append(plan[file.ArchiveFileName], file.filePath)
+		archiveSet := archiveSetFileName(file.ArchiveFileName)
+		if first, ok := firstVolumes[archiveSet]; !ok || volumeNumber(file.ArchiveFileName) < volumeNumber(first) {
+			firstVolumes[archiveSet] = file.ArchiveFileName
+		}
+		setFiles[archiveSet] = append(setFiles[archiveSet], file.filePath)
+	}
+
+	plan := make(ExtractionPlan)
+	for archiveSet, files := range setFiles {
+		plan[firstVolumes[archiveSet]] = files
 	}
 
 	return plan, nil
 }
 
+// Максимальная длина цепочки ссылок на содержимое файлов в других архивах
+const maxLinkDepth = 16
+
+// restoreTargets - файлы для восстановления из архива: внутренний путь - пути восстанавливаемых файлов
+type restoreTargets map[string][]string
+
 func (b *Config) extract(extractionPlan ExtractionPlan, toDir string) error {
+	targets := make(map[string]restoreTargets) // archive file - files
 	for archiveFile, files := range extractionPlan {
-		log.Printf("Восстановление из архивного файла %s...", filepath.Join(filepath.Dir(b.filePath), archiveFile))
-		f, err := os.Open(filepath.Join(filepath.Dir(b.filePath), archiveFile))
-		if err != nil {
-			return fmt.Errorf("ошибка при чтении файла архива: %v", err)
+		targets[archiveFile] = make(restoreTargets)
+		for _, file := range files {
+			targets[archiveFile][file] = append(targets[archiveFile][file], filepath.Join(toDir, clean(file)))
 		}
-		defer f.Close()
+	}
 
-		decoder, err := zstd.NewReader(f)
-		if err != nil {
-			return fmt.Errorf("ошибка при инициализации разархиватора: %v", err)
+	media, err := b.planMedia(extractionPlan)
+	if err != nil {
+		return err
+	}
+	if len(media) > 0 {
+		log.Printf("Для восстановления нужны носители: %s", strings.Join(media, ", "))
+	}
+
+	// Хранилище блоков, открывается при восстановлении из первого снимка
+	var repo *chunkRepository
+
+	// Индекс, читается при восстановлении первого файла из разностей
+	var index Index
+
+	// Файлы, сохранённые как ссылки, восстанавливаются из архивов с их содержимым
+	for depth := 0; len(targets) > 0; depth++ {
+		if depth > maxLinkDepth {
+			return fmt.Errorf("too long chain of file references")
 		}
-		defer decoder.Close()
 
-		tarReader := tar.NewReader(decoder)
+		links := make(map[string]restoreTargets)
+		deltas := make(map[string]restoreTargets)
 
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("ошибка при чтении tar-содержимого: %v", err)
-			}
-			if inArr, i := stringIn(header.Name, files); inArr {
-				log.Printf("Восстановление файла %s...", header.Name)
-				resultFilePath := filepath.Join(toDir, clean(header.Name))
-				os.MkdirAll(filepath.Dir(resultFilePath), 0644)
-				f, err := os.Create(resultFilePath)
+		archiveFiles := make([]string, 0, len(targets))
+		for archiveFile := range targets {
+			archiveFiles = append(archiveFiles, archiveFile)
+		}
+
+		// Архивы на подключённом носителе восстанавливаются первыми, остальные - по носителям
+		for _, archiveFile := range b.mediaOrder(archiveFiles) {
+			files := targets[archiveFile]
+			if isSnapshotFile(archiveFile) {
+				log.Printf("Восстановление из снимка %s...", archiveFile)
+				if repo == nil {
+					var err error
+					repo, err = b.openChunkRepository()
+					if err != nil {
+						return err
+					}
+				}
+
+				err := b.extractSnapshot(repo, archiveFile, files)
 				if err != nil {
 					return err
 				}
+				continue
+			}
+
+			err := b.extractArchive(archiveFile, files, links, deltas)
+			if err != nil {
+				return err
+			}
+		}
 
-				_, err = io.Copy(f, tarReader)
+		// Файлы, сохранённые как разница с предыдущей версией, проверяются по хешу из индекса
+		if len(deltas) > 0 && index == nil {
+			index, err = b.index(true)
+			if err != nil {
+				return err
+			}
+		}
+		for archiveFile, files := range deltas {
+			for file, resultFilePaths := range files {
+				log.Printf("Восстановление файла %s...", file)
+				err := b.restoreFileVersion(archiveFile, file, resultFilePaths, index.versionDigest(file, archiveFile))
 				if err != nil {
-					f.Close() // TODO: удалять частичный файл?
-					return fmt.Errorf("ошибка при извлечении файла из tar-архива: %v", err)
+					return fmt.Errorf("ошибка при восстановлении файла %s: %v", file, err)
 				}
+			}
+		}
 
-				f.Close()
-				if err != nil {
-					return err
+		targets = links
+	}
+
+	return nil
+}
+
+// extractArchive restores files from tar archive. Files stored as references
+// to content in other archive entries are added to links, files stored as
+// delta against previous version are added to deltas.
+func (b *Config) extractArchive(archiveFile string, files restoreTargets, links, deltas map[string]restoreTargets) error {
+	log.Printf("Восстановление из архивного файла %s...", archiveFile)
+	f, err := b.openArchive(archiveFile)
+	if err != nil {
+		return fmt.Errorf("ошибка при чтении файла архива: %v", err)
+	}
+	defer f.Close()
+
+	decoder, err := b.newArchiveReader(f, archiveFile)
+	if err != nil {
+		return fmt.Errorf("ошибка при инициализации разархиватора: %v", err)
+	}
+	defer decoder.Close()
+
+	tarReader := tar.NewReader(decoder)
+
+	// Все файлы извлечены, оставшиеся тома не нужны
+	for len(files) > 0 {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("ошибка при чтении tar-содержимого: %v", err)
+		}
+		if _, ok := header.PAXRecords[paxChecksumsRecord]; ok {
+			continue
+		}
+
+		resultFilePaths, exists := files[header.Name]
+		if !exists {
+			continue
+		}
+		delete(files, header.Name)
+
+		if header.Typeflag == tar.TypeLink {
+			linkArchive := archiveSetFileName(archiveFile)
+			if archive, ok := header.PAXRecords[paxLinkArchiveRecord]; ok {
+				linkArchive = archiveSetFileName(archive)
+			}
+			b.logf(Debug, "File %s is a reference to %s in %s.", header.Name, header.Linkname, linkArchive)
+
+			if links[linkArchive] == nil {
+				links[linkArchive] = make(restoreTargets)
+			}
+			links[linkArchive][header.Linkname] = append(links[linkArchive][header.Linkname], resultFilePaths...)
+			continue
+		}
+
+		if _, ok := header.PAXRecords[paxDeltaArchiveRecord]; ok {
+			if deltas[archiveFile] == nil {
+				deltas[archiveFile] = make(restoreTargets)
+			}
+			deltas[archiveFile][header.Name] = append(deltas[archiveFile][header.Name], resultFilePaths...)
+			continue
+		}
+
+		log.Printf("Восстановление файла %s...", header.Name)
+		err = writeRestoredFiles(resultFilePaths, tarReader)
+		if err != nil {
+			return fmt.Errorf("ошибка при извлечении файла из tar-архива: %v", err)
+		}
+	}
+
+	// Файлы из индекса или цели ссылок, отсутствующие в архиве
+	if len(files) > 0 {
+		missing := make([]string, 0, len(files))
+		for file := range files {
+			missing = append(missing, file)
+		}
+		sort.Strings(missing)
+
+		return fmt.Errorf("files not found in archive %s: %s", archiveFile, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// restoreFileVersion restores single file version from archive resolving
+// references to other archives and delta chains. Restored content is
+// checked against digest if it is not empty.
+func (b *Config) restoreFileVersion(archiveFile, filePath string, resultFilePaths []string, digest string) error {
+	// Записи с разностями от нужной версии к полной копии
+	var chain []archiveEntry
+
+	// Промежуточные версии файла, восстанавливаемого из разностей
+	var versions *deltaVersions
+
+	entry := archiveEntry{ArchiveFileName: archiveFile, FilePath: filePath}
+	for depth := 0; ; depth++ {
+		if depth > maxLinkDepth+b.Delta.maxChainLength() {
+			return fmt.Errorf("too long chain of file references")
+		}
+
+		var next *archiveEntry
+		err := b.readArchiveEntry(entry, func(header *tar.Header, r io.Reader) error {
+			if header.Typeflag == tar.TypeLink {
+				next = &archiveEntry{ArchiveFileName: archiveSetFileName(entry.ArchiveFileName), FilePath: header.Linkname}
+				if archive, ok := header.PAXRecords[paxLinkArchiveRecord]; ok {
+					next.ArchiveFileName = archiveSetFileName(archive)
 				}
+				return nil
+			}
+
+			if baseArchive, ok := header.PAXRecords[paxDeltaArchiveRecord]; ok {
+				b.logf(Debug, "File %s in %s is a delta against %s.", entry.FilePath, entry.ArchiveFileName, baseArchive)
+				chain = append(chain, entry)
+				next = &archiveEntry{ArchiveFileName: archiveSetFileName(baseArchive), FilePath: entry.FilePath}
+				return nil
+			}
 
-				files[i] = files[len(files)-1]
-				files = files[:len(files)-1]
+			if len(chain) == 0 {
+				return writeVerifiedFiles(resultFilePaths, r, digest)
 			}
+
+			var err error
+			versions, err = newDeltaVersions(filepath.Dir(resultFilePaths[0]), r)
+			return err
+		})
+		if versions != nil {
+			defer versions.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		if next == nil {
+			if versions == nil {
+				return nil
+			}
+
+			return b.restoreDelta(chain, versions, resultFilePaths, digest)
+		}
+
+		entry = *next
+	}
+}
+
+// archiveEntry is a file entry in archive
+type archiveEntry struct {
+	ArchiveFileName string
+	FilePath        string
+}
+
+// readArchiveEntry calls fn for content of archive entry. Archive is
+// closed after that, so media with other archives can be mounted.
+func (b *Config) readArchiveEntry(entry archiveEntry, fn func(header *tar.Header, r io.Reader) error) error {
+	if isSnapshotFile(entry.ArchiveFileName) {
+		return fmt.Errorf("file %s in snapshot %s can not be referenced", entry.FilePath, entry.ArchiveFileName)
+	}
+
+	f, err := b.openArchive(entry.ArchiveFileName)
+	if err != nil {
+		return fmt.Errorf("ошибка при чтении файла архива: %v", err)
+	}
+	defer f.Close()
+
+	decoder, err := b.newArchiveReader(f, entry.ArchiveFileName)
+	if err != nil {
+		return fmt.Errorf("ошибка при инициализации разархиватора: %v", err)
+	}
+	defer decoder.Close()
+
+	tarReader := tar.NewReader(decoder)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("file %s not found in archive %s", entry.FilePath, entry.ArchiveFileName)
+		}
+		if err != nil {
+			return fmt.Errorf("ошибка при чтении tar-содержимого: %v", err)
+		}
+		if header.Name == entry.FilePath {
+			return fn(header, tarReader)
 		}
 	}
+}
+
+// writeVerifiedFiles writes content read from r to all files and checks
+// its SHA-256 against digest if it is not empty
+func writeVerifiedFiles(filePaths []string, r io.Reader, digest string) error {
+	h := sha256.New()
+
+	err := writeRestoredFiles(filePaths, io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+
+	if digest != "" && !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), digest) {
+		return fmt.Errorf("restored content does not match digest %s", digest)
+	}
+
+	return nil
+}
+
+// writeRestoredFiles writes content read from r to all files
+func writeRestoredFiles(filePaths []string, r io.Reader) error {
+	var writers []io.Writer
+	for _, filePath := range filePaths {
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		f, err := os.Create(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		writers = append(writers, f)
+	}
+
+	_, err := io.Copy(io.MultiWriter(writers...), r) // TODO: удалять частичный файл?
+	if err != nil {
+		return err
+	}
+
+	for _, w := range writers {
+		err = w.(*os.File).Close()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Cache directory tag, see https://bford.info/cachedir/
+const (
+	cacheDirTagFileName  = "CACHEDIR.TAG"
+	cacheDirTagSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// isCacheDir reports whether dir contains a valid cache directory tag.
+func isCacheDir(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, cacheDirTagFileName))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(cacheDirTagSignature))
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(buf, []byte(cacheDirTagSignature))
+}
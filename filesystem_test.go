@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.False(t, isCacheDir(dir))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, cacheDirTagFileName), []byte("Signature: invalid"), 0644))
+	assert.False(t, isCacheDir(dir))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, cacheDirTagFileName), []byte(cacheDirTagSignature+"\n# This file is a cache directory tag.\n"), 0644))
+	assert.True(t, isCacheDir(dir))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+)
+
+// fileTypeSignature describes magic bytes of a file type
+type fileTypeSignature struct {
+	Name   string
+	Group  string
+	Offset int
+	Magic  []byte
+}
+
+// fileTypeSignatures contains known file type signatures.
+// File types can be referenced in config by name or by group.
+var fileTypeSignatures = []fileTypeSignature{
+	{"elf", "executable", 0, []byte("\x7fELF")},
+	{"pe", "executable", 0, []byte("MZ")},
+	{"macho", "executable", 0, []byte{0xcf, 0xfa, 0xed, 0xfe}},
+	{"macho", "executable", 0, []byte{0xce, 0xfa, 0xed, 0xfe}},
+
+	{"zip", "archive", 0, []byte("PK\x03\x04")},
+	{"gzip", "archive", 0, []byte{0x1f, 0x8b}},
+	{"zstd", "archive", 0, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"xz", "archive", 0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"bzip2", "archive", 0, []byte("BZh")},
+	{"7z", "archive", 0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}},
+	{"rar", "archive", 0, []byte("Rar!\x1a\x07")},
+
+	{"jpeg", "image", 0, []byte{0xff, 0xd8, 0xff}},
+	{"png", "image", 0, []byte("\x89PNG\r\n\x1a\n")},
+	{"gif", "image", 0, []byte("GIF8")},
+	{"webp", "image", 8, []byte("WEBP")},
+
+	{"mp4", "video", 4, []byte("ftyp")},
+	{"mkv", "video", 0, []byte{0x1a, 0x45, 0xdf, 0xa3}},
+	{"avi", "video", 8, []byte("AVI ")},
+
+	{"mp3", "audio", 0, []byte("ID3")},
+	{"flac", "audio", 0, []byte("fLaC")},
+	{"ogg", "audio", 0, []byte("OggS")},
+
+	{"pdf", "document", 0, []byte("%PDF-")},
+}
+
+// fileTypeChecks contains additional checks of file types whose magic bytes
+// are too short to tell the type reliably
+var fileTypeChecks = map[string]func(r io.ReaderAt) bool{
+	"pe": isPEFile,
+}
+
+// fileTypeHeaderSize is the number of bytes enough to detect any known file type
+const fileTypeHeaderSize = 16
+
+// detectFileType returns name and group of the file type detected by the file header.
+// Empty strings are returned for unknown types.
+func detectFileType(r io.ReaderAt) (name string, group string, err error) {
+	header := make([]byte, fileTypeHeaderSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+	header = header[:n]
+
+	for _, signature := range fileTypeSignatures {
+		if len(header) < signature.Offset+len(signature.Magic) {
+			continue
+		}
+
+		if !bytes.Equal(header[signature.Offset:signature.Offset+len(signature.Magic)], signature.Magic) {
+			continue
+		}
+
+		if check, ok := fileTypeChecks[signature.Name]; ok && !check(r) {
+			continue
+		}
+
+		return signature.Name, signature.Group, nil
+	}
+
+	return "", "", nil
+}
+
+// detectFileTypeOfFile returns name and group of the file type of the file
+func detectFileTypeOfFile(filePath string) (name string, group string, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	return detectFileType(f)
+}
+
+// isPEFile checks PE signature at the offset stored at 0x3C of MS-DOS header,
+// like debug/pe does
+func isPEFile(r io.ReaderAt) bool {
+	var buf [4]byte
+	if n, _ := r.ReadAt(buf[:], 0x3c); n < len(buf) {
+		return false
+	}
+
+	offset := int64(binary.LittleEndian.Uint32(buf[:]))
+	if n, _ := r.ReadAt(buf[:], offset); n < len(buf) {
+		return false
+	}
+
+	return string(buf[:]) == "PE\x00\x00"
+}
+
+// isFileTypeIn reports whether detected file type matches any of types given by name or group
+func isFileTypeIn(name, group string, types []string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, t := range types {
+		if strings.EqualFold(t, name) || strings.EqualFold(t, group) {
+			return true
+		}
+	}
+
+	return false
+}
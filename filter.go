@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// FileFilter contains rules for filtering files by size, age and type
+type FileFilter struct {
+	// Minimal file size
+	MinFileSize FileSize
+
+	// Maximal file size
+	MaxFileSize FileSize
+
+	// Minimal time since last modification, skips files still being written
+	MinAge time.Duration
+
+	// Maximal time since last modification
+	MaxAge time.Duration
+
+	// File types or groups of types to skip, detected by magic bytes
+	ExcludeFileTypes []string
+}
+
+// skipReason returns the reason why file should be skipped or empty string
+// if file passes the filter.
+func (filter *FileFilter) skipReason(filePath string, info fs.FileInfo, now time.Time) (string, error) {
+	if filter.MinFileSize > 0 && info.Size() < int64(filter.MinFileSize) {
+		return fmt.Sprintf("size %s is less than %s", sizeToApproxHuman(info.Size()), sizeToApproxHuman(int64(filter.MinFileSize))), nil
+	}
+
+	if filter.MaxFileSize > 0 && info.Size() > int64(filter.MaxFileSize) {
+		return fmt.Sprintf("size %s is greater than %s", sizeToApproxHuman(info.Size()), sizeToApproxHuman(int64(filter.MaxFileSize))), nil
+	}
+
+	age := now.Sub(info.ModTime())
+
+	if filter.MinAge > 0 && age < filter.MinAge {
+		return fmt.Sprintf("modified less than %s ago", filter.MinAge), nil
+	}
+
+	if filter.MaxAge > 0 && age > filter.MaxAge {
+		return fmt.Sprintf("modified more than %s ago", filter.MaxAge), nil
+	}
+
+	if len(filter.ExcludeFileTypes) > 0 {
+		name, group, err := detectFileTypeOfFile(filePath)
+		if err != nil {
+			return "", fmt.Errorf("read file header: %v", err)
+		}
+
+		if isFileTypeIn(name, group, filter.ExcludeFileTypes) {
+			return fmt.Sprintf("file type %s is excluded", name), nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectFileType(t *testing.T) {
+	name, group, err := detectFileType(strings.NewReader("\x7fELF\x02\x01\x01"))
+	assert.NoError(t, err)
+	assert.Equal(t, "elf", name)
+	assert.Equal(t, "executable", group)
+
+	name, _, err = detectFileType(strings.NewReader("\x00\x00\x00\x18ftypmp42"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mp4", name)
+
+	name, group, err = detectFileType(strings.NewReader("plain text"))
+	assert.NoError(t, err)
+	assert.Empty(t, name)
+	assert.Empty(t, group)
+
+	// PE signature is checked at the offset from MS-DOS header
+	pe := make([]byte, 0x84)
+	copy(pe, "MZ")
+	pe[0x3c] = 0x80
+	copy(pe[0x80:], "PE\x00\x00")
+	name, group, err = detectFileType(bytes.NewReader(pe))
+	assert.NoError(t, err)
+	assert.Equal(t, "pe", name)
+	assert.Equal(t, "executable", group)
+
+	name, _, err = detectFileType(strings.NewReader("MZ is not an executable"))
+	assert.NoError(t, err)
+	assert.Empty(t, name)
+
+	pe[0x3c] = 0xff
+	name, _, err = detectFileType(bytes.NewReader(pe))
+	assert.NoError(t, err)
+	assert.Empty(t, name)
+
+	assert.True(t, isFileTypeIn("elf", "executable", []string{"Executable"}))
+	assert.False(t, isFileTypeIn("", "", []string{""}))
+}
+
+func TestFileFilterSkipReason(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	binPath := filepath.Join(dir, "bin")
+	assert.NoError(t, os.WriteFile(binPath, []byte("\x7fELF0123456789"), 0644))
+	assert.NoError(t, os.Chtimes(binPath, now.Add(-time.Hour), now.Add(-time.Hour)))
+	binInfo, err := os.Stat(binPath)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		filter FileFilter
+		skip   bool
+	}{
+		{FileFilter{}, false},
+		{FileFilter{MinFileSize: 100}, true},
+		{FileFilter{MaxFileSize: 10}, true},
+		{FileFilter{MinFileSize: 10, MaxFileSize: 100}, false},
+		{FileFilter{MinAge: 2 * time.Hour}, true},
+		{FileFilter{MinAge: time.Minute}, false},
+		{FileFilter{MaxAge: time.Minute}, true},
+		{FileFilter{ExcludeFileTypes: []string{"executable"}}, true},
+		{FileFilter{ExcludeFileTypes: []string{"zip"}}, false},
+	}
+
+	for _, test := range tests {
+		reason, err := test.filter.skipReason(binPath, binInfo, now)
+		assert.NoError(t, err)
+		assert.Equal(t, test.skip, reason != "", "%+v", test.filter)
+	}
+}
@@ -1,16 +1,18 @@
 module github.com/nxshock/backuper
 
-go 1.20
+go 1.22
 
 require (
 	github.com/BurntSushi/toml v1.2.1
-	github.com/klauspost/compress v1.16.4
+	github.com/bmatcuk/doublestar/v4 v4.8.1
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.8.2
-	github.com/tidwall/match v1.1.1
+	golang.org/x/crypto v0.31.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// ignoreRule is a single line of an ignore file
+type ignoreRule struct {
+	// Pattern relative to the directory of the ignore file
+	pattern string
+
+	// Rule re-includes matched paths
+	negate bool
+
+	// Rule matches only directories
+	dirOnly bool
+}
+
+// IgnoreRules contains rules of an ignore file and rules inherited from
+// ignore files of parent directories.
+type IgnoreRules struct {
+	dir    string
+	rules  []ignoreRule
+	parent *IgnoreRules
+}
+
+// parseIgnoreRules parses ignore file content written in gitignore syntax.
+func parseIgnoreRules(r io.Reader) ([]ignoreRule, error) {
+	var rules []ignoreRule
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Trailing spaces are ignored unless escaped
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = line[:len(line)-1]
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		// Patterns without slash in the beginning or middle match at any level
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+
+		if !doublestar.ValidatePattern(line) {
+			continue
+		}
+
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// loadIgnoreRules reads ignore file with specified name from dir.
+// If there is no such file, parent rules are returned.
+func loadIgnoreRules(dir, fileName string, parent *IgnoreRules) (*IgnoreRules, error) {
+	f, err := os.Open(filepath.Join(dir, fileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return parent, nil
+	}
+	if err != nil {
+		return parent, err
+	}
+	defer f.Close()
+
+	rules, err := parseIgnoreRules(f)
+	if err != nil {
+		return parent, err
+	}
+
+	return &IgnoreRules{dir: dir, rules: rules, parent: parent}, nil
+}
+
+// Ignored reports whether path is excluded by rules.
+// Rules of nested directories take precedence over rules of parent directories.
+func (ignoreRules *IgnoreRules) Ignored(path string, isDir bool) bool {
+	if ignoreRules == nil {
+		return false
+	}
+
+	ignored := ignoreRules.parent.Ignored(path, isDir)
+
+	relPath, err := filepath.Rel(ignoreRules.dir, path)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return ignored
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	for _, rule := range ignoreRules.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if doublestar.MatchUnvalidated(rule.pattern, relPath) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
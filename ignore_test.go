@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIgnoreRules(t *testing.T) {
+	rules, err := parseIgnoreRules(strings.NewReader("# comment\n\n*.o\n/build/\n!keep.o\ndocs/*.tmp  \n\\#file\n"))
+	assert.NoError(t, err)
+
+	expected := []ignoreRule{
+		{pattern: "**/*.o"},
+		{pattern: "build", dirOnly: true},
+		{pattern: "**/keep.o", negate: true},
+		{pattern: "docs/*.tmp"},
+		{pattern: "**/#file"}}
+
+	assert.Equal(t, expected, rules)
+}
+
+func TestIgnoreRulesIgnored(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	assert.NoError(t, os.Mkdir(sub, 0755))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(root, defaultIgnoreFileName), []byte("*.o\nbuild/\n/top.txt\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(sub, defaultIgnoreFileName), []byte("!keep.o\n"), 0644))
+
+	rootRules, err := loadIgnoreRules(root, defaultIgnoreFileName, nil)
+	assert.NoError(t, err)
+	subRules, err := loadIgnoreRules(sub, defaultIgnoreFileName, rootRules)
+	assert.NoError(t, err)
+
+	assert.True(t, rootRules.Ignored(filepath.Join(root, "a.o"), false))
+	assert.True(t, rootRules.Ignored(filepath.Join(root, "top.txt"), false))
+	assert.False(t, subRules.Ignored(filepath.Join(sub, "top.txt"), false))
+	assert.True(t, rootRules.Ignored(filepath.Join(root, "build"), true))
+	assert.False(t, rootRules.Ignored(filepath.Join(root, "build"), false))
+	assert.True(t, subRules.Ignored(filepath.Join(sub, "a.o"), false))
+	assert.False(t, subRules.Ignored(filepath.Join(sub, "keep.o"), false))
+
+	noRules, err := loadIgnoreRules(filepath.Join(root, "build"), defaultIgnoreFileName, rootRules)
+	assert.NoError(t, err)
+	assert.Equal(t, rootRules, noRules)
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"archive/tar"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
+	"io/fs"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
@@ -18,15 +19,26 @@ type FileInfo struct {
 	ArchiveFileName  string
 	ModificationTime time.Time
 
+	// Hex SHA-256 of file content, empty if unknown
+	Digest string
+
+	// Label of removable media with archive, empty if archive is stored in Destination
+	MediaLabel string
+
 	filePath string
+
+	// File size, -1 if unknown for versions recorded by older index format
 	fileSize int64
 }
 
 type Index map[string]FileHistory
 
 func (index Index) AddFile(fileName string, archiveFileName string, modTime time.Time) {
-	fileInfo := FileInfo{ArchiveFileName: archiveFileName, ModificationTime: modTime}
+	index.AddFileInfo(fileName, FileInfo{ArchiveFileName: archiveFileName, ModificationTime: modTime})
+}
 
+// AddFileInfo adds file version to index
+func (index Index) AddFileInfo(fileName string, fileInfo FileInfo) {
 	if eFileInfo, exists := index[fileName]; exists {
 		index[fileName] = append(eFileInfo, fileInfo)
 		return
@@ -35,6 +47,26 @@ func (index Index) AddFile(fileName string, archiveFileName string, modTime time
 	index[fileName] = FileHistory{fileInfo}
 }
 
+// versionDigest returns digest of file version stored in archive set
+func (index Index) versionDigest(filePath, archiveFileName string) string {
+	for _, fileInfo := range index[filePath] {
+		if archiveSetFileName(fileInfo.ArchiveFileName) == archiveSetFileName(archiveFileName) {
+			return fileInfo.Digest
+		}
+	}
+
+	return ""
+}
+
+// setMediaLabel sets label of media with archives of all file versions
+func (index Index) setMediaLabel(label string) {
+	for _, fileHistory := range index {
+		for i := range fileHistory {
+			fileHistory[i].MediaLabel = label
+		}
+	}
+}
+
 func (index Index) ViewFileVersions(w io.Writer) error {
 	for filePath, fileHistory := range index {
 		_, err := fmt.Fprintf(w, "%s\n", filePath)
@@ -43,7 +75,12 @@ func (index Index) ViewFileVersions(w io.Writer) error {
 		}
 
 		for _, v := range fileHistory {
-			_, err := fmt.Fprintf(w, "\t%s %s\n", v.ModificationTime.Format(defaultTimeFormat), v.ArchiveFileName)
+			var err error
+			if v.MediaLabel != "" {
+				_, err = fmt.Fprintf(w, "\t%s %s [%s]\n", v.ModificationTime.Format(defaultTimeFormat), v.ArchiveFileName, v.MediaLabel)
+			} else {
+				_, err = fmt.Fprintf(w, "\t%s %s\n", v.ModificationTime.Format(defaultTimeFormat), v.ArchiveFileName)
+			}
 			if err != nil {
 				return err
 			}
@@ -54,22 +91,33 @@ func (index Index) ViewFileVersions(w io.Writer) error {
 	return nil
 }
 
-func (index Index) Save(fileName string) error {
-	f, err := os.Create(fileName)
+// Save writes index to storage as zstd compressed file encrypted according to settings.
+// Best compression is used if no encoder options are given.
+func (index Index) Save(storage Storage, fileName string, encryption *EncryptionConfig, options ...zstd.EOption) error {
+	f, err := storage.Put(fileName)
 	if err != nil {
 		return err
 	}
 
-	enc, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	encrypted, err := encryption.newIndexEncryptWriter(f)
 	if err != nil {
-		f.Close()
-		os.Remove(fileName)
+		f.Abort()
+		return err
+	}
+
+	if len(options) == 0 {
+		options = []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBestCompression)}
+	}
+
+	enc, err := zstd.NewWriter(encrypted, options...)
+	if err != nil {
+		f.Abort()
 		return err
 	}
 
 	files := make([]string, 0, len(index))
-	for fileName := range index {
-		files = append(files, fileName)
+	for filePath := range index {
+		files = append(files, filePath)
 	}
 
 	// Sort file list for better compression
@@ -78,13 +126,20 @@ func (index Index) Save(fileName string) error {
 	csvWriter := csv.NewWriter(enc)
 	csvWriter.Comma = ';'
 
-	for _, fileName := range files {
-		for _, historyItem := range index[fileName] {
-			err := csvWriter.Write([]string{fileName, historyItem.ArchiveFileName, strconv.Itoa(int(historyItem.ModificationTime.Unix()))})
+	for _, filePath := range files {
+		for _, historyItem := range index[filePath] {
+			record := []string{filePath, historyItem.ArchiveFileName, strconv.Itoa(int(historyItem.ModificationTime.Unix())), historyItem.Digest}
+			if historyItem.Digest != "" && historyItem.fileSize >= 0 {
+				// Sizes of known contents are used to find duplicate candidates
+				record = append(record, historyItem.MediaLabel, strconv.FormatInt(historyItem.fileSize, 10))
+			} else if historyItem.MediaLabel != "" {
+				record = append(record, historyItem.MediaLabel)
+			}
+
+			err := csvWriter.Write(record)
 			if err != nil {
 				enc.Close()
-				f.Close()
-				os.Remove(fileName)
+				f.Abort()
 				return err
 			}
 		}
@@ -93,24 +148,23 @@ func (index Index) Save(fileName string) error {
 	csvWriter.Flush()
 	if err := csvWriter.Error(); err != nil {
 		enc.Close()
-		f.Close()
-		os.Remove(fileName)
+		f.Abort()
 		return err
 	}
 
 	err = enc.Close()
 	if err != nil {
-		f.Close()
-		os.Remove(fileName)
+		f.Abort()
 		return err
 	}
 
-	err = f.Close()
+	err = encrypted.Close()
 	if err != nil {
+		f.Abort()
 		return err
 	}
 
-	return err
+	return f.Close()
 }
 
 func (b *Config) index(fullIndex bool) (Index, error) {
@@ -125,17 +179,46 @@ func (b *Config) index(fullIndex bool) (Index, error) {
 }
 
 func (b *Config) indexFromFile() (Index, error) {
-	index := make(Index)
+	index, err := b.readIndexFile(b.indexFileName())
+	if !errors.Is(err, fs.ErrNotExist) || b.IndexFileName != "" {
+		return index, err
+	}
+
+	// Индекс задания ещё не сохранён, записи архивов задания берутся из общего индекса
+	legacyIndex, legacyErr := b.readIndexFile(legacyIndexFileName)
+	if legacyErr != nil {
+		return nil, err
+	}
+	b.logf(Info, "Reading job archives from legacy index %s...", legacyIndexFileName)
+
+	index = make(Index)
+	for filePath, fileHistory := range legacyIndex {
+		for _, historyItem := range fileHistory {
+			if b.isJobFile(historyItem.ArchiveFileName) {
+				index.AddFileInfo(filePath, historyItem)
+			}
+		}
+	}
+
+	return index, nil
+}
 
-	indexFileName := filepath.Join(filepath.Dir(b.filePath), indexFileName)
+// readIndexFile reads index file from storage
+func (b *Config) readIndexFile(fileName string) (Index, error) {
+	index := make(Index)
 
-	f, err := os.Open(indexFileName)
+	f, err := b.storage().Get(fileName, 0, -1)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	dec, err := zstd.NewReader(f)
+	decrypted, err := b.Encryption.newIndexDecryptReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(decrypted)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +226,7 @@ func (b *Config) indexFromFile() (Index, error) {
 
 	csvReader := csv.NewReader(dec)
 	csvReader.Comma = ';'
-	csvReader.FieldsPerRecord = 3
+	csvReader.FieldsPerRecord = -1 // индексы старых версий не содержат хешей и размеров, метки носителей есть только у архивов на сменных носителях
 	for {
 		data, err := csvReader.Read()
 		if err == io.EOF {
@@ -152,79 +235,116 @@ func (b *Config) indexFromFile() (Index, error) {
 		if err != nil {
 			return nil, err
 		}
+		if len(data) < 3 || len(data) > 6 {
+			return nil, fmt.Errorf("wrong number of fields in index record: %d", len(data))
+		}
 
 		unixTime, err := strconv.Atoi(data[2])
 		if err != nil {
 			return nil, err
 		}
 
-		index.AddFile(data[0], data[1], time.Unix(int64(unixTime), 0).Local())
+		fileInfo := FileInfo{ArchiveFileName: data[1], ModificationTime: time.Unix(int64(unixTime), 0).Local(), fileSize: -1}
+		if len(data) >= 4 {
+			fileInfo.Digest = data[3]
+		}
+		if len(data) >= 5 {
+			fileInfo.MediaLabel = data[4]
+		}
+		if len(data) == 6 {
+			fileInfo.fileSize, err = strconv.ParseInt(data[5], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		index.AddFileInfo(data[0], fileInfo)
 	}
 
 	return index, nil
 }
 
 func (b *Config) indexFromDisk(fullIndex bool) (Index, error) {
-	b.logf(Info, "Rebuilding index from %s...", filepath.Dir(b.filePath))
-	allFileMask := filepath.Join(filepath.Dir(b.filePath), b.FileName+"*"+defaultExt)
-	onlyFullBackupFileMask := filepath.Join(filepath.Dir(b.filePath), b.FileName+"*f"+defaultExt)
+	b.log(Info, "Rebuilding index from archives...")
 
-	// Get last full backup name
-	lastFullBackupFileName := ""
-	err := filepath.WalkDir(filepath.Dir(b.filePath), func(path string, info os.DirEntry, err error) error {
-		matched, err := filepath.Match(onlyFullBackupFileMask, path)
+	// Архивы на других сменных носителях недоступны, индексируется только подключённый носитель
+	var mediaLabel string
+	if b.Media.Enabled() {
+		var err error
+		mediaLabel, err = b.mountedMedia()
 		if err != nil {
-			return fmt.Errorf("filepath.WalkDir: %v", err)
-		}
-		if !matched {
-			return nil
+			return nil, err
 		}
+		b.logf(Warn, "Only archives on mounted media %s are indexed.", mediaLabel)
+	}
 
-		lastFullBackupFileName = path
-
-		return nil
-	})
+	jobFiles, err := b.jobFiles(archiveExtMask, snapshotExt)
 	if err != nil {
-		return nil, fmt.Errorf("filepath.WalkDir: %v", err)
+		return nil, fmt.Errorf("ошибка при поиске архивов: %v", err)
+	}
+
+	// Get last full backup name
+	lastFullBackupFileName := ""
+	for _, path := range jobFiles {
+		if strings.HasSuffix(archiveBaseName(path), "f") {
+			lastFullBackupFileName = path
+		}
 	}
 
 	if !fullIndex {
-		b.logf(Debug, "Diff will be calculated from %s.", filepath.Base(lastFullBackupFileName))
+		b.logf(Debug, "Diff will be calculated from %s.", lastFullBackupFileName)
 	}
 
 	var files []string
-	err = filepath.WalkDir(filepath.Dir(b.filePath), func(path string, info os.DirEntry, err error) error {
-		matched, err := filepath.Match(allFileMask, path)
-		if err != nil {
-			return fmt.Errorf("filepath.Match: %v", err)
+	for _, path := range jobFiles {
+		// Тома, кроме первого, читаются вместе с первым
+		if _, volume, _ := parseVolumeFileName(path); volume > 1 {
+			continue
 		}
 
-		if matched && (fullIndex || path >= lastFullBackupFileName) {
+		if fullIndex || archiveBaseName(path) >= archiveBaseName(lastFullBackupFileName) {
 			files = append(files, path)
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("filepath.Walk: %v", err)
 	}
 
 	index := make(Index)
 
 	for i, file := range files {
-		b.logf(Debug, "[%3d%%] Reading file %s...", (100 * i / len(files)), filepath.Base(file))
-		f, err := os.Open(file)
+		b.logf(Debug, "[%3d%%] Reading file %s...", (100 * i / len(files)), file)
+
+		if isSnapshotFile(file) {
+			err = b.readSnapshot(file, func(entry SnapshotEntry) error {
+				index[entry.Path] = append(index[entry.Path], FileInfo{
+					filePath:         entry.Path,
+					ModificationTime: entry.ModificationTime,
+					fileSize:         entry.Size,
+					Digest:           entry.Digest,
+					ArchiveFileName:  file,
+					MediaLabel:       mediaLabel})
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("ошибка при чтении снимка %s: %v", file, err)
+			}
+			continue
+		}
+
+		f, err := openArchiveFile(b.storage(), file)
 		if err != nil {
-			return nil, fmt.Errorf("os.Open: %v", err)
+			return nil, fmt.Errorf("openArchiveFile: %v", err)
 		}
 		defer f.Close()
 
-		decoder, err := zstd.NewReader(f)
+		decoder, err := b.newArchiveReader(f, file)
 		if err != nil {
-			return nil, fmt.Errorf("zstd.NewReader: %v", err)
+			return nil, fmt.Errorf("newArchiveReader: %v", err)
 		}
 
 		tarReader := tar.NewReader(decoder)
 
+		// Files of current archive
+		var archiveFiles []string
+
 		for {
 			tarHeader, err := tarReader.Next()
 			if err != nil {
@@ -235,11 +355,27 @@ func (b *Config) indexFromDisk(fullIndex bool) (Index, error) {
 				}
 			}
 
+			if _, ok := tarHeader.PAXRecords[paxChecksumsRecord]; ok {
+				err = index.setDigestsFromArchive(archiveFiles, archiveSetFileName(file), tarReader)
+				if err != nil {
+					return nil, fmt.Errorf("ошибка при чтении контрольных сумм из архива %s: %v", file, err)
+				}
+				continue
+			}
+			archiveFiles = append(archiveFiles, tarHeader.Name)
+
+			archiveFileName := file
+			if volume, err := strconv.Atoi(tarHeader.PAXRecords[paxVolumeRecord]); err == nil {
+				base, _, ext := parseVolumeFileName(archiveFileName)
+				archiveFileName = volumeFileName(base, volume, ext)
+			}
+
 			index[tarHeader.Name] = append(index[tarHeader.Name], FileInfo{
 				filePath:         tarHeader.Name,
 				ModificationTime: tarHeader.FileInfo().ModTime(),
 				fileSize:         tarHeader.FileInfo().Size(),
-				ArchiveFileName:  filepath.Base(file)})
+				ArchiveFileName:  archiveFileName,
+				MediaLabel:       mediaLabel})
 		}
 		decoder.Close()
 	}
@@ -247,11 +383,39 @@ func (b *Config) indexFromDisk(fullIndex bool) (Index, error) {
 	return index, nil
 }
 
+// setDigestsFromArchive sets digests of archive files versions from checksums entry
+func (index Index) setDigestsFromArchive(archiveFiles []string, archiveSet string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	checksums, err := parseChecksums(data)
+	if err != nil {
+		return err
+	}
+
+	for _, filePath := range archiveFiles {
+		for i, fileInfo := range index[filePath] {
+			if archiveSetFileName(fileInfo.ArchiveFileName) == archiveSet {
+				index[filePath][i].Digest = checksums[filePath]
+			}
+		}
+	}
+
+	return nil
+}
+
 func (index Index) GetFilesLocation(mask string, t time.Time) ([]FileInfo, error) {
+	patterns := searchPatterns(mask)
+	if err := patterns.Validate(); err != nil {
+		return nil, err
+	}
+
 	var files2 []FileInfo
 
 	for fileName := range index {
-		if isFilePathMatchPatterns([]string{mask}, fileName) {
+		if patterns.Match(fileName) {
 			files := index[fileName]
 
 			file := files[0]
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -25,3 +27,61 @@ func TestIndexAddFile(t *testing.T) {
 
 	assert.Equal(t, expectedFileInfo, index[fileName][0])
 }
+
+func TestJobIndexSeparation(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+
+	newConfig := func(fileName string) *Config {
+		path := filepath.Join(root, fileName)
+		assert.NoError(t, os.MkdirAll(path, 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(path, "a.txt"), []byte(fileName), 0644))
+
+		return &Config{
+			FileName: fileName,
+			LogLevel: Error,
+			Patterns: []*Pattern{{
+				Path:                path,
+				FileNamePatternList: PatternList{"*"},
+				FilePathPatternList: PatternList{"**"},
+				MaxDepth:            -1}},
+			filePath: filepath.Join(dir, fileName+".toml")}
+	}
+
+	configs := []*Config{newConfig("backup"), newConfig("backup_home")}
+	for _, config := range configs {
+		assert.NoError(t, config.FullBackup())
+	}
+
+	legacyIndex := make(Index)
+	for _, config := range configs {
+		ownFile := filepath.ToSlash(filepath.Join(root, config.FileName, "a.txt"))
+
+		for _, fromDisk := range []bool{false, true} {
+			var index Index
+			var err error
+			if fromDisk {
+				index, err = config.indexFromDisk(true)
+			} else {
+				index, err = config.indexFromFile()
+			}
+			assert.NoError(t, err)
+			assert.Len(t, index, 1)
+			assert.Contains(t, index, ownFile)
+		}
+
+		index, err := config.indexFromFile()
+		assert.NoError(t, err)
+		for filePath, fileHistory := range index {
+			legacyIndex[filePath] = fileHistory
+		}
+	}
+
+	// Job archives are read from legacy shared index until job index is saved
+	assert.NoError(t, legacyIndex.Save(configs[0].storage(), legacyIndexFileName, &configs[0].Encryption))
+	assert.NoError(t, os.Remove(configs[0].indexFilePath()))
+	index, err := configs[0].indexFromFile()
+	assert.NoError(t, err)
+	assert.Len(t, index, 1)
+	assert.Contains(t, index, filepath.ToSlash(filepath.Join(root, "backup", "a.txt")))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	publicKeyPrefix  = "bkp-pub:"
+	privateKeyPrefix = "bkp-key:"
+
+	// Environment variable with path of private key file supplied at restore time
+	identityFileEnv = "BACKUPER_IDENTITY_FILE"
+
+	x25519KeySize = 32
+	x25519Info    = "backuper X25519"
+)
+
+// generateKeyPair creates new X25519 key pair, writes private key to file
+// and returns encoded public key
+func generateKeyPair(identityFilePath string) (string, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(identityFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = fmt.Fprintf(f, "%s%s\n", privateKeyPrefix, base64.RawStdEncoding.EncodeToString(privateKey.Bytes()))
+	if err != nil {
+		f.Close()
+		os.Remove(identityFilePath)
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return encodePublicKey(privateKey.PublicKey()), nil
+}
+
+func encodePublicKey(publicKey *ecdh.PublicKey) string {
+	return publicKeyPrefix + base64.RawStdEncoding.EncodeToString(publicKey.Bytes())
+}
+
+// parsePublicKey decodes public key written as "bkp-pub:<base64>"
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	if !strings.HasPrefix(s, publicKeyPrefix) {
+		return nil, fmt.Errorf("public key must start with %q", publicKeyPrefix)
+	}
+
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, publicKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %v", err)
+	}
+
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// readPrivateKey reads private key file written by generateKeyPair
+func readPrivateKey(filePath string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("read private key: %v", err)
+	}
+
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, privateKeyPrefix) {
+		return nil, fmt.Errorf("private key must start with %q", privateKeyPrefix)
+	}
+
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, privateKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("decode private key: %v", err)
+	}
+
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// x25519WrappingKey derives key wrapping key from shared secret
+func x25519WrappingKey(sharedSecret, ephemeralPublicKey, recipientPublicKey []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublicKey...), recipientPublicKey...)
+
+	wrappingKey := make([]byte, fileKeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, salt, []byte(x25519Info)), wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrappingKey, nil
+}
+
+// wrapKeyForRecipient returns X25519 stanza with file key wrapped for recipient:
+// ephemeral public key | wrapped file key
+func wrapKeyForRecipient(recipient *ecdh.PublicKey, fileKey []byte) ([]byte, error) {
+	ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := ephemeralKey.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappingKey, err := x25519WrappingKey(sharedSecret, ephemeralKey.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := wrapKey(wrappingKey, fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ephemeralKey.PublicKey().Bytes(), wrappedKey...), nil
+}
+
+// unwrapKeyWithIdentity decrypts file key from X25519 stanza
+func unwrapKeyWithIdentity(identity *ecdh.PrivateKey, stanza []byte) ([]byte, error) {
+	if len(stanza) < x25519KeySize {
+		return nil, errors.New("invalid key stanza")
+	}
+
+	ephemeralPublicKey, err := ecdh.X25519().NewPublicKey(stanza[:x25519KeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := identity.ECDH(ephemeralPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappingKey, err := x25519WrappingKey(sharedSecret, ephemeralPublicKey.Bytes(), identity.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapKey(wrappingKey, stanza[x25519KeySize:])
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -10,7 +11,15 @@ func init() {
 	log.SetFlags(0)
 }
 
+// Каталог для архивов, заданный в командной строке вместо Destination из файла настроек
+var destination string
+
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "-d" {
+		destination = os.Args[2]
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+
 	if len(os.Args) < 2 {
 		printUsage()
 		os.Exit(1)
@@ -18,7 +27,7 @@ func main() {
 
 	switch os.Args[1] {
 	case "f":
-		config, err := LoadConfig(os.Args[2])
+		config, err := loadConfig(os.Args[2])
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -28,7 +37,7 @@ func main() {
 			log.Fatalln(err)
 		}
 	case "i":
-		config, err := LoadConfig(os.Args[2])
+		config, err := loadConfig(os.Args[2])
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -38,7 +47,7 @@ func main() {
 			log.Fatalln(err)
 		}
 	case "s":
-		config, err := LoadConfig(os.Args[2])
+		config, err := loadConfig(os.Args[2])
 		if err != nil {
 			log.Fatalln("read config error:", err)
 		}
@@ -50,7 +59,7 @@ func main() {
 
 		idx.ViewFileVersions(os.Stdout)
 	case "r":
-		config, err := LoadConfig(os.Args[2])
+		config, err := loadConfig(os.Args[2])
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -69,12 +78,180 @@ func main() {
 			log.Fatalln(err)
 		}
 	case "t":
-		config, err := LoadConfig(os.Args[2])
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		config, err := loadConfig(os.Args[2])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		full := true
+		if len(os.Args) > 3 {
+			switch os.Args[3] {
+			case "quick":
+				full = false
+			case "full":
+			default:
+				printUsage()
+				os.Exit(1)
+			}
+		}
+
+		problems, err := config.Verify(full)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", problem.FileName, problem.Problem)
+		}
+
+		if len(problems) > 0 {
+			log.Printf("Verification failed, %d problems found.", len(problems))
+			os.Exit(1)
+		}
+		log.Print("No problems found.")
+	case "d":
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		config, err := loadConfig(os.Args[2])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		compareHashes := len(os.Args) > 3 && os.Args[3] == "hash"
+
+		report, err := config.Drift(compareHashes)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		err = report.Write(os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		log.Printf("New: %d, modified: %d, deleted: %d.", len(report.New), len(report.Modified), len(report.Deleted))
+		if compareHashes {
+			log.Printf("Content differs with the same modification time: %d, not compared: %d.", len(report.Corrupted), report.Unverified)
+		}
+
+		if len(report.Corrupted) > 0 {
+			os.Exit(1)
+		}
+	case "c":
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		config, err := loadConfig(os.Args[2])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		err = config.Resync(os.Args[3:]...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "m":
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		config, err := loadConfig(os.Args[2])
 		if err != nil {
 			log.Fatalln(err)
 		}
 
-		_, err = config.index(true)
+		if len(os.Args) > 3 {
+			err = config.LabelMedia(os.Args[3])
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.Printf("Media at %s is labeled %s.", config.destination(), os.Args[3])
+			return
+		}
+
+		catalog, err := config.mediaCatalog()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		mounted, err := config.mountedMedia()
+		if err != nil {
+			log.Println(err)
+		}
+
+		err = catalog.Write(os.Stdout, mounted)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "k":
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		publicKey, err := generateKeyPair(os.Args[2])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		log.Printf("Private key saved to %s, public key:", os.Args[2])
+		fmt.Println(publicKey)
+	case "g":
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		publicKey, err := generateSigningKey(os.Args[2])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		log.Printf("Signing key saved to %s, verification key:", os.Args[2])
+		fmt.Println(publicKey)
+	case "v":
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		config, err := loadConfig(os.Args[2])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		problems, err := config.VerifySignatures()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", problem.FileName, problem.Problem)
+		}
+
+		if len(problems) > 0 {
+			log.Printf("Verification failed, %d problems found.", len(problems))
+			os.Exit(1)
+		}
+		log.Print("All signatures are valid.")
+	case "l":
+		if len(os.Args) < 3 {
+			printUsage()
+			os.Exit(1)
+		}
+
+		err := servePlugin(newLocalStorage(os.Args[2]), os.Stdin, os.Stdout)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -83,13 +260,39 @@ func main() {
 	}
 }
 
+// loadConfig reads config file and applies command line settings
+func loadConfig(filePath string) (*Config, error) {
+	config, err := LoadConfig(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if destination != "" {
+		config.Destination, err = filepath.Abs(destination)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
+
 func printUsage() {
 	bin := filepath.Base(os.Args[0])
 
 	log.Print("Usage:\n")
+	log.Printf("%s [-d <destination directory>] <command> ...\n", bin)
 	log.Printf("%s i <config file path> - do incremental backup\n", bin)
 	log.Printf("%s f <config file path> - do full backup\n", bin)
 	log.Printf("%s s <config file path> <mask> - search file(s) in backup\n", bin)
 	log.Printf("%s r <config file path> <mask> <dd.mm.yyyy hh:mm> <path> - recover file(s) from backup\n", bin)
-	log.Printf("%s t <config file path> - test archive for errors\n", bin)
+	log.Printf("%s t <config file path> [quick|full] - verify archives and index, full by default\n", bin)
+	log.Printf("%s d <config file path> [hash] - compare backup with source files\n", bin)
+	log.Printf("%s c <config file path> [replica name...] - copy missing archives and index to replicas\n", bin)
+	log.Printf("%s m <config file path> [label] - label mounted media or list media with archives\n", bin)
+	log.Printf("%s k <private key file path> - generate key pair for public key encryption\n", bin)
+	log.Printf("%s g <signing key file path> - generate key pair for archive signing\n", bin)
+	log.Printf("%s v <config file path> - verify archive and index signatures\n", bin)
+	log.Printf("%s l <directory> - serve directory as storage plugin\n", bin)
+	log.Print("-d overrides Destination from config file\n")
 }
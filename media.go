@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Label file in the root of removable media
+const mediaLabelFileName = "backuper.label"
+
+var mediaLabelRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var errMediaNotMounted = errors.New("no labeled media mounted")
+
+// Answers to requests to mount media during restore
+var mediaInput = bufio.NewReader(os.Stdin)
+
+// MediaConfig contains settings of removable media holding archives
+type MediaConfig struct {
+	// Host directory for index, dictionaries and signatures, absolute or
+	// relative to the config file. If set, archives are written to labeled
+	// removable media mounted at Destination.
+	IndexDestination string
+}
+
+// Enabled reports whether archives are stored on removable media
+func (config *MediaConfig) Enabled() bool {
+	return config.IndexDestination != ""
+}
+
+// Validate checks media settings against storage settings
+func (config *MediaConfig) Validate(storage *StorageConfig, format string) error {
+	if !config.Enabled() {
+		return nil
+	}
+
+	if storage.Type != "" && storage.Type != storageLocal {
+		return fmt.Errorf("removable media requires local storage, got %q", storage.Type)
+	}
+
+	if format == formatChunked {
+		return errors.New("chunked format is not supported on removable media")
+	}
+
+	return nil
+}
+
+// isHostObject reports whether repository object is kept on the host when
+// archives are stored on removable media: index, dictionaries, signatures
+// and other files needed by every backup run
+func (b *Config) isHostObject(name string) bool {
+	if !b.isJobFile(name) {
+		return true
+	}
+
+	return strings.HasSuffix(name, dictExt) || strings.HasSuffix(name, signatureExt)
+}
+
+// mediaStorage keeps host objects in host storage and archives on the mounted media
+type mediaStorage struct {
+	host  Storage
+	media Storage
+
+	isHostObject func(name string) bool
+}
+
+func (s *mediaStorage) storage(name string) Storage {
+	if s.isHostObject(name) {
+		return s.host
+	}
+
+	return s.media
+}
+
+func (s *mediaStorage) Put(name string) (ObjectWriter, error) {
+	if !s.isHostObject(name) {
+		// Archives are not written to the mount point without media
+		if _, err := s.media.Stat(mediaLabelFileName); err != nil {
+			return nil, fmt.Errorf("put %s: %w", name, errMediaNotMounted)
+		}
+	}
+
+	return s.storage(name).Put(name)
+}
+
+func (s *mediaStorage) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	return s.storage(name).Get(name, offset, length)
+}
+
+func (s *mediaStorage) List(prefix string) ([]ObjectInfo, error) {
+	objects, err := s.host.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaObjects, err := s.media.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects are listed from the storage they are routed to
+	var result []ObjectInfo
+	for _, object := range objects {
+		if s.isHostObject(object.Name) {
+			result = append(result, object)
+		}
+	}
+	for _, object := range mediaObjects {
+		if !s.isHostObject(object.Name) {
+			result = append(result, object)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+func (s *mediaStorage) Delete(name string) error {
+	return s.storage(name).Delete(name)
+}
+
+func (s *mediaStorage) Stat(name string) (ObjectInfo, error) {
+	return s.storage(name).Stat(name)
+}
+
+// mountedMedia returns label of media mounted at Destination
+func (b *Config) mountedMedia() (string, error) {
+	data, err := os.ReadFile(filepath.Join(b.destination(), mediaLabelFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w at %s", errMediaNotMounted, b.destination())
+	}
+	if err != nil {
+		return "", fmt.Errorf("read media label: %v", err)
+	}
+
+	label := strings.TrimSpace(string(data))
+	if !mediaLabelRe.MatchString(label) {
+		return "", fmt.Errorf("invalid media label %q", label)
+	}
+
+	return label, nil
+}
+
+// LabelMedia labels media mounted at Destination. Labeled media is not relabeled.
+func (b *Config) LabelMedia(label string) error {
+	if !b.Media.Enabled() {
+		return errors.New("media index destination is not set")
+	}
+
+	if !mediaLabelRe.MatchString(label) {
+		return fmt.Errorf("invalid media label %q", label)
+	}
+
+	current, err := b.mountedMedia()
+	if err == nil {
+		if current == label {
+			return nil
+		}
+		return fmt.Errorf("media is already labeled %s", current)
+	}
+	if !errors.Is(err, errMediaNotMounted) {
+		return err
+	}
+
+	info, err := os.Stat(b.destination())
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", b.destination())
+	}
+
+	return os.WriteFile(filepath.Join(b.destination(), mediaLabelFileName), []byte(label+"\n"), 0644)
+}
+
+// MediaCatalog maps archive sets to labels of media holding them
+type MediaCatalog map[string]string
+
+// MediaCatalog returns labels of media with archives referenced by index
+func (index Index) MediaCatalog() MediaCatalog {
+	catalog := make(MediaCatalog)
+	for _, fileHistory := range index {
+		for _, historyItem := range fileHistory {
+			if historyItem.MediaLabel != "" {
+				catalog[archiveSetFileName(historyItem.ArchiveFileName)] = historyItem.MediaLabel
+			}
+		}
+	}
+
+	return catalog
+}
+
+// Labels returns sorted labels of media in catalog
+func (catalog MediaCatalog) Labels() []string {
+	var labels []string
+	for _, label := range catalog {
+		if found, _ := stringIn(label, labels); !found {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	return labels
+}
+
+// Write writes media labels with number of archives, mounted media is marked
+func (catalog MediaCatalog) Write(w io.Writer, mounted string) error {
+	counts := make(map[string]int)
+	for _, label := range catalog {
+		counts[label]++
+	}
+
+	for _, label := range catalog.Labels() {
+		mark := " "
+		if label == mounted {
+			mark = "*"
+		}
+
+		_, err := fmt.Fprintf(w, "%s %s: %d archives\n", mark, label, counts[label])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mediaCatalog returns catalog of archives on removable media read from the
+// index file. Catalog is read once and reset when index is saved.
+func (b *Config) mediaCatalog() (MediaCatalog, error) {
+	if b.catalog != nil {
+		return b.catalog, nil
+	}
+
+	index, err := b.indexFromFile()
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(MediaCatalog), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read media catalog: %v", err)
+	}
+	b.catalog = index.MediaCatalog()
+
+	return b.catalog, nil
+}
+
+// isOffline reports whether archive file is stored on media which is not mounted
+func (b *Config) isOffline(fileName string) bool {
+	if !b.Media.Enabled() {
+		return false
+	}
+
+	catalog, err := b.mediaCatalog()
+	if err != nil {
+		return false
+	}
+
+	label, ok := catalog[archiveSetFileName(fileName)]
+	if !ok {
+		return false
+	}
+
+	mounted, _ := b.mountedMedia()
+
+	return label != mounted
+}
+
+// planMedia returns sorted labels of media needed to restore files of plan.
+// Archives referenced by restored files are not known in advance, so other
+// media may be requested during restore.
+func (b *Config) planMedia(plan ExtractionPlan) ([]string, error) {
+	if !b.Media.Enabled() {
+		return nil, nil
+	}
+
+	catalog, err := b.mediaCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	planCatalog := make(MediaCatalog)
+	for archiveFile := range plan {
+		if label, ok := catalog[archiveSetFileName(archiveFile)]; ok {
+			planCatalog[archiveSetFileName(archiveFile)] = label
+		}
+	}
+
+	return planCatalog.Labels(), nil
+}
+
+// mediaOrder sorts archive sets so that archives on the mounted media go
+// first and archives on other media are grouped by media
+func (b *Config) mediaOrder(archiveSets []string) []string {
+	sort.Strings(archiveSets)
+	if !b.Media.Enabled() {
+		return archiveSets
+	}
+
+	catalog, err := b.mediaCatalog()
+	if err != nil {
+		return archiveSets
+	}
+	mounted, _ := b.mountedMedia()
+
+	rank := func(archiveSet string) string {
+		label, ok := catalog[archiveSetFileName(archiveSet)]
+		if !ok || label == mounted {
+			return ""
+		}
+		return label
+	}
+	sort.SliceStable(archiveSets, func(i, j int) bool { return rank(archiveSets[i]) < rank(archiveSets[j]) })
+
+	return archiveSets
+}
+
+// requireMedia waits until media holding archive is mounted. Archives
+// missing in catalog are expected in Destination.
+func (b *Config) requireMedia(archiveFile string) error {
+	if !b.Media.Enabled() {
+		return nil
+	}
+
+	catalog, err := b.mediaCatalog()
+	if err != nil {
+		return err
+	}
+
+	label, ok := catalog[archiveSetFileName(archiveFile)]
+	if !ok {
+		return nil
+	}
+
+	inputClosed := false
+	for {
+		mounted, err := b.mountedMedia()
+		if err == nil && mounted == label {
+			return nil
+		}
+		if err != nil && !errors.Is(err, errMediaNotMounted) {
+			return err
+		}
+		if inputClosed {
+			return fmt.Errorf("media %s with archive %s is not mounted", label, archiveFile)
+		}
+
+		if err == nil {
+			log.Printf("Media %s is mounted at %s.", mounted, b.destination())
+		}
+		log.Printf("Mount media %s at %s and press Enter...", label, b.destination())
+
+		_, err = mediaInput.ReadString('\n')
+		inputClosed = err != nil
+	}
+}
+
+// openArchive opens archive for restore asking to mount media holding it
+func (b *Config) openArchive(archiveFile string) (io.ReadCloser, error) {
+	err := b.requireMedia(archiveFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return openArchiveFile(b.storage(), archiveFile)
+}
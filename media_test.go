@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMedia simulates removable media by renaming directories to the mount
+// point. Every read of mount request answer mounts the next media of queue.
+type testMedia struct {
+	t          *testing.T
+	mountPoint string
+	mounted    string
+	queue      []string
+}
+
+func (m *testMedia) diskPath(name string) string {
+	return filepath.Join(filepath.Dir(m.mountPoint), "disk"+name)
+}
+
+func (m *testMedia) mount(name string) {
+	m.unmount()
+	assert.NoError(m.t, os.MkdirAll(m.diskPath(name), 0755))
+	assert.NoError(m.t, os.Rename(m.diskPath(name), m.mountPoint))
+	m.mounted = name
+}
+
+func (m *testMedia) unmount() {
+	if m.mounted == "" {
+		return
+	}
+	assert.NoError(m.t, os.Rename(m.mountPoint, m.diskPath(m.mounted)))
+	m.mounted = ""
+}
+
+func (m *testMedia) Read(p []byte) (int, error) {
+	if len(m.queue) == 0 {
+		return 0, io.EOF
+	}
+
+	m.mount(m.queue[0])
+	m.queue = m.queue[1:]
+
+	return copy(p, "\n"), nil
+}
+
+func TestMediaBackup(t *testing.T) {
+	defer func(input *bufio.Reader) { mediaInput = input }(mediaInput)
+
+	root := t.TempDir()
+	aPath := filepath.ToSlash(filepath.Join(root, "a.txt"))
+	bPath := filepath.ToSlash(filepath.Join(root, "b.txt"))
+	assert.NoError(t, os.WriteFile(aPath, []byte("a"), 0644))
+
+	configDir := t.TempDir()
+	media := &testMedia{t: t, mountPoint: filepath.Join(configDir, "media")}
+	config := &Config{
+		FileName:    "backup",
+		LogLevel:    Error,
+		Destination: "media",
+		Media:       MediaConfig{IndexDestination: "host"},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(configDir, "config.toml")}
+	assert.NoError(t, config.Media.Validate(&config.Storage, config.Format))
+	assert.Error(t, config.Media.Validate(&config.Storage, formatChunked))
+
+	// Archives are not written without labeled media
+	assert.ErrorIs(t, config.FullBackup(), errMediaNotMounted)
+
+	media.mount("A")
+	assert.ErrorIs(t, config.FullBackup(), errMediaNotMounted)
+	assert.NoError(t, config.LabelMedia("A"))
+	assert.NoError(t, config.FullBackup())
+	assert.ErrorContains(t, config.LabelMedia("B"), "already labeled A")
+
+	media.mount("B")
+	assert.NoError(t, config.LabelMedia("B"))
+	assert.NoError(t, os.WriteFile(bPath, []byte("b"), 0644))
+	assert.NoError(t, config.IncrementalBackup())
+
+	// Index is kept on the host, archives on media
+	assert.FileExists(t, filepath.Join(configDir, "host", "backup"+indexFileExt))
+	for _, disk := range []string{media.diskPath("A"), media.mountPoint} {
+		archives, err := filepath.Glob(filepath.Join(disk, "backup_*"+archiveExtMask))
+		assert.NoError(t, err)
+		assert.Len(t, archives, 1)
+	}
+
+	index, err := config.indexFromFile()
+	assert.NoError(t, err)
+	assert.Equal(t, "A", index[aPath][0].MediaLabel)
+	assert.Equal(t, "B", index[bPath][0].MediaLabel)
+
+	// Archives on unmounted media are not reported as missing
+	problems, err := config.Verify(true)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Restore asks for media in order
+	media.unmount()
+	plan, err := config.extractionPlan("*", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	labels, err := config.planMedia(plan)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"A", "B"}, labels)
+
+	media.queue = []string{"A", "B"}
+	mediaInput = bufio.NewReader(media)
+	toDir := t.TempDir()
+	assert.NoError(t, config.extract(plan, toDir))
+	assert.Empty(t, media.queue)
+
+	for filePath, content := range map[string]string{aPath: "a", bPath: "b"} {
+		data, err := os.ReadFile(filepath.Join(toDir, clean(filePath)))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(content), data)
+	}
+
+	// Restore fails if requested media is not mounted
+	media.mount("B")
+	assert.ErrorContains(t, config.extract(plan, t.TempDir()), "media A with archive")
+}
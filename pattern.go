@@ -1,15 +1,150 @@
 package main
 
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
 type Pattern struct {
 	// Root directory
 	Path string
 
 	// List of file name patterns
-	FileNamePatternList []string
+	FileNamePatternList PatternList
 
 	// List of file path patterns
-	FilePathPatternList []string
+	FilePathPatternList PatternList
+
+	// Maximal depth of subdirectories to search in: 0 - only root directory, -1 - unlimited
+	MaxDepth int
 
-	// Recursive search
+	// Recursive search.
+	//
+	// Deprecated: use MaxDepth = -1.
 	Recursive bool
+
+	// List of directory path patterns to skip without descending into them
+	ExcludeDirPatternList PatternList
+
+	// Do not cross file system boundaries
+	OneFileSystem bool
+
+	// Skip directories containing CACHEDIR.TAG file
+	SkipCacheDirs bool
+
+	// Size, age and type filters
+	FileFilter
+}
+
+// PatternList is an ordered list of gitignore-style glob patterns.
+//
+// "*" matches any sequence of characters inside one path segment, "**"
+// matches any number of segments, "{a,b}" expands to alternatives and
+// "[a-z]" matches a character class. A pattern prefixed with "!" negates
+// the match; patterns are evaluated in order and the last matching one wins.
+// Use "\!" to match a literal leading "!".
+type PatternList []string
+
+// Match reports whether path is matched by the pattern list.
+func (patterns PatternList) Match(path string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		negate := false
+		if strings.HasPrefix(pattern, "!") {
+			negate = true
+			pattern = pattern[1:]
+		}
+
+		if matched == !negate {
+			// Result cannot change
+			continue
+		}
+
+		if doublestar.MatchUnvalidated(pattern, path) {
+			matched = !negate
+		}
+	}
+
+	return matched
+}
+
+// MatchDir reports whether the pattern list matches every path inside
+// directory, so the directory can be skipped without descending into it.
+// Only patterns ending with "/**" match whole directories. Negated pattern
+// may match paths inside directory again, so it cancels earlier matches.
+func (patterns PatternList) MatchDir(dir string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			matched = false
+			continue
+		}
+
+		if prefix, ok := strings.CutSuffix(pattern, "/**"); ok && doublestar.MatchUnvalidated(prefix, dir) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// MatchName reports whether the base name of path is matched by the pattern list.
+func (patterns PatternList) MatchName(path string) bool {
+	return patterns.Match(filepath.Base(path))
+}
+
+// Validate checks the syntax of every pattern in the list.
+func (patterns PatternList) Validate() error {
+	for _, pattern := range patterns {
+		if !doublestar.ValidatePattern(strings.TrimPrefix(pattern, "!")) {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+
+	return nil
+}
+
+// searchPatterns returns pattern list for search and restore mask. Mask
+// without "/" matches file names at any depth, like in .gitignore files.
+func searchPatterns(mask string) PatternList {
+	if strings.Contains(mask, "/") {
+		return PatternList{mask}
+	}
+
+	return PatternList{"**/" + mask}
+}
+
+// legacyPatterns returns catch-all path patterns of earlier versions ("*" and
+// patterns starting with "*/"), which matched any number of path segments
+// before gitignore-style rules were used.
+func (patterns PatternList) legacyPatterns() []string {
+	var result []string
+	for _, pattern := range patterns {
+		p := strings.TrimPrefix(pattern, "!")
+		if p == "*" || strings.HasPrefix(p, "*/") {
+			result = append(result, pattern)
+		}
+	}
+
+	return result
+}
+
+// warnLegacyPatterns warns about path patterns which changed meaning with
+// gitignore-style rules
+func (b *Config) warnLegacyPatterns() {
+	lists := []PatternList{b.GlobalExcludeFilePathPatterns}
+	for _, mask := range b.Patterns {
+		lists = append(lists, mask.FilePathPatternList, mask.ExcludeDirPatternList)
+	}
+
+	for _, patterns := range lists {
+		for _, pattern := range patterns.legacyPatterns() {
+			b.logf(Warn, `Pattern %q: "*" matches one path segment only, use "**" to match any number of segments.`, pattern)
+		}
+	}
 }
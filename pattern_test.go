@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatternListMatch(t *testing.T) {
+	tests := []struct {
+		patterns PatternList
+		path     string
+		expected bool
+	}{
+		{PatternList{"*"}, "/etc/fstab", false},
+		{PatternList{"**"}, "/etc/fstab", true},
+		{PatternList{"/etc/*"}, "/etc/fstab", true},
+		{PatternList{"/etc/*"}, "/etc/nginx/nginx.conf", false},
+		{PatternList{"/etc/**/*.conf"}, "/etc/nginx/nginx.conf", true},
+		{PatternList{"/etc/**/*.conf"}, "/etc/a/b/c.conf", true},
+		{PatternList{"**/*.{conf,ini}"}, "/etc/php.ini", true},
+		{PatternList{"**/*.{conf,ini}"}, "/etc/php.toml", false},
+		{PatternList{"**/file[0-9]"}, "/tmp/file1", true},
+		{PatternList{"**/file[0-9]"}, "/tmp/filex", false},
+		{PatternList{"**", "!**/*.log"}, "/var/app.log", false},
+		{PatternList{"**", "!**/*.log", "**/keep.log"}, "/var/keep.log", true},
+		{PatternList{"!**/*.log", "**"}, "/var/app.log", true},
+		{PatternList{`\!*`}, "!file", true},
+		{PatternList{}, "/etc/fstab", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.patterns.Match(test.path), "%v %s", test.patterns, test.path)
+	}
+}
+
+func TestPatternListMatchName(t *testing.T) {
+	patterns := PatternList{"*.conf", "!secret.*"}
+
+	assert.True(t, patterns.MatchName("/etc/nginx/nginx.conf"))
+	assert.False(t, patterns.MatchName("/etc/secret.conf"))
+	assert.False(t, patterns.MatchName("/etc/fstab"))
+}
+
+func TestPatternListValidate(t *testing.T) {
+	assert.NoError(t, PatternList{"**/*.go", "!{a,b}"}.Validate())
+	assert.Error(t, PatternList{"[a-"}.Validate())
+	assert.Error(t, PatternList{"!{a,b"}.Validate())
+}
+
+func TestSearchPatterns(t *testing.T) {
+	assert.True(t, searchPatterns("*.go").Match("/home/user/main.go"))
+	assert.True(t, searchPatterns("*").Match("/etc/fstab"))
+	assert.True(t, searchPatterns("/home/**/*.go").Match("/home/user/main.go"))
+	assert.False(t, searchPatterns("/home/*.go").Match("/home/user/main.go"))
+}
+
+func TestPatternListLegacyPatterns(t *testing.T) {
+	assert.Equal(t, []string{"*/tmp/*", "!*"}, PatternList{"*/tmp/*", "**/tmp/**", "!/var/*", "/etc/*", "/etc/*.conf", "!*"}.legacyPatterns())
+	assert.Empty(t, PatternList{"**"}.legacyPatterns())
+}
+
+func TestPatternListMatchDir(t *testing.T) {
+	assert.True(t, PatternList{"**/tmp/**"}.MatchDir("/home/user/tmp"))
+	assert.False(t, PatternList{"**/tmp/**"}.MatchDir("/home/user"))
+	assert.False(t, PatternList{"**/tmp/*"}.MatchDir("/home/user/tmp"))
+	assert.False(t, PatternList{"**/tmp/**", "!**/keep"}.MatchDir("/home/user/tmp"))
+	assert.True(t, PatternList{"!**/keep", "/var/cache/**"}.MatchDir("/var/cache"))
+}
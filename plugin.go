@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage plugin protocol.
+//
+// Plugin is an executable started once per storage. It reads requests from
+// stdin and writes responses to stdout, one JSON object per line. Requests
+// are sent one at a time, every request gets exactly one response. Request
+// and response with non-zero "size" field are followed by that many bytes of
+// raw data. Plugin may log to stderr.
+//
+//	{"op":"hello","version":1}                       -> {"ok":true,"version":1}
+//	{"op":"put","id":1,"name":"a.tar"}               -> {"ok":true}
+//	{"op":"write","id":1,"size":5} + 5 bytes         -> {"ok":true}
+//	{"op":"close","id":1}                            -> {"ok":true}, object appears
+//	{"op":"abort","id":1}                            -> {"ok":true}, written data is discarded
+//	{"op":"read","name":"a.tar","offset":0,"length":1048576}
+//	                                                 -> {"ok":true,"size":n} + n bytes, n < length at the end of object
+//	{"op":"list","prefix":"a"}                       -> {"ok":true,"objects":[{"name":"a.tar","size":5,"mtime":1672531200}]}
+//	{"op":"stat","name":"a.tar"}                     -> {"ok":true,"object":{"name":"a.tar","size":5,"mtime":1672531200}}
+//	{"op":"delete","name":"a.tar"}                   -> {"ok":true}, missing object is not an error
+//
+// Failed requests get {"ok":false,"error":"message"}, "notExist":true is
+// added for missing objects. Several put streams with different ids can be
+// open at the same time. Plugin exits when stdin is closed.
+const (
+	pluginProtocolVersion = 1
+
+	// Data size of read and write requests
+	pluginChunkSize = 1 << 20
+)
+
+// PluginConfig contains settings of external storage plugin
+type PluginConfig struct {
+	// Plugin command line, run by sh -c (cmd /C on Windows)
+	Command string
+}
+
+// Validate checks plugin settings
+func (config *PluginConfig) Validate() error {
+	if strings.TrimSpace(config.Command) == "" {
+		return errors.New("plugin command is not set")
+	}
+
+	return nil
+}
+
+type pluginRequest struct {
+	Op      string `json:"op"`
+	Version int    `json:"version,omitempty"`
+	ID      int    `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	Offset  int64  `json:"offset,omitempty"`
+	Length  int64  `json:"length,omitempty"`
+	Size    int    `json:"size,omitempty"`
+}
+
+type pluginResponse struct {
+	OK       bool           `json:"ok"`
+	Error    string         `json:"error,omitempty"`
+	NotExist bool           `json:"notExist,omitempty"`
+	Version  int            `json:"version,omitempty"`
+	Size     int            `json:"size,omitempty"`
+	Object   *pluginObject  `json:"object,omitempty"`
+	Objects  []pluginObject `json:"objects,omitempty"`
+}
+
+type pluginObject struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+}
+
+func (object pluginObject) info() ObjectInfo {
+	return ObjectInfo{Name: object.Name, Size: object.Size, ModTime: time.Unix(object.ModTime, 0)}
+}
+
+func newPluginObject(info ObjectInfo) pluginObject {
+	return pluginObject{Name: info.Name, Size: info.Size, ModTime: info.ModTime.Unix()}
+}
+
+// writeMessage writes JSON line followed by data
+func writeMessage(w *bufio.Writer, message any, data []byte) error {
+	b, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	w.Write(b)
+	w.WriteByte('\n')
+	w.Write(data)
+
+	return w.Flush()
+}
+
+// readMessage reads JSON line and returns false on end of stream
+func readMessage(r *bufio.Reader, message any) (bool, error) {
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = json.Unmarshal(line, message)
+	if err != nil {
+		return false, fmt.Errorf("invalid message: %v", err)
+	}
+
+	return true, nil
+}
+
+// readData reads data following message
+func readData(r *bufio.Reader, size int) ([]byte, error) {
+	if size < 0 || size > pluginChunkSize {
+		return nil, fmt.Errorf("invalid data size %d", size)
+	}
+
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+
+	return data, err
+}
+
+// pluginStorage stores objects with external plugin
+type pluginStorage struct {
+	config *PluginConfig
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  *bufio.Writer
+	pipe   io.WriteCloser
+	stdout *bufio.Reader
+
+	// Communication error, plugin is not used after it
+	err error
+
+	// Id of the last put stream
+	lastID int
+}
+
+func newPluginStorage(config *PluginConfig) *pluginStorage {
+	return &pluginStorage{config: config}
+}
+
+// start runs plugin and checks protocol version
+func (s *pluginStorage) start() error {
+	cmd := shellCommand(s.config.Command)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("start storage plugin: %v", err)
+	}
+
+	s.cmd, s.pipe, s.stdin, s.stdout = cmd, stdin, bufio.NewWriter(stdin), bufio.NewReader(stdout)
+
+	resp, _, err := s.exchange(pluginRequest{Op: "hello", Version: pluginProtocolVersion}, nil)
+	if err != nil {
+		// Команда, не найденная оболочкой, обнаруживается только здесь
+		return fmt.Errorf("start storage plugin: %v", err)
+	}
+	if resp.Version != pluginProtocolVersion {
+		return fmt.Errorf("unsupported storage plugin protocol version %d", resp.Version)
+	}
+
+	return nil
+}
+
+// exchange sends request and reads response
+func (s *pluginStorage) exchange(req pluginRequest, data []byte) (*pluginResponse, []byte, error) {
+	err := writeMessage(s.stdin, req, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp := new(pluginResponse)
+	ok, err := readMessage(s.stdout, resp)
+	if err == nil && !ok {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = readData(s.stdout, resp.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !resp.OK {
+		if resp.NotExist {
+			return resp, nil, fmt.Errorf("storage plugin %s %s: %w", req.Op, req.Name, fs.ErrNotExist)
+		}
+		return resp, nil, fmt.Errorf("storage plugin %s %s: %s", req.Op, req.Name, resp.Error)
+	}
+
+	return resp, data, nil
+}
+
+// call sends request to plugin, starting it if needed
+func (s *pluginStorage) call(req pluginRequest, data []byte) (*pluginResponse, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+
+	if s.cmd == nil {
+		err := s.start()
+		if err != nil {
+			s.fail(err)
+			return nil, nil, err
+		}
+	}
+
+	resp, respData, err := s.exchange(req, data)
+	if err != nil && resp == nil {
+		s.fail(fmt.Errorf("storage plugin: %v", err))
+		return nil, nil, s.err
+	}
+
+	return resp, respData, err
+}
+
+// fail stops plugin after communication error
+func (s *pluginStorage) fail(err error) {
+	s.err = err
+
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+}
+
+// Close stops plugin
+func (s *pluginStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil || s.err != nil {
+		return nil
+	}
+	s.err = errors.New("storage plugin is closed")
+
+	s.pipe.Close()
+
+	return s.cmd.Wait()
+}
+
+// pluginObjectWriter writes object with plugin put stream
+type pluginObjectWriter struct {
+	s   *pluginStorage
+	id  int
+	buf []byte
+
+	done bool
+}
+
+func (s *pluginStorage) Put(name string) (ObjectWriter, error) {
+	s.mu.Lock()
+	s.lastID++
+	id := s.lastID
+	s.mu.Unlock()
+
+	_, _, err := s.call(pluginRequest{Op: "put", ID: id, Name: name}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pluginObjectWriter{s: s, id: id}, nil
+}
+
+func (w *pluginObjectWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("write to closed object")
+	}
+
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= pluginChunkSize {
+		err := w.flush(pluginChunkSize)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// flush sends size bytes of buffered data
+func (w *pluginObjectWriter) flush(size int) error {
+	_, _, err := w.s.call(pluginRequest{Op: "write", ID: w.id, Size: size}, w.buf[:size])
+	if err != nil {
+		return err
+	}
+	w.buf = w.buf[:copy(w.buf, w.buf[size:])]
+
+	return nil
+}
+
+func (w *pluginObjectWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		err := w.flush(len(w.buf))
+		if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	w.done = true
+
+	_, _, err := w.s.call(pluginRequest{Op: "close", ID: w.id}, nil)
+
+	return err
+}
+
+func (w *pluginObjectWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	w.s.call(pluginRequest{Op: "abort", ID: w.id}, nil)
+}
+
+// pluginObjectReader reads object by chunks
+type pluginObjectReader struct {
+	s    *pluginStorage
+	name string
+
+	offset int64
+
+	// Bytes left to read, negative if object is read up to the end
+	remaining int64
+
+	data []byte
+	eof  bool
+}
+
+func (s *pluginStorage) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	r := &pluginObjectReader{s: s, name: name, offset: offset, remaining: length}
+
+	// The first chunk is read to report missing object
+	err := r.fill()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// fill reads next chunk of object
+func (r *pluginObjectReader) fill() error {
+	length := int64(pluginChunkSize)
+	if r.remaining >= 0 && r.remaining < length {
+		length = r.remaining
+	}
+
+	_, data, err := r.s.call(pluginRequest{Op: "read", Name: r.name, Offset: r.offset, Length: length}, nil)
+	if err != nil {
+		return err
+	}
+
+	r.data = data
+	r.offset += int64(len(data))
+	if r.remaining >= 0 {
+		r.remaining -= int64(len(data))
+	}
+	r.eof = int64(len(data)) < length || r.remaining == 0
+
+	return nil
+}
+
+func (r *pluginObjectReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		err := r.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+func (r *pluginObjectReader) Close() error {
+	return nil
+}
+
+func (s *pluginStorage) List(prefix string) ([]ObjectInfo, error) {
+	resp, _, err := s.call(pluginRequest{Op: "list", Prefix: prefix}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]ObjectInfo, 0, len(resp.Objects))
+	for _, object := range resp.Objects {
+		objects = append(objects, object.info())
+	}
+
+	return objects, nil
+}
+
+func (s *pluginStorage) Delete(name string) error {
+	_, _, err := s.call(pluginRequest{Op: "delete", Name: name}, nil)
+
+	return err
+}
+
+func (s *pluginStorage) Stat(name string) (ObjectInfo, error) {
+	resp, _, err := s.call(pluginRequest{Op: "stat", Name: name}, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if resp.Object == nil {
+		return ObjectInfo{}, fmt.Errorf("storage plugin stat %s: no object in response", name)
+	}
+
+	return resp.Object.info(), nil
+}
+
+// servePlugin serves storage over plugin protocol until r is closed.
+// It is the reference plugin implementation.
+func servePlugin(storage Storage, r io.Reader, w io.Writer) error {
+	in, out := bufio.NewReader(r), bufio.NewWriter(w)
+
+	writers := make(map[int]ObjectWriter)
+	defer func() {
+		for _, writer := range writers {
+			writer.Abort()
+		}
+	}()
+
+	for {
+		var req pluginRequest
+		ok, err := readMessage(in, &req)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		data, err := readData(in, req.Size)
+		if err != nil {
+			return err
+		}
+
+		resp, respData, err := handlePluginRequest(storage, writers, req, data)
+		if err != nil {
+			resp = &pluginResponse{Error: err.Error(), NotExist: errors.Is(err, fs.ErrNotExist)}
+		} else {
+			resp.OK = true
+			resp.Size = len(respData)
+		}
+
+		err = writeMessage(out, resp, respData)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func handlePluginRequest(storage Storage, writers map[int]ObjectWriter, req pluginRequest, data []byte) (*pluginResponse, []byte, error) {
+	resp := new(pluginResponse)
+
+	switch req.Op {
+	case "hello":
+		resp.Version = pluginProtocolVersion
+	case "put":
+		if _, exists := writers[req.ID]; exists {
+			return nil, nil, fmt.Errorf("stream %d is already open", req.ID)
+		}
+
+		writer, err := storage.Put(req.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		writers[req.ID] = writer
+	case "write", "close", "abort":
+		writer, exists := writers[req.ID]
+		if !exists {
+			return nil, nil, fmt.Errorf("unknown stream %d", req.ID)
+		}
+
+		switch req.Op {
+		case "write":
+			_, err := writer.Write(data)
+			if err != nil {
+				writer.Abort()
+				delete(writers, req.ID)
+				return nil, nil, err
+			}
+		case "close":
+			delete(writers, req.ID)
+			err := writer.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+		case "abort":
+			delete(writers, req.ID)
+			writer.Abort()
+		}
+	case "read":
+		if req.Length < 0 || req.Length > pluginChunkSize {
+			return nil, nil, fmt.Errorf("invalid read length %d", req.Length)
+		}
+
+		r, err := storage.Get(req.Name, req.Offset, req.Length)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer r.Close()
+
+		respData := make([]byte, req.Length)
+		n, err := io.ReadFull(r, respData)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+
+		return resp, respData[:n], nil
+	case "list":
+		objects, err := storage.List(req.Prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp.Objects = make([]pluginObject, 0, len(objects))
+		for _, object := range objects {
+			resp.Objects = append(resp.Objects, newPluginObject(object))
+		}
+	case "stat":
+		info, err := storage.Stat(req.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		object := newPluginObject(info)
+		resp.Object = &object
+	case "delete":
+		err := storage.Delete(req.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown operation %q", req.Op)
+	}
+
+	return resp, nil, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPluginHelperProcess is the reference plugin started by tests
+func TestPluginHelperProcess(t *testing.T) {
+	dir := os.Getenv("BACKUPER_TEST_PLUGIN_DIR")
+	if dir == "" {
+		return
+	}
+
+	err := servePlugin(newLocalStorage(dir), os.Stdin, os.Stdout)
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// testPluginConfig returns settings of reference plugin serving dir
+func testPluginConfig(t *testing.T, dir string) PluginConfig {
+	t.Setenv("BACKUPER_TEST_PLUGIN_DIR", dir)
+
+	return PluginConfig{Command: "'" + os.Args[0] + "' -test.run='^TestPluginHelperProcess$'"}
+}
+
+func TestPluginStorage(t *testing.T) {
+	dir := t.TempDir()
+	config := testPluginConfig(t, dir)
+	assert.NoError(t, config.Validate())
+
+	storage := newPluginStorage(&config)
+	defer storage.Close()
+
+	// Objects larger than chunk are split into several requests
+	large := bytes.Repeat([]byte("0123456789abcdef"), pluginChunkSize/16*2+100)
+	w, err := storage.Put("a/large.bin")
+	assert.NoError(t, err)
+	_, err = w.Write(large)
+	assert.NoError(t, err)
+
+	// Other requests are served while object is being written
+	assert.NoError(t, writeObject(storage, "a/b c.txt", []byte("0123456789")))
+	assert.NoFileExists(t, filepath.Join(dir, "a", "large.bin"))
+
+	assert.NoError(t, w.Close())
+	data, err := os.ReadFile(filepath.Join(dir, "a", "large.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, large, data)
+
+	data, err = readObject(storage, "a/large.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, large, data)
+
+	r, err := storage.Get("a/large.bin", pluginChunkSize-2, 5)
+	assert.NoError(t, err)
+	data, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, large[pluginChunkSize-2:pluginChunkSize+3], data)
+
+	r, err = storage.Get("a/b c.txt", 7, -1)
+	assert.NoError(t, err)
+	data, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("789"), data)
+
+	// Aborted object is not stored
+	w, err = storage.Put("a/aborted.bin")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("data"))
+	assert.NoError(t, err)
+	w.Abort()
+
+	objects, err := storage.List("a/")
+	assert.NoError(t, err)
+	if assert.Len(t, objects, 2) {
+		assert.Equal(t, "a/b c.txt", objects[0].Name)
+		assert.Equal(t, int64(10), objects[0].Size)
+		assert.Equal(t, "a/large.bin", objects[1].Name)
+	}
+
+	info, err := storage.Stat("a/b c.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), info.Size)
+
+	assert.NoError(t, storage.Delete("a/b c.txt"))
+	assert.NoError(t, storage.Delete("a/b c.txt"))
+	_, err = storage.Stat("a/b c.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = storage.Get("a/b c.txt", 0, -1)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Plugin is not restarted after it is stopped
+	assert.NoError(t, storage.Close())
+	_, err = storage.Stat("a/large.bin")
+	assert.Error(t, err)
+}
+
+func TestPluginStartError(t *testing.T) {
+	storage := newPluginStorage(&PluginConfig{Command: filepath.Join(t.TempDir(), "missing")})
+
+	_, err := storage.List("")
+	assert.ErrorContains(t, err, "start storage plugin")
+}
+
+func TestPluginBackup(t *testing.T) {
+	root := t.TempDir()
+	filePath := filepath.ToSlash(filepath.Join(root, "a.txt"))
+	assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+
+	storageDir := t.TempDir()
+	configDir := t.TempDir()
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		Storage:  StorageConfig{Type: storagePlugin, Plugin: testPluginConfig(t, storageDir)},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(configDir, "config.toml")}
+	defer func() { config.storage().(*pluginStorage).Close() }()
+
+	assert.NoError(t, config.FullBackup())
+	assert.FileExists(t, filepath.Join(storageDir, "backup"+indexFileExt))
+
+	problems, err := config.Verify(true)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	toDir := t.TempDir()
+	plan, err := config.extractionPlan("*", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, config.extract(plan, toDir))
+
+	data, err := os.ReadFile(filepath.Join(toDir, clean(filePath)))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Replica states are stored in the primary storage:
+	//
+	//	<FileName>.replicas/<replica name>.csv - name;size;SHA-256;unix time of copy;
+	//	                                         modification time of source object in unix nanoseconds
+	replicaStateDirExt = ".replicas"
+
+	defaultReplicaMaxRetries = 3
+)
+
+// Delay before the first retry of failed copy, doubled for every next retry
+var replicaRetryDelay = time.Second
+
+var replicaNameRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ReplicaConfig describes copy of repository receiving new archives and index
+type ReplicaConfig struct {
+	// Unique replica name
+	Name string
+
+	// Directory of local replica, absolute or relative to the config file
+	Destination string
+
+	// Replica storage, Destination directory by default
+	Storage StorageConfig
+
+	// Number of copy retries of every object
+	MaxRetries int
+
+	storageBackend Storage
+}
+
+// Validate checks replica settings
+func (replica *ReplicaConfig) Validate() error {
+	if !replicaNameRe.MatchString(replica.Name) {
+		return fmt.Errorf("invalid replica name %q", replica.Name)
+	}
+
+	if (replica.Storage.Type == "" || replica.Storage.Type == storageLocal) && replica.Destination == "" {
+		return errors.New("destination is not set")
+	}
+
+	if replica.MaxRetries < 0 {
+		return fmt.Errorf("invalid max retries %d", replica.MaxRetries)
+	}
+
+	return replica.Storage.Validate()
+}
+
+func (replica *ReplicaConfig) maxRetries() int {
+	if replica.MaxRetries == 0 {
+		return defaultReplicaMaxRetries
+	}
+
+	return replica.MaxRetries
+}
+
+// replicaStorage returns storage of replica
+func (b *Config) replicaStorage(replica *ReplicaConfig) Storage {
+	if replica.storageBackend == nil {
+		replica.storageBackend = newStorage(&replica.Storage, b.resolvePath(replica.Destination))
+	}
+
+	return replica.storageBackend
+}
+
+// replicaObject is object copied to replica
+type replicaObject struct {
+	Size   int64
+	Digest string
+	Time   time.Time
+
+	// Modification time of the source object, zero if unknown
+	ModTime time.Time
+}
+
+// replicaState lists objects copied to replica and verified: name - object
+type replicaState map[string]replicaObject
+
+func (b *Config) replicaStateFileName(replica *ReplicaConfig) string {
+	return b.FileName + replicaStateDirExt + "/" + replica.Name + ".csv"
+}
+
+// readReplicaState reads state of replica, missing state is empty
+func (b *Config) readReplicaState(replica *ReplicaConfig) (replicaState, error) {
+	state := make(replicaState)
+
+	data, err := readObject(b.storage(), b.replicaStateFileName(replica))
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	csvReader := csv.NewReader(bytes.NewReader(data))
+	csvReader.Comma = ';'
+	csvReader.FieldsPerRecord = -1 // состояния старых версий не содержат времени изменения
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read replica state: %v", err)
+	}
+
+	for _, record := range records {
+		if len(record) < 4 || len(record) > 5 {
+			return nil, fmt.Errorf("read replica state: wrong number of fields: %d", len(record))
+		}
+		size, err := strconv.ParseInt(record[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("read replica state: %v", err)
+		}
+		unixTime, err := strconv.ParseInt(record[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("read replica state: %v", err)
+		}
+
+		object := replicaObject{Size: size, Digest: record[2], Time: time.Unix(unixTime, 0)}
+		if len(record) == 5 && record[4] != "" {
+			modTime, err := strconv.ParseInt(record[4], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("read replica state: %v", err)
+			}
+			object.ModTime = time.Unix(0, modTime)
+		}
+
+		state[record[0]] = object
+	}
+
+	return state, nil
+}
+
+// writeReplicaState saves state of replica
+func (b *Config) writeReplicaState(replica *ReplicaConfig, state replicaState) error {
+	names := make([]string, 0, len(state))
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	csvWriter := csv.NewWriter(&buf)
+	csvWriter.Comma = ';'
+	for _, name := range names {
+		object := state[name]
+		var modTime string
+		if !object.ModTime.IsZero() {
+			modTime = strconv.FormatInt(object.ModTime.UnixNano(), 10)
+		}
+		err := csvWriter.Write([]string{name, strconv.FormatInt(object.Size, 10), object.Digest, strconv.FormatInt(object.Time.Unix(), 10), modTime})
+		if err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	return writeObject(b.storage(), b.replicaStateFileName(replica), buf.Bytes())
+}
+
+// isMutableObject reports whether repository object is rewritten by backup runs.
+// Archives, snapshots, dictionaries, signatures of archives and packs are
+// written once.
+func (b *Config) isMutableObject(name string) bool {
+	return !b.isJobFile(name) && !strings.HasPrefix(name, b.chunkRepositoryPrefix()+"/"+packDirName+"/")
+}
+
+// repositoryObjects returns objects of the job in the order of copying to
+// replicas: immutable objects first, index and its signature last, so the
+// replica index never refers to missing archives
+func (b *Config) repositoryObjects() ([]ObjectInfo, error) {
+	objects, err := b.storage().List(b.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	indexFileNames := []string{b.indexFileName(), b.indexFileName() + signatureExt}
+
+	var result []ObjectInfo
+	for _, object := range objects {
+		if b.isJobFile(object.Name) ||
+			strings.HasPrefix(object.Name, b.chunkRepositoryPrefix()+"/") ||
+			strings.HasPrefix(object.Name, b.FileName+signatureDirExt+"/") {
+			result = append(result, object)
+		}
+	}
+
+	// Index name may be set without job name prefix
+	for _, name := range indexFileNames {
+		info, err := b.storage().Stat(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+
+	rank := func(name string) int {
+		switch {
+		case name == indexFileNames[0]:
+			return 2
+		case name == indexFileNames[1]:
+			return 3
+		case b.isMutableObject(name):
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if rank(result[i].Name) != rank(result[j].Name) {
+			return rank(result[i].Name) < rank(result[j].Name)
+		}
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+// copyObject copies object to replica storage and checks checksum of the copy.
+// Size and hex SHA-256 of object are returned.
+func (b *Config) copyObject(storage Storage, name string) (int64, string, error) {
+	r, err := b.storage().Get(name, 0, -1)
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+
+	w, err := storage.Put(name)
+	if err != nil {
+		return 0, "", err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(w, io.TeeReader(r, h))
+	if err != nil {
+		w.Abort()
+		return 0, "", err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return 0, "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	copySize, copyDigest, err := objectDigest(storage, name)
+	if err != nil {
+		return 0, "", fmt.Errorf("read copy: %v", err)
+	}
+	if copySize != size || copyDigest != digest {
+		return 0, "", errors.New("checksum mismatch of copy")
+	}
+
+	return size, digest, nil
+}
+
+// syncReplica copies objects missing or outdated in replica and returns
+// number of copied objects. Copies of immutable objects are checked by size,
+// mutable ones by size and modification time, and by checksum if the
+// object was touched since it was copied.
+func (b *Config) syncReplica(replica *ReplicaConfig) (int, error) {
+	storage := b.replicaStorage(replica)
+
+	state, err := b.readReplicaState(replica)
+	if err != nil {
+		return 0, err
+	}
+
+	objects, err := b.repositoryObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	replicaObjects, err := storage.List(b.FileName)
+	if err != nil {
+		return 0, fmt.Errorf("list replica: %v", err)
+	}
+	replicaSizes := make(map[string]int64)
+	for _, object := range replicaObjects {
+		replicaSizes[object.Name] = object.Size
+	}
+
+	copied := 0
+	stateChanged := false
+	for _, object := range objects {
+		recorded, upToDate := state[object.Name]
+		upToDate = upToDate && recorded.Size == object.Size
+
+		replicaSize, onReplica := replicaSizes[object.Name]
+		if !onReplica && upToDate {
+			// Objects outside of the job prefix are not listed
+			info, err := storage.Stat(object.Name)
+			onReplica, replicaSize = err == nil, info.Size
+		}
+		upToDate = upToDate && onReplica && replicaSize == object.Size
+
+		if upToDate && b.isMutableObject(object.Name) && (object.ModTime.IsZero() || !object.ModTime.Equal(recorded.ModTime)) {
+			_, digest, err := objectDigest(b.storage(), object.Name)
+			if err != nil {
+				return copied, err
+			}
+			upToDate = digest == recorded.Digest
+
+			// Rewritten with the same content, checksum is not calculated next time
+			if upToDate && !object.ModTime.IsZero() {
+				recorded.ModTime = object.ModTime
+				state[object.Name] = recorded
+				stateChanged = true
+			}
+		}
+
+		if upToDate {
+			continue
+		}
+
+		b.logf(Debug, "Copying %s to replica %s...", object.Name, replica.Name)
+
+		for attempt := 0; ; attempt++ {
+			size, digest, copyErr := b.copyObject(storage, object.Name)
+			if copyErr == nil {
+				state[object.Name] = replicaObject{Size: size, Digest: digest, Time: time.Now(), ModTime: object.ModTime}
+				break
+			}
+
+			if attempt >= replica.maxRetries() {
+				err = b.writeReplicaState(replica, state)
+				if err != nil {
+					b.logf(Error, "save replica %s state error: %v", replica.Name, err)
+				}
+				return copied, fmt.Errorf("copy %s: %v", object.Name, copyErr)
+			}
+
+			delay := replicaRetryDelay << attempt
+			b.logf(Warn, "copy %s to replica %s error, retrying in %v: %v", object.Name, replica.Name, delay, copyErr)
+			time.Sleep(delay)
+		}
+		copied++
+	}
+
+	if copied == 0 && !stateChanged {
+		return 0, nil
+	}
+
+	return copied, b.writeReplicaState(replica, state)
+}
+
+// replicaByName returns replica with given name
+func (b *Config) replicaByName(name string) (*ReplicaConfig, error) {
+	for _, replica := range b.Replicas {
+		if replica.Name == name {
+			return replica, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown replica %s", name)
+}
+
+// Resync brings replicas up to date with the primary storage. If names are
+// empty, all replicas are synchronized.
+func (b *Config) Resync(names ...string) error {
+	replicas := b.Replicas
+	if len(names) > 0 {
+		replicas = nil
+		for _, name := range names {
+			replica, err := b.replicaByName(name)
+			if err != nil {
+				return err
+			}
+			replicas = append(replicas, replica)
+		}
+	}
+
+	var failed []string
+	for _, replica := range replicas {
+		b.logf(Info, "Synchronizing replica %s...", replica.Name)
+
+		copied, err := b.syncReplica(replica)
+		if err != nil {
+			b.logf(Error, "replica %s error: %v", replica.Name, err)
+			failed = append(failed, replica.Name)
+			continue
+		}
+
+		if copied > 0 {
+			b.logf(Info, "%d files copied to replica %s.", copied, replica.Name)
+		} else {
+			b.logf(Info, "Replica %s is up to date.", replica.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("replication failed: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStorage fails the first put requests and corrupts the first stored objects
+type flakyStorage struct {
+	Storage
+
+	failures    int
+	corruptions int
+}
+
+func (s *flakyStorage) Put(name string) (ObjectWriter, error) {
+	if s.failures > 0 {
+		s.failures--
+		return nil, errors.New("injected failure")
+	}
+
+	w, err := s.Storage.Put(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.corruptions > 0 {
+		s.corruptions--
+		w.Write([]byte("garbage"))
+	}
+
+	return w, nil
+}
+
+// countingStorage counts reads of objects other than replica states
+type countingStorage struct {
+	Storage
+
+	gets int
+}
+
+func (s *countingStorage) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	if !strings.Contains(name, replicaStateDirExt+"/") {
+		s.gets++
+	}
+
+	return s.Storage.Get(name, offset, length)
+}
+
+// assertReplicated checks that replica has the same job objects as primary storage
+func assertReplicated(t *testing.T, config *Config, storage Storage) {
+	objects, err := config.repositoryObjects()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, objects)
+
+	for _, object := range objects {
+		_, digest, err := objectDigest(config.storage(), object.Name)
+		assert.NoError(t, err)
+		_, replicaDigest, err := objectDigest(storage, object.Name)
+		assert.NoError(t, err, object.Name)
+		assert.Equal(t, digest, replicaDigest, object.Name)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	defer func(delay time.Duration) { replicaRetryDelay = delay }(replicaRetryDelay)
+	replicaRetryDelay = time.Millisecond
+
+	root := t.TempDir()
+	filePath := filepath.Join(root, "a.txt")
+	assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+
+	configDir := t.TempDir()
+	flaky := &flakyStorage{Storage: newLocalStorage(filepath.Join(configDir, "flaky")), failures: 1, corruptions: 1}
+	config := &Config{
+		FileName:    "backup",
+		LogLevel:    Error,
+		Destination: "primary",
+		Replicas: []*ReplicaConfig{
+			{Name: "disk", Destination: "disk"},
+			{Name: "flaky", Destination: "flaky", storageBackend: flaky}},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(configDir, "config.toml")}
+	for _, replica := range config.Replicas {
+		assert.NoError(t, replica.Validate())
+	}
+
+	// Failed and corrupted copies are retried
+	assert.NoError(t, config.FullBackup())
+	assert.Zero(t, flaky.failures)
+	assert.Zero(t, flaky.corruptions)
+	assertReplicated(t, config, newLocalStorage(filepath.Join(configDir, "disk")))
+	assertReplicated(t, config, flaky)
+
+	state, err := config.readReplicaState(config.Replicas[1])
+	assert.NoError(t, err)
+	assert.Contains(t, state, "backup"+indexFileExt)
+
+	// Replica falls behind when retries are exhausted
+	time.Sleep(time.Second)
+	assert.NoError(t, os.WriteFile(filePath, []byte("modified"), 0644))
+	assert.NoError(t, os.Chtimes(filePath, time.Now(), time.Now().Add(time.Minute)))
+	flaky.failures = 100
+	assert.ErrorContains(t, config.IncrementalBackup(), "replication failed: flaky")
+	assertReplicated(t, config, newLocalStorage(filepath.Join(configDir, "disk")))
+
+	flaky.failures = 0
+	assert.NoError(t, config.Resync("flaky"))
+	assertReplicated(t, config, flaky)
+
+	// Up to date replica is not copied again and unchanged objects are not read
+	primary := &countingStorage{Storage: config.storage()}
+	config.storageBackend = primary
+	copied, err := config.syncReplica(config.Replicas[1])
+	assert.NoError(t, err)
+	assert.Zero(t, copied)
+	assert.Zero(t, primary.gets)
+
+	// Touched index with the same content is hashed once
+	indexFilePath := filepath.Join(configDir, "primary", "backup"+indexFileExt)
+	assert.NoError(t, os.Chtimes(indexFilePath, time.Now(), time.Now().Add(time.Hour)))
+	copied, err = config.syncReplica(config.Replicas[1])
+	assert.NoError(t, err)
+	assert.Zero(t, copied)
+	assert.Equal(t, 1, primary.gets)
+	copied, err = config.syncReplica(config.Replicas[1])
+	assert.NoError(t, err)
+	assert.Zero(t, copied)
+	assert.Equal(t, 1, primary.gets)
+
+	// Objects removed from replica are copied again
+	archives, err := filepath.Glob(filepath.Join(configDir, "disk", "backup_*"+archiveExtMask))
+	assert.NoError(t, err)
+	assert.Len(t, archives, 2)
+	assert.NoError(t, os.Remove(archives[0]))
+	copied, err = config.syncReplica(config.Replicas[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, copied)
+
+	assert.ErrorContains(t, config.Resync("missing"), "unknown replica")
+}
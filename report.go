@@ -0,0 +1,65 @@
+package main
+
+// SkippedFile describes a file skipped by filters
+type SkippedFile struct {
+	FilePath string
+	Reason   string
+}
+
+// PatternOverlap describes two patterns matched the same files
+type PatternOverlap struct {
+	First     *Pattern
+	Second    *Pattern
+	FileCount int
+}
+
+// Report contains results of file list building
+type Report struct {
+	// Files skipped by size, age or type filters
+	SkippedFiles []SkippedFile
+
+	// Patterns matched the same files
+	Overlaps []*PatternOverlap
+
+	// Error which stopped building of file list
+	err error
+}
+
+// Stop registers error which stopped building of file list
+func (report *Report) Stop(err error) {
+	if report == nil {
+		return
+	}
+
+	report.err = err
+}
+
+// Err returns error which stopped building of file list
+func (report *Report) Err() error {
+	return report.err
+}
+
+// AddSkippedFile registers file skipped by filters
+func (report *Report) AddSkippedFile(filePath, reason string) {
+	if report == nil {
+		return
+	}
+
+	report.SkippedFiles = append(report.SkippedFiles, SkippedFile{FilePath: filePath, Reason: reason})
+}
+
+// AddOverlap registers file matched by second pattern which was already matched by first pattern
+func (report *Report) AddOverlap(first, second *Pattern) {
+	if report == nil {
+		return
+	}
+
+	for _, overlap := range report.Overlaps {
+		if overlap.First == first && overlap.Second == second {
+			overlap.FileCount++
+			return
+		}
+	}
+
+	report.Overlaps = append(report.Overlaps, &PatternOverlap{First: first, Second: second, FileCount: 1})
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region     = "us-east-1"
+	defaultS3PartSize   = 16 << 20
+	minS3PartSize       = 5 << 20
+	defaultS3MaxRetries = 3
+	defaultS3RetryDelay = 500 * time.Millisecond
+
+	s3TimeFormat  = "20060102T150405Z"
+	s3DateFormat  = "20060102"
+	s3EmptyDigest = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config contains settings of S3-compatible object storage
+type S3Config struct {
+	// Service URL, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Endpoint string
+
+	// Region used for request signing, us-east-1 by default
+	Region string
+
+	Bucket string
+
+	// Prefix of object names in bucket, e.g. "backups/host1"
+	Prefix string
+
+	// Credentials, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+	// variables are used if not set
+	AccessKeyID         string
+	SecretAccessKey     string
+	SecretAccessKeyFile string
+
+	// Address bucket as host name prefix instead of path prefix
+	VirtualHostedStyle bool
+
+	// Size of multipart upload parts, objects of this size and larger are
+	// uploaded in parts
+	PartSize FileSize
+
+	// Number of retries of failed requests
+	MaxRetries int
+}
+
+// Validate checks S3 settings
+func (config *S3Config) Validate() error {
+	u, err := url.Parse(config.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q", config.Endpoint)
+	}
+
+	if config.Bucket == "" {
+		return errors.New("bucket is not set")
+	}
+
+	if config.PartSize != 0 && config.PartSize < minS3PartSize {
+		return fmt.Errorf("part size must be at least %s", sizeToApproxHuman(minS3PartSize))
+	}
+
+	if config.MaxRetries < 0 {
+		return fmt.Errorf("invalid max retries %d", config.MaxRetries)
+	}
+
+	return nil
+}
+
+// credentials returns access key id and secret access key
+func (config *S3Config) credentials() (string, string, error) {
+	accessKeyID := config.AccessKeyID
+	if accessKeyID == "" {
+		accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	secretAccessKey := config.SecretAccessKey
+	switch {
+	case secretAccessKey != "":
+	case config.SecretAccessKeyFile != "":
+		b, err := os.ReadFile(config.SecretAccessKeyFile)
+		if err != nil {
+			return "", "", fmt.Errorf("read secret access key file: %v", err)
+		}
+		secretAccessKey = strings.TrimRight(string(b), "\r\n")
+	default:
+		secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if accessKeyID == "" || secretAccessKey == "" {
+		return "", "", errors.New("s3 credentials are not set")
+	}
+
+	return accessKeyID, secretAccessKey, nil
+}
+
+// s3Storage stores objects in S3-compatible object storage
+type s3Storage struct {
+	config     *S3Config
+	client     *http.Client
+	region     string
+	partSize   int
+	maxRetries int
+	retryDelay time.Duration
+}
+
+func newS3Storage(config *S3Config) *s3Storage {
+	s := &s3Storage{
+		config:     config,
+		client:     http.DefaultClient,
+		region:     config.Region,
+		partSize:   int(config.PartSize),
+		maxRetries: config.MaxRetries,
+		retryDelay: defaultS3RetryDelay}
+
+	if s.region == "" {
+		s.region = defaultS3Region
+	}
+	if s.partSize == 0 {
+		s.partSize = defaultS3PartSize
+	}
+	if s.maxRetries == 0 {
+		s.maxRetries = defaultS3MaxRetries
+	}
+
+	return s
+}
+
+// key returns bucket key of object
+func (s *s3Storage) key(name string) string {
+	prefix := strings.Trim(s.config.Prefix, "/")
+	if prefix == "" {
+		return name
+	}
+
+	return prefix + "/" + name
+}
+
+// name returns object name of bucket key
+func (s *s3Storage) name(key string) string {
+	prefix := strings.Trim(s.config.Prefix, "/")
+	if prefix == "" {
+		return key
+	}
+
+	return strings.TrimPrefix(key, prefix+"/")
+}
+
+// uriEncode encodes string as required by AWS Signature Version 4
+func uriEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+
+	return buf.String()
+}
+
+// canonicalQuery returns query string with sorted and encoded parameters
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// s3Signature calculates AWS Signature Version 4 of request with given
+// signed headers. Header names must be lower case.
+func s3Signature(method, escapedPath, rawQuery string, header http.Header, host string, signedHeaders []string, payloadDigest, secretAccessKey, region string, t time.Time) string {
+	query, _ := url.ParseQuery(rawQuery)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := header.Get(name)
+		if name == "host" {
+			value = host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadDigest}, "\n")
+
+	scope := t.Format(s3DateFormat) + "/" + region + "/s3/aws4_request"
+	requestDigest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(requestDigest[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{t.Format(s3DateFormat), region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// sign adds AWS Signature Version 4 authorization to request
+func (s *s3Storage) sign(req *http.Request, payloadDigest string, t time.Time) error {
+	accessKeyID, secretAccessKey, err := s.config.credentials()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadDigest)
+
+	signedHeaders := []string{"host"}
+	for name := range req.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(name))
+	}
+	sort.Strings(signedHeaders)
+
+	signature := s3Signature(req.Method, req.URL.EscapedPath(), req.URL.RawQuery, req.Header, req.URL.Host, signedHeaders, payloadDigest, secretAccessKey, s.region, t)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s/%s/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		accessKeyID, t.Format(s3DateFormat), s.region, strings.Join(signedHeaders, ";"), signature))
+
+	return nil
+}
+
+// objectURL returns URL of bucket key, empty key addresses the bucket
+func (s *s3Storage) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.config.VirtualHostedStyle {
+		u.Host = s.config.Bucket + "." + u.Host
+	} else {
+		p += "/" + s.config.Bucket
+	}
+	p += "/" + key
+
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	return u, nil
+}
+
+// s3Error is error response of S3 service
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// responseError returns error of failed request and closes response body
+func responseError(method, key string, resp *http.Response) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3 %s %s: %w", method, key, fs.ErrNotExist)
+	}
+
+	var e s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s %s", method, key, resp.Status, e.Code, e.Message)
+	}
+
+	return fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+}
+
+// retryable reports whether failed request can be retried
+func retryable(resp *http.Response) bool {
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// do sends signed request, requests failed with network and server errors
+// are retried. Response with status code >= 300 is returned as error.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := s3EmptyDigest
+	if len(body) > 0 {
+		d := sha256.Sum256(body)
+		digest = hex.EncodeToString(d[:])
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		err = s.sign(req, digest, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.client.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		if err == nil {
+			retry := retryable(resp)
+			err = responseError(method, key, resp)
+			if !retry {
+				return nil, err
+			}
+		}
+
+		if attempt >= s.maxRetries {
+			return nil, err
+		}
+
+		delay := s.retryDelay << attempt
+		log.Printf("s3 request failed, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// s3ObjectReader reads object, interrupted downloads are resumed from the
+// last read byte
+type s3ObjectReader struct {
+	s   *s3Storage
+	key string
+
+	offset int64
+
+	// Bytes left to read, negative if object is read up to the end
+	remaining int64
+
+	body    io.ReadCloser
+	retries int
+}
+
+func (s *s3Storage) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	r := &s3ObjectReader{s: s, key: s.key(name), offset: offset, remaining: length}
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *s3ObjectReader) open() error {
+	header := make(http.Header)
+	if r.remaining >= 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.remaining-1))
+	} else if r.offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	}
+
+	resp, err := r.s.do(http.MethodGet, r.key, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	r.body = resp.Body
+
+	return nil
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if r.remaining > 0 && int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if r.remaining > 0 {
+		r.remaining -= int64(n)
+	}
+
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil || err == io.EOF || r.retries >= r.s.maxRetries {
+		return n, err
+	}
+
+	// Download is resumed on the next read
+	r.retries++
+	r.body.Close()
+	if openErr := r.open(); openErr != nil {
+		return n, openErr
+	}
+
+	return n, nil
+}
+
+func (r *s3ObjectReader) Close() error {
+	return r.body.Close()
+}
+
+// s3ObjectWriter uploads object, data larger than part size is uploaded in parts
+type s3ObjectWriter struct {
+	s   *s3Storage
+	key string
+
+	buf bytes.Buffer
+
+	uploadID string
+	parts    []s3CompletedPart
+
+	done bool
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3Storage) Put(name string) (ObjectWriter, error) {
+	return &s3ObjectWriter{s: s, key: s.key(name)}, nil
+}
+
+func (w *s3ObjectWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("write to closed object")
+	}
+
+	w.buf.Write(p)
+
+	for w.buf.Len() >= w.s.partSize {
+		err := w.uploadPart(w.buf.Next(w.s.partSize))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *s3ObjectWriter) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		if err != nil || result.UploadID == "" {
+			return fmt.Errorf("s3 create multipart upload %s: invalid response", w.key)
+		}
+		w.uploadID = result.UploadID
+	}
+
+	partNumber := len(w.parts) + 1
+	resp, err := w.s.do(http.MethodPut, w.key, url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {w.uploadID}}, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	w.parts = append(w.parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+	return nil
+}
+
+func (w *s3ObjectWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	if w.uploadID == "" {
+		w.done = true
+
+		resp, err := w.s.do(http.MethodPut, w.key, nil, nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		return resp.Body.Close()
+	}
+
+	if w.buf.Len() > 0 {
+		err := w.uploadPart(w.buf.Bytes())
+		if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	w.done = true
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.s.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		w.abortUpload()
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Completion errors can be reported with 200 OK status
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var e s3Error
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		w.abortUpload()
+		return fmt.Errorf("s3 complete multipart upload %s: %s %s", w.key, e.Code, e.Message)
+	}
+
+	return nil
+}
+
+func (w *s3ObjectWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	w.abortUpload()
+}
+
+func (w *s3ObjectWriter) abortUpload() {
+	if w.uploadID == "" {
+		return
+	}
+
+	resp, err := w.s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *s3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	query := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %v", prefix, err)
+		}
+
+		for _, object := range result.Contents {
+			objects = append(objects, ObjectInfo{Name: s.name(object.Key), Size: object.Size, ModTime: object.LastModified})
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	return objects, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Stat(name string) (ObjectInfo, error) {
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	info := ObjectInfo{Name: name, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return info, nil
+}
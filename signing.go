@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Signature sidecar format, one line per field:
+//
+//	backuper-manifest 1
+//	archive <quoted archive base name>
+//	previous <SHA-256 of previous signature file or "none">
+//	file <quoted file name> <size> <SHA-256>
+//	signature <base64 ed25519 signature of all previous lines>
+//
+// Names are quoted as Go string literals.
+//
+// Every run writes <archive base name>.sig listing all files of the run.
+// Signature of the index covers the index file and links to the signature
+// of the archive that produced this index generation.
+const (
+	signingKeyPrefix   = "bkp-sign:"
+	verifyingKeyPrefix = "bkp-verify:"
+
+	manifestHeader   = "backuper-manifest 1"
+	signatureExt     = ".sig"
+	noPreviousDigest = "none"
+)
+
+// SigningConfig contains settings of archive and index signing.
+// Signing is enabled if key file is set.
+type SigningConfig struct {
+	// Private ed25519 key file for signing new archives and index
+	KeyFile string
+
+	// Public key for verification, derived from KeyFile if empty
+	PublicKey string
+}
+
+// Enabled reports whether new archives and index are signed
+func (config *SigningConfig) Enabled() bool {
+	return config != nil && config.KeyFile != ""
+}
+
+// Validate checks signing settings
+func (config *SigningConfig) Validate() error {
+	if config.PublicKey != "" {
+		if _, err := parseVerifyingKey(config.PublicKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyingKey returns public key for signature verification
+func (config *SigningConfig) verifyingKey() (ed25519.PublicKey, error) {
+	if config.PublicKey != "" {
+		return parseVerifyingKey(config.PublicKey)
+	}
+
+	if config.KeyFile == "" {
+		return nil, errors.New("no public key for signature verification")
+	}
+
+	privateKey, err := readSigningKey(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return privateKey.Public().(ed25519.PublicKey), nil
+}
+
+// generateSigningKey creates new ed25519 key pair, writes private key to file
+// and returns encoded public key
+func generateSigningKey(keyFilePath string) (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.OpenFile(keyFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = fmt.Fprintf(f, "%s%s\n", signingKeyPrefix, base64.RawStdEncoding.EncodeToString(privateKey.Seed()))
+	if err != nil {
+		f.Close()
+		os.Remove(keyFilePath)
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return verifyingKeyPrefix + base64.RawStdEncoding.EncodeToString(publicKey), nil
+}
+
+// parseVerifyingKey decodes public key written as "bkp-verify:<base64>"
+func parseVerifyingKey(s string) (ed25519.PublicKey, error) {
+	if !strings.HasPrefix(s, verifyingKeyPrefix) {
+		return nil, fmt.Errorf("verification key must start with %q", verifyingKeyPrefix)
+	}
+
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, verifyingKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("decode verification key: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid verification key size")
+	}
+
+	return ed25519.PublicKey(b), nil
+}
+
+// readSigningKey reads private key file written by generateSigningKey
+func readSigningKey(filePath string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key: %v", err)
+	}
+
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, signingKeyPrefix) {
+		return nil, fmt.Errorf("signing key must start with %q", signingKeyPrefix)
+	}
+
+	seed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, signingKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("decode signing key: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid signing key size")
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ManifestFile is a file covered by signed manifest
+type ManifestFile struct {
+	Name   string
+	Size   int64
+	Digest string
+}
+
+// Manifest lists files of one archive or index generation
+type Manifest struct {
+	Archive  string
+	Previous string
+	Files    []ManifestFile
+
+	signature []byte
+}
+
+// body returns signed part of manifest
+func (m *Manifest) body() []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintln(&buf, manifestHeader)
+	fmt.Fprintf(&buf, "archive %q\n", m.Archive)
+	fmt.Fprintf(&buf, "previous %s\n", m.Previous)
+	for _, file := range m.Files {
+		fmt.Fprintf(&buf, "file %q %d %s\n", file.Name, file.Size, file.Digest)
+	}
+
+	return buf.Bytes()
+}
+
+// Sign signs manifest and returns sidecar file content
+func (m *Manifest) Sign(privateKey ed25519.PrivateKey) []byte {
+	body := m.body()
+	m.signature = ed25519.Sign(privateKey, body)
+
+	return append(body, []byte("signature "+base64.RawStdEncoding.EncodeToString(m.signature)+"\n")...)
+}
+
+// Verify checks manifest signature
+func (m *Manifest) Verify(publicKey ed25519.PublicKey) bool {
+	return ed25519.Verify(publicKey, m.body(), m.signature)
+}
+
+// parseManifest parses signature sidecar file content
+func parseManifest(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || scanner.Text() != manifestHeader {
+		return nil, errors.New("unknown manifest format")
+	}
+
+	for scanner.Scan() {
+		fields, err := splitManifestLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest line %q: %v", scanner.Text(), err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "archive" && len(fields) == 2:
+			m.Archive = fields[1]
+		case fields[0] == "previous" && len(fields) == 2:
+			m.Previous = fields[1]
+		case fields[0] == "file" && len(fields) == 4:
+			size, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid file size: %v", err)
+			}
+			m.Files = append(m.Files, ManifestFile{Name: fields[1], Size: size, Digest: fields[3]})
+		case fields[0] == "signature" && len(fields) == 2:
+			signature, err := base64.RawStdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("decode signature: %v", err)
+			}
+			m.signature = signature
+		default:
+			return nil, fmt.Errorf("invalid manifest line %q", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if m.signature == nil {
+		return nil, errors.New("manifest is not signed")
+	}
+
+	return m, nil
+}
+
+// splitManifestLine splits manifest line into keyword and values. Names of
+// archive and file lines are unquoted.
+func splitManifestLine(line string) ([]string, error) {
+	keyword, rest, _ := strings.Cut(line, " ")
+	if keyword != "archive" && keyword != "file" {
+		return strings.Fields(line), nil
+	}
+
+	quoted, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := strconv.Unquote(quoted)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{keyword, name}, strings.Fields(rest[len(quoted):])...), nil
+}
+
+// fileDigest returns size and hex SHA-256 of file
+func fileDigest(filePath string) (int64, string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// objectDigest returns size and hex SHA-256 of stored object
+func objectDigest(storage Storage, name string) (int64, string, error) {
+	r, err := storage.Get(name, 0, -1)
+	if err != nil {
+		return 0, "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestStorage computes digests of stored objects while they are written,
+// so signing does not read new files back
+type digestStorage struct {
+	Storage
+
+	mu      sync.Mutex
+	digests map[string]ManifestFile
+}
+
+func newDigestStorage(storage Storage) *digestStorage {
+	return &digestStorage{Storage: storage, digests: make(map[string]ManifestFile)}
+}
+
+func (s *digestStorage) Put(name string) (ObjectWriter, error) {
+	w, err := s.Storage.Put(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.forget(name)
+
+	return &digestWriter{ObjectWriter: w, storage: s, name: name, hash: sha256.New()}, nil
+}
+
+func (s *digestStorage) Delete(name string) error {
+	s.forget(name)
+
+	return s.Storage.Delete(name)
+}
+
+func (s *digestStorage) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.digests, name)
+}
+
+// digest returns digest of object written through storage
+func (s *digestStorage) digest(name string) (ManifestFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.digests[name]
+
+	return file, ok
+}
+
+// digestWriter hashes written data and records digest when object is stored
+type digestWriter struct {
+	ObjectWriter
+
+	storage *digestStorage
+	name    string
+	hash    hash.Hash
+	size    int64
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.ObjectWriter.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+
+	return n, err
+}
+
+func (w *digestWriter) Close() error {
+	err := w.ObjectWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	w.storage.mu.Lock()
+	defer w.storage.mu.Unlock()
+
+	w.storage.digests[w.name] = ManifestFile{Name: w.name, Size: w.size, Digest: hex.EncodeToString(w.hash.Sum(nil))}
+
+	return nil
+}
+
+// storedDigest returns size and hex SHA-256 of stored object. Digests of
+// objects written by the current run are taken without reading them.
+func storedDigest(storage Storage, name string) (int64, string, error) {
+	if s, ok := storage.(*digestStorage); ok {
+		if file, ok := s.digest(name); ok {
+			return file.Size, file.Digest, nil
+		}
+	}
+
+	return objectDigest(storage, name)
+}
+
+// signatureFiles returns archive signature files sorted by creation time
+func (b *Config) signatureFiles() ([]string, error) {
+	return b.jobFiles(signatureExt)
+}
+
+// writeSignature signs files of archive and writes sidecar file.
+// File names are object names in the repository storage.
+func writeSignature(storage Storage, signatureFileName, archive, previous string, fileNames []string, privateKey ed25519.PrivateKey) error {
+	m := &Manifest{Archive: archive, Previous: previous}
+
+	for _, fileName := range fileNames {
+		size, digest, err := storedDigest(storage, fileName)
+		if err != nil {
+			return err
+		}
+
+		m.Files = append(m.Files, ManifestFile{Name: fileName, Size: size, Digest: digest})
+	}
+
+	return writeObject(storage, signatureFileName, m.Sign(privateKey))
+}
+
+// signBackup signs files created by backup run, linking signature to the
+// previous one, and signs the new index generation along with other
+// repository files updated by the run
+func (b *Config) signBackup(baseName string, fileNames []string, indexFileNames []string) error {
+	privateKey, err := readSigningKey(b.Signing.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	signatureFiles, err := b.signatureFiles()
+	if err != nil {
+		return err
+	}
+
+	previous := noPreviousDigest
+	if len(signatureFiles) > 0 {
+		_, previous, err = objectDigest(b.storage(), signatureFiles[len(signatureFiles)-1])
+		if err != nil {
+			return err
+		}
+	}
+
+	signatureFileName := baseName + signatureExt
+	err = writeSignature(b.storage(), signatureFileName, baseName, previous, fileNames, privateKey)
+	if err != nil {
+		return fmt.Errorf("sign archive: %v", err)
+	}
+
+	if len(indexFileNames) == 0 {
+		return nil
+	}
+
+	_, previous, err = storedDigest(b.storage(), signatureFileName)
+	if err != nil {
+		return err
+	}
+
+	err = writeSignature(b.storage(), indexFileNames[0]+signatureExt, baseName, previous, indexFileNames, privateKey)
+	if err != nil {
+		return fmt.Errorf("sign index: %v", err)
+	}
+
+	return nil
+}
+
+// VerifySignatures checks signatures of all archives and index, chain links
+// between them and presence and integrity of signed files
+func (b *Config) VerifySignatures() ([]VerifyProblem, error) {
+	publicKey, err := b.Signing.verifyingKey()
+	if err != nil {
+		return nil, err
+	}
+
+	storage := b.storage()
+
+	signatureFiles, err := b.signatureFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []VerifyProblem
+	addProblem := func(fileName, format string, args ...any) {
+		problems = append(problems, VerifyProblem{FileName: fileName, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	// Files covered by signatures
+	signed := make(map[string]bool)
+
+	previous := noPreviousDigest
+	for _, name := range signatureFiles {
+		b.logf(Debug, "Verifying %s...", name)
+
+		m, digest, err := readManifest(storage, name)
+		if err != nil {
+			addProblem(name, "invalid signature file: %v", err)
+			previous = digest
+			continue
+		}
+
+		if !m.Verify(publicKey) {
+			addProblem(name, "invalid signature")
+		}
+		if m.Archive+signatureExt != name {
+			addProblem(name, "signature belongs to archive %s", m.Archive)
+		}
+		if m.Previous != previous {
+			addProblem(name, "broken chain link, previous signature is missing or modified")
+		}
+		previous = digest
+
+		problems = append(problems, verifyManifestFiles(storage, m, signed, b.isOffline)...)
+	}
+
+	indexFileName := b.indexFileName()
+	m, _, err := readManifest(storage, indexFileName+signatureExt)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if _, err := storage.Stat(indexFileName); err == nil {
+			addProblem(indexFileName, "index is not signed")
+		}
+	case err != nil:
+		addProblem(indexFileName+signatureExt, "invalid signature file: %v", err)
+	default:
+		if !m.Verify(publicKey) {
+			addProblem(indexFileName+signatureExt, "invalid signature")
+		}
+		if m.Previous != previous {
+			addProblem(indexFileName+signatureExt, "broken chain link, index does not belong to the latest archive")
+		}
+		problems = append(problems, verifyManifestFiles(storage, m, signed, b.isOffline)...)
+	}
+
+	repositoryFiles, err := b.jobFiles(archiveExtMask, dictExt, snapshotExt)
+	if err != nil {
+		return nil, err
+	}
+	packFiles, err := storage.List(b.chunkRepositoryPrefix() + "/" + packDirName + "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, pack := range packFiles {
+		if path.Ext(pack.Name) == packExt {
+			repositoryFiles = append(repositoryFiles, pack.Name)
+		}
+	}
+
+	for _, name := range repositoryFiles {
+		if !signed[name] {
+			addProblem(name, "not signed")
+		}
+	}
+
+	return problems, nil
+}
+
+// readManifest reads signature file and returns parsed manifest and digest of the file
+func readManifest(storage Storage, fileName string) (*Manifest, string, error) {
+	data, err := readObject(storage, fileName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	digest := sha256.Sum256(data)
+
+	m, err := parseManifest(data)
+
+	return m, hex.EncodeToString(digest[:]), err
+}
+
+// verifyManifestFiles checks that files listed in manifest exist and are not
+// modified. Offline files are not checked.
+func verifyManifestFiles(storage Storage, m *Manifest, signed map[string]bool, offline func(name string) bool) []VerifyProblem {
+	var problems []VerifyProblem
+
+	for _, file := range m.Files {
+		signed[file.Name] = true
+
+		if offline(file.Name) {
+			continue
+		}
+
+		size, digest, err := objectDigest(storage, file.Name)
+		if errors.Is(err, fs.ErrNotExist) {
+			problems = append(problems, VerifyProblem{FileName: file.Name, Problem: "missing archive file"})
+			continue
+		}
+		if err != nil {
+			problems = append(problems, VerifyProblem{FileName: file.Name, Problem: err.Error()})
+			continue
+		}
+
+		if size != file.Size || digest != file.Digest {
+			problems = append(problems, VerifyProblem{FileName: file.Name, Problem: "file is modified"})
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestSignVerify(t *testing.T) {
+	keyFilePath := filepath.Join(t.TempDir(), "signing.key")
+	publicKeyString, err := generateSigningKey(keyFilePath)
+	assert.NoError(t, err)
+
+	privateKey, err := readSigningKey(keyFilePath)
+	assert.NoError(t, err)
+	publicKey, err := parseVerifyingKey(publicKeyString)
+	assert.NoError(t, err)
+
+	m := &Manifest{Archive: "backup_f", Previous: noPreviousDigest, Files: []ManifestFile{{Name: "backup_f.tar.zst", Size: 10, Digest: "00"}, {Name: "dir name/backup \"f\".tar.zst", Size: 20, Digest: "01"}}}
+	data := m.Sign(privateKey)
+
+	parsed, err := parseManifest(data)
+	assert.NoError(t, err)
+	assert.Equal(t, m.Files, parsed.Files)
+	assert.True(t, parsed.Verify(publicKey))
+
+	parsed.Files[0].Size = 11
+	assert.False(t, parsed.Verify(publicKey))
+
+	_, err = parseManifest(m.body())
+	assert.Error(t, err)
+}
+
+func TestVerifySignatures(t *testing.T) {
+	dir := t.TempDir()
+	keyFilePath := filepath.Join(dir, "signing.key")
+	_, err := generateSigningKey(keyFilePath)
+	assert.NoError(t, err)
+
+	config := &Config{FileName: "backup", filePath: filepath.Join(dir, "config.toml"), Signing: SigningConfig{KeyFile: keyFilePath}}
+
+	indexFilePath := config.indexFilePath()
+	for _, name := range []string{"backup_2023-01-01_00-00-00f", "backup_2023-01-02_00-00-00i", "backup_2023-01-03_00-00-00i"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".tar.zst"), []byte(name), 0644))
+		assert.NoError(t, os.WriteFile(indexFilePath, []byte(name), 0644))
+		assert.NoError(t, config.signBackup(name, []string{name + ".tar.zst"}, []string{config.indexFileName()}))
+	}
+
+	problems, err := config.VerifySignatures()
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Modified archive
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "backup_2023-01-01_00-00-00f.tar.zst"), []byte("modified"), 0644))
+	problems, err = config.VerifySignatures()
+	assert.NoError(t, err)
+	assert.Equal(t, []VerifyProblem{{FileName: "backup_2023-01-01_00-00-00f.tar.zst", Problem: "file is modified"}}, problems)
+
+	// Missing archive with its signature breaks the chain
+	assert.NoError(t, os.Remove(filepath.Join(dir, "backup_2023-01-02_00-00-00i.tar.zst")))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "backup_2023-01-02_00-00-00i.sig")))
+	problems, err = config.VerifySignatures()
+	assert.NoError(t, err)
+	assert.Contains(t, problems, VerifyProblem{FileName: "backup_2023-01-03_00-00-00i.sig", Problem: "broken chain link, previous signature is missing or modified"})
+
+	// Unsigned archive and invalid signature
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "backup_2023-01-04_00-00-00i.tar.zst"), nil, 0644))
+	data, err := os.ReadFile(filepath.Join(dir, "backup_2023-01-03_00-00-00i.sig"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "backup_2023-01-03_00-00-00i.sig"), append([]byte("backuper-manifest 1\narchive \"backup_2023-01-03_00-00-00x\"\n"), data[len("backuper-manifest 1\narchive \"backup_2023-01-03_00-00-00i\"\n"):]...), 0644))
+	problems, err = config.VerifySignatures()
+	assert.NoError(t, err)
+	assert.Contains(t, problems, VerifyProblem{FileName: "backup_2023-01-04_00-00-00i.tar.zst", Problem: "not signed"})
+	assert.Contains(t, problems, VerifyProblem{FileName: "backup_2023-01-03_00-00-00i.sig", Problem: "invalid signature"})
+	assert.Contains(t, problems, VerifyProblem{FileName: config.indexFileName() + signatureExt, Problem: "broken chain link, index does not belong to the latest archive"})
+}
+
+func TestSignBackupDigests(t *testing.T) {
+	dir := t.TempDir()
+	keyFilePath := filepath.Join(dir, "signing.key")
+	_, err := generateSigningKey(keyFilePath)
+	assert.NoError(t, err)
+
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "a b.txt"), []byte("a"), 0644))
+
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		Signing:  SigningConfig{KeyFile: keyFilePath},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(dir, "config.toml")}
+	assert.NoError(t, config.FullBackup())
+
+	problems, err := config.VerifySignatures()
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Digests of written files are recorded while writing
+	name := "backup_2023-01-01_00-00-00i"
+	assert.NoError(t, writeObject(config.storage(), name+".tar.zst", []byte("data")))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".tar.zst"), []byte("changed after write"), 0644))
+	assert.NoError(t, config.signBackup(name, []string{name + ".tar.zst"}, nil))
+
+	problems, err = config.VerifySignatures()
+	assert.NoError(t, err)
+	assert.Contains(t, problems, VerifyProblem{FileName: name + ".tar.zst", Problem: "file is modified"})
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Snapshot is the chunked repository counterpart of tar archive: a list of
+// files added by backup run with chunk lists of their content. It is zstd
+// compressed CSV encrypted with the archive key:
+//
+//	path;size;unix modification time;SHA-256;comma separated chunk ids
+const snapshotExt = ".snap"
+
+// SnapshotEntry describes file stored in chunked repository
+type SnapshotEntry struct {
+	Path             string
+	Size             int64
+	ModificationTime time.Time
+	Digest           string
+	Chunks           []string
+}
+
+// isSnapshotFile reports whether file is a snapshot of chunked repository
+func isSnapshotFile(fileName string) bool {
+	return strings.HasSuffix(fileName, snapshotExt)
+}
+
+// snapshotWriter writes snapshot file
+type snapshotWriter struct {
+	fileName   string
+	object     ObjectWriter
+	encrypted  io.WriteCloser
+	compressor *zstd.Encoder
+	csvWriter  *csv.Writer
+
+	// Number of written entries
+	count int
+}
+
+func newSnapshotWriter(storage Storage, fileName string, encryption *EncryptionConfig, options []zstd.EOption) (*snapshotWriter, error) {
+	w := &snapshotWriter{fileName: fileName}
+
+	var err error
+	w.object, err = storage.Put(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при создании файла снимка: %v", err)
+	}
+
+	w.encrypted, err = encryption.newEncryptWriter(w.object)
+	if err != nil {
+		w.object.Abort()
+		return nil, fmt.Errorf("ошибка при инициализации шифрования: %v", err)
+	}
+
+	w.compressor, err = zstd.NewWriter(w.encrypted, options...)
+	if err != nil {
+		w.object.Abort()
+		return nil, err
+	}
+
+	w.csvWriter = csv.NewWriter(w.compressor)
+	w.csvWriter.Comma = ';'
+
+	return w, nil
+}
+
+func (w *snapshotWriter) Write(entry SnapshotEntry) error {
+	w.count++
+
+	return w.csvWriter.Write([]string{
+		entry.Path,
+		strconv.FormatInt(entry.Size, 10),
+		strconv.FormatInt(entry.ModificationTime.Unix(), 10),
+		entry.Digest,
+		strings.Join(entry.Chunks, ",")})
+}
+
+// Close finalizes snapshot. Snapshot file is removed on error.
+func (w *snapshotWriter) Close() error {
+	w.csvWriter.Flush()
+	err := w.csvWriter.Error()
+	if err == nil {
+		err = w.compressor.Close()
+	}
+	if err == nil {
+		err = w.encrypted.Close()
+	}
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("close snapshot error: %v", err)
+	}
+
+	err = w.object.Close()
+	if err != nil {
+		return fmt.Errorf("close snapshot error: %v", err)
+	}
+
+	return nil
+}
+
+// Abort closes and removes partially written snapshot
+func (w *snapshotWriter) Abort() {
+	w.compressor.Close()
+	w.object.Abort()
+}
+
+// readSnapshot calls fn for every entry of snapshot file
+func (b *Config) readSnapshot(fileName string, fn func(entry SnapshotEntry) error) error {
+	f, err := b.storage().Get(fileName, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decrypted, err := b.Encryption.newDecryptReader(f)
+	if err != nil {
+		return err
+	}
+
+	dec, err := zstd.NewReader(decrypted)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	csvReader := csv.NewReader(dec)
+	csvReader.Comma = ';'
+	csvReader.FieldsPerRecord = 5
+	for {
+		data, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		size, err := strconv.ParseInt(data[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		unixTime, err := strconv.ParseInt(data[2], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		entry := SnapshotEntry{Path: data[0], Size: size, ModificationTime: time.Unix(unixTime, 0).Local(), Digest: data[3]}
+		if data[4] != "" {
+			entry.Chunks = strings.Split(data[4], ",")
+		}
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// doChunkedBackup stores new and updated files in chunked repository
+func (b *Config) doChunkedBackup(index Index, baseName string) error {
+	repo, err := b.openChunkRepository()
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := newSnapshotWriter(b.storage(), baseName+snapshotExt, &b.Encryption, b.indexEncoderOptions())
+	if err != nil {
+		return err
+	}
+	b.logf(Info, "Creating new snapshot %s...", snapshot.fileName)
+
+	abort := func() {
+		snapshot.Abort()
+		repo.Abort()
+	}
+
+	b.log(Info, "Copying files...")
+
+	addedFileIndex := make(Index)
+
+	var report Report
+
+	addSize := int64(0) // added bytes
+	for k := range b.planChan(index, &report) {
+		b.logf(Debug, "Adding file %s...\n", k.filePath)
+
+		entry, err := repo.AddFile(k)
+		if err != nil {
+			b.logf(Error, "add file error %s: %v\n", k.filePath, err)
+			if b.StopOnAnyError {
+				abort()
+				return fmt.Errorf("add file error: %v", err)
+			}
+			continue
+		}
+
+		err = snapshot.Write(entry)
+		if err != nil {
+			abort()
+			return fmt.Errorf("write snapshot error: %v", err)
+		}
+
+		addSize += entry.Size
+		addedFileIndex.AddFileInfo(k.filePath, FileInfo{ArchiveFileName: snapshot.fileName, ModificationTime: k.ModificationTime, Digest: entry.Digest, fileSize: k.fileSize})
+	}
+
+	if err := report.Err(); err != nil {
+		abort()
+		return fmt.Errorf("get file list error: %v", err)
+	}
+
+	err = snapshot.Close()
+	if err != nil {
+		repo.Abort()
+		return err
+	}
+
+	err = repo.Close()
+	if err != nil {
+		b.storage().Delete(snapshot.fileName)
+		repo.Abort()
+		return err
+	}
+
+	var fileNames []string
+	if snapshot.count == 0 {
+		b.storage().Delete(snapshot.fileName)
+	} else {
+		fileNames = append(fileNames, snapshot.fileName)
+	}
+	fileNames = append(fileNames, repo.newPacks...)
+
+	b.logAdded(snapshot.count, addSize)
+	if len(repo.newPacks) > 0 {
+		b.logf(Info, "%d new pack files written.", len(repo.newPacks))
+	}
+	b.logReport(&report)
+
+	return b.commitBackup(index, addedFileIndex, baseName, fileNames, repo.prefix+"/"+chunkIndexFileName)
+}
+
+// extractSnapshot restores files from snapshot of chunked repository
+func (b *Config) extractSnapshot(repo *chunkRepository, snapshotFileName string, files restoreTargets) error {
+	return b.readSnapshot(snapshotFileName, func(entry SnapshotEntry) error {
+		resultFilePaths, exists := files[entry.Path]
+		if !exists {
+			return nil
+		}
+
+		log.Printf("Восстановление файла %s...", entry.Path)
+		err := writeRestoredFiles(resultFilePaths, &chunkReader{repo: repo, chunks: entry.Chunks})
+		if err != nil {
+			return fmt.Errorf("ошибка при восстановлении файла %s: %v", entry.Path, err)
+		}
+
+		return nil
+	})
+}
+
+// chunkReader reads content of file stored as a list of chunks
+type chunkReader struct {
+	repo   *chunkRepository
+	chunks []string
+	data   []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+
+		chunk, err := r.repo.ReadChunk(r.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		r.data, r.chunks = chunk, r.chunks[1:]
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+// verifySnapshot reads all chunks of snapshot files and checks them against
+// file checksums and index entries. If indexedEntries is nil, index
+// cross-check is skipped.
+func (b *Config) verifySnapshot(repo *chunkRepository, snapshotFileName string, indexedEntries map[indexEntryKey]bool) []VerifyProblem {
+	var problems []VerifyProblem
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, VerifyProblem{FileName: snapshotFileName, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	entries := make(map[indexEntryKey]bool)
+
+	err := b.readSnapshot(snapshotFileName, func(entry SnapshotEntry) error {
+		key := indexEntryKey{snapshotFileName, entry.Path}
+		entries[key] = true
+
+		if indexedEntries != nil && !indexedEntries[key] {
+			addProblem("file %s is not in index", entry.Path)
+		}
+
+		h := sha256.New()
+		size := int64(0)
+		for _, id := range entry.Chunks {
+			chunk, err := repo.ReadChunk(id)
+			if err != nil {
+				addProblem("file %s: %v", entry.Path, err)
+				return nil
+			}
+
+			h.Write(chunk)
+			size += int64(len(chunk))
+		}
+
+		if size != entry.Size || hex.EncodeToString(h.Sum(nil)) != entry.Digest {
+			addProblem("checksum mismatch for file %s", entry.Path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		addProblem("corrupted snapshot: %v", err)
+		return problems
+	}
+
+	return append(problems, missingIndexedEntries(indexedEntries, entries)...)
+}
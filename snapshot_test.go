@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkedBackup(t *testing.T) {
+	root := t.TempDir()
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "a.bin"), data, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "copy.bin"), data, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "empty.txt"), nil, 0644))
+
+	dir := t.TempDir()
+	config := &Config{
+		FileName: "backup",
+		Format:   formatChunked,
+		Chunking: ChunkingConfig{MinChunkSize: 1 << 10, AverageChunkSize: 4 << 10, MaxChunkSize: 16 << 10},
+		LogLevel: Error,
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(dir, "config.toml")}
+
+	assert.NoError(t, config.FullBackup())
+
+	repo, err := config.openChunkRepository()
+	assert.NoError(t, err)
+	chunkCount := len(repo.chunks)
+
+	// Changed byte in the middle of file stores only few new chunks
+	data[len(data)/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "a.bin"), data, 0644))
+	modTime := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(root, "a.bin"), modTime, modTime))
+
+	time.Sleep(time.Second) // snapshot names contain time with seconds
+	assert.NoError(t, config.IncrementalBackup())
+
+	repo, err = config.openChunkRepository()
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(repo.chunks)-chunkCount, 3)
+	chunkCount = len(repo.chunks)
+
+	problems, err := config.Verify(true)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Restore latest versions
+	plan, err := config.extractionPlan("*", time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	toDir := t.TempDir()
+	assert.NoError(t, config.extract(plan, toDir))
+
+	for _, name := range []string{"a.bin", "copy.bin", "empty.txt"} {
+		expected, err := os.ReadFile(filepath.Join(root, name))
+		assert.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(toDir, clean(filepath.ToSlash(filepath.Join(root, name)))))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, got, name)
+	}
+
+	// Index and chunk index are rebuilt from snapshots and packs
+	index, err := config.indexFromFile()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(config.indexFilePath()))
+	assert.NoError(t, config.storage().Delete(config.chunkRepositoryPrefix()+"/"+chunkIndexFileName))
+
+	rebuiltIndex, err := config.indexFromDisk(true)
+	assert.NoError(t, err)
+	assert.Len(t, rebuiltIndex, len(index))
+	for filePath, fileHistory := range index {
+		assert.Len(t, rebuiltIndex[filePath], len(fileHistory))
+	}
+
+	repo, err = config.openChunkRepository()
+	assert.NoError(t, err)
+	assert.Len(t, repo.chunks, chunkCount)
+	problems = config.verifySnapshot(repo, index[filepath.ToSlash(filepath.Join(root, "copy.bin"))][0].ArchiveFileName, nil)
+	assert.Empty(t, problems)
+
+	// Recently read packs are cached
+	packs, err := config.storage().List(config.chunkRepositoryPrefix() + "/" + packDirName + "/")
+	assert.NoError(t, err)
+	assert.Len(t, repo.packCache, min(len(packs), packCacheSize))
+}
+
+func TestPackCache(t *testing.T) {
+	dir := t.TempDir()
+	repo := &chunkRepository{storage: newLocalStorage(dir), prefix: "backup" + chunkRepositoryDirExt, packSize: 1, chunks: make(map[string]chunkLocation)}
+
+	var ids []string
+	for i := 0; i < packCacheSize+1; i++ {
+		chunk := []byte{byte(i)}
+		digest := sha256.Sum256(chunk)
+		assert.NoError(t, repo.writeChunk(digest[:], chunk))
+		ids = append(ids, hex.EncodeToString(digest[:]))
+	}
+	assert.NoError(t, repo.Close())
+	assert.Len(t, repo.newPacks, packCacheSize+1)
+
+	for _, id := range ids {
+		_, err := repo.ReadChunk(id)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, repo.packCache, packCacheSize)
+
+	// The least recently used pack is evicted, used packs are kept
+	_, err := repo.ReadChunk(ids[1])
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(dir, repo.packFileName(repo.chunks[ids[1]].Pack))))
+	_, err = repo.ReadChunk(ids[1])
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, repo.packFileName(repo.chunks[ids[0]].Pack))))
+	_, err = repo.ReadChunk(ids[0])
+	assert.Error(t, err)
+}
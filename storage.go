@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	storageLocal  = "local"
+	storageS3     = "s3"
+	storageWebDAV = "webdav"
+	storagePlugin = "plugin"
+)
+
+// Storage stores repository files: archives, index, signatures and other
+// files of backup jobs. Object names are slash separated paths relative to
+// the repository root. Missing objects are reported with errors wrapping
+// fs.ErrNotExist.
+type Storage interface {
+	// Put returns writer storing object. Object appears after successful
+	// Close, Abort discards written data.
+	Put(name string) (ObjectWriter, error)
+
+	// Get returns reader of length bytes of object starting at offset.
+	// Negative length means reading up to the end of object.
+	Get(name string, offset, length int64) (io.ReadCloser, error)
+
+	// List returns objects with names starting with prefix sorted by name
+	List(prefix string) ([]ObjectInfo, error)
+
+	// Delete removes object, missing object is not an error
+	Delete(name string) error
+
+	// Stat returns object description
+	Stat(name string) (ObjectInfo, error)
+}
+
+// ObjectWriter writes object to storage
+type ObjectWriter interface {
+	io.Writer
+
+	// Close stores written data
+	Close() error
+
+	// Abort discards written data, it does nothing after Close
+	Abort()
+}
+
+// ObjectInfo describes stored object
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// StorageConfig contains settings of repository storage
+type StorageConfig struct {
+	// Storage type: "local" (default) - Destination directory,
+	// "s3" - S3-compatible object storage, "webdav" - WebDAV collection,
+	// "plugin" - external storage plugin
+	Type string
+
+	// S3-compatible object storage settings
+	S3 S3Config
+
+	// WebDAV storage settings
+	WebDAV WebDAVConfig
+
+	// External storage plugin settings
+	Plugin PluginConfig
+}
+
+// Validate checks storage settings
+func (config *StorageConfig) Validate() error {
+	switch config.Type {
+	case "", storageLocal:
+		return nil
+	case storageS3:
+		return config.S3.Validate()
+	case storageWebDAV:
+		return config.WebDAV.Validate()
+	case storagePlugin:
+		return config.Plugin.Validate()
+	default:
+		return fmt.Errorf("unknown storage type %q", config.Type)
+	}
+}
+
+// storage returns storage of the repository
+func (b *Config) storage() Storage {
+	if b.storageBackend == nil {
+		b.storageBackend = newStorage(&b.Storage, b.destination())
+
+		if b.Media.Enabled() {
+			b.storageBackend = &mediaStorage{
+				host:         newLocalStorage(b.resolvePath(b.Media.IndexDestination)),
+				media:        b.storageBackend,
+				isHostObject: b.isHostObject}
+		}
+
+		// Digests of new files are computed while writing for signing
+		if b.Signing.Enabled() {
+			b.storageBackend = newDigestStorage(b.storageBackend)
+		}
+	}
+
+	return b.storageBackend
+}
+
+// newStorage creates storage according to settings, dir is used by local storage
+func newStorage(config *StorageConfig, dir string) Storage {
+	switch config.Type {
+	case storageS3:
+		return newS3Storage(&config.S3)
+	case storageWebDAV:
+		return newWebDAVStorage(&config.WebDAV)
+	case storagePlugin:
+		return newPluginStorage(&config.Plugin)
+	default:
+		return newLocalStorage(dir)
+	}
+}
+
+// readObject reads whole object
+func readObject(storage Storage, name string) ([]byte, error) {
+	r, err := storage.Get(name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// writeObject stores object with given content
+func writeObject(storage Storage, name string, data []byte) error {
+	w, err := storage.Put(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close()
+}
+
+// localStorage stores objects as files in directory
+type localStorage struct {
+	root string
+}
+
+func newLocalStorage(root string) *localStorage {
+	return &localStorage{root: root}
+}
+
+func (s *localStorage) filePath(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+// localObjectWriter writes object to temporary file renamed on Close
+type localObjectWriter struct {
+	*os.File
+
+	filePath string
+	done     bool
+}
+
+func (s *localStorage) Put(name string) (ObjectWriter, error) {
+	filePath := s.filePath(name)
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &localObjectWriter{File: f, filePath: filePath}, nil
+}
+
+func (w *localObjectWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	err := w.File.Close()
+	if err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+
+	err = os.Rename(w.File.Name(), w.filePath)
+	if err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (w *localObjectWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+func (s *localStorage) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.filePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if offset == 0 && length < 0 {
+		return f, nil
+	}
+
+	if length < 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		return f, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+func (s *localStorage) List(prefix string) ([]ObjectInfo, error) {
+	// Only the directory containing prefix is walked
+	dir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir = strings.TrimSuffix(prefix, "/")
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(s.filePath(dir), func(filePath string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(s.root, filePath)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		if d.IsDir() {
+			// Directories which can not contain names with prefix are skipped
+			if name != "." && !strings.HasPrefix(name+"/", prefix) && !strings.HasPrefix(prefix, name+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	return objects, nil
+}
+
+func (s *localStorage) Delete(name string) error {
+	err := os.Remove(s.filePath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *localStorage) Stat(name string) (ObjectInfo, error) {
+	info, err := os.Stat(s.filePath(name))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress"
+)
+
+// storeCodec is used for archives of incompressible files
+var storeCodec, _ = codecByName("none")
+
+// defaultStoreExtensions contains extensions of usually incompressible files
+var defaultStoreExtensions = []string{
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp4", ".mkv", ".avi", ".mov", ".webm",
+	".mp3", ".flac", ".ogg", ".opus", ".m4a",
+	".zip", ".gz", ".tgz", ".zst", ".xz", ".bz2", ".7z", ".rar",
+	".docx", ".xlsx", ".pptx", ".odt", ".ods", ".jar", ".apk"}
+
+const (
+	// Size of file content sample for compressibility probe
+	compressibilityProbeSize = 64 << 10
+
+	// Files smaller than this size are always compressed
+	compressibilityProbeMinSize = 4 << 10
+
+	// Files with estimate below this value are considered incompressible
+	compressibilityThreshold = 0.1
+)
+
+// shouldStore reports whether file should be stored without compression
+func (config *CompressionConfig) shouldStore(filePath string, fileSize int64) (bool, error) {
+	if !config.StoreIncompressible {
+		return false, nil
+	}
+
+	extensions := config.StoreExtensions
+	if len(extensions) == 0 {
+		extensions = defaultStoreExtensions
+	}
+
+	ext := filepath.Ext(filePath)
+	for _, storeExt := range extensions {
+		if strings.EqualFold(ext, storeExt) {
+			return true, nil
+		}
+	}
+
+	if !config.ProbeCompressibility || fileSize < compressibilityProbeMinSize {
+		return false, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sample := make([]byte, compressibilityProbeSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	return compress.Estimate(sample[:n]) < compressibilityThreshold, nil
+}
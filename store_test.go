@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldStore(t *testing.T) {
+	dir := t.TempDir()
+
+	randomFilePath := filepath.Join(dir, "random.bin")
+	randomData := make([]byte, 128<<10)
+	_, err := rand.Read(randomData)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(randomFilePath, randomData, 0644))
+
+	textFilePath := filepath.Join(dir, "text.txt")
+	textData := bytes.Repeat([]byte("compressible text "), 10000)
+	assert.NoError(t, os.WriteFile(textFilePath, textData, 0644))
+
+	tests := []struct {
+		config   CompressionConfig
+		filePath string
+		size     int64
+		expected bool
+	}{
+		{CompressionConfig{}, "photo.jpg", 0, false},
+		{CompressionConfig{StoreIncompressible: true}, "photo.JPG", 0, true},
+		{CompressionConfig{StoreIncompressible: true}, "notes.txt", 0, false},
+		{CompressionConfig{StoreIncompressible: true, StoreExtensions: []string{".raw"}}, "photo.jpg", 0, false},
+		{CompressionConfig{StoreIncompressible: true, StoreExtensions: []string{".raw"}}, "photo.raw", 0, true},
+		{CompressionConfig{StoreIncompressible: true}, randomFilePath, int64(len(randomData)), false},
+		{CompressionConfig{StoreIncompressible: true, ProbeCompressibility: true}, randomFilePath, int64(len(randomData)), true},
+		{CompressionConfig{StoreIncompressible: true, ProbeCompressibility: true}, textFilePath, int64(len(textData)), false},
+	}
+
+	for _, test := range tests {
+		got, err := test.config.shouldStore(test.filePath, test.size)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, got, "%+v %s", test.config, test.filePath)
+	}
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/tidwall/match"
 )
 
 func sizeToApproxHuman(s int64) string {
@@ -34,6 +36,40 @@ func sizeToApproxHuman(s int64) string {
 	return fmt.Sprintf("%d B", s)
 }
 
+// FileSize is a size in bytes which can be written in config as integer
+// or as string with unit suffix, e.g. "10 MiB"
+type FileSize int64
+
+func (fileSize *FileSize) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+
+	units := []struct {
+		Suffix string
+		Val    int64
+	}{
+		{"EiB", 1 << 60}, {"PiB", 1 << 50}, {"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+		{"E", 1 << 60}, {"P", 1 << 50}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+		{"B", 1}}
+
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(unit.Suffix)) {
+			multiplier = unit.Val
+			s = strings.TrimSpace(s[:len(s)-len(unit.Suffix)])
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid file size %q", string(b))
+	}
+
+	*fileSize = FileSize(v * float64(multiplier))
+
+	return nil
+}
+
 // clean убирает невозможные комбинации символов из пути
 func clean(s string) string {
 	s = strings.ReplaceAll(s, ":", "")
@@ -43,35 +79,32 @@ func clean(s string) string {
 	return s
 }
 
-// stringIn - аналог оператора in
-func stringIn(s string, ss []string) (bool, int) {
-	for i, v := range ss {
-		if v == s {
-			return true, i
-		}
+// pathDepth возвращает глубину вложенности директории path относительно root
+func pathDepth(root, path string) int {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil || relPath == "." {
+		return 0
 	}
 
-	return false, -1
+	return strings.Count(filepath.ToSlash(relPath), "/") + 1
 }
 
-func isFileNameMatchPatterns(patterns []string, fileName string) bool {
-	for _, mask := range patterns {
-		if match.Match(filepath.Base(fileName), mask) {
-			return true
-		}
-	}
+// archiveBaseName возвращает имя файла архива без расширения и номера тома
+func archiveBaseName(fileName string) string {
+	base, _, _ := parseVolumeFileName(fileName)
 
-	return false
+	return base
 }
 
-func isFilePathMatchPatterns(patterns []string, fileName string) bool {
-	for _, mask := range patterns {
-		if match.Match(fileName, mask) {
-			return true
+// stringIn - аналог оператора in
+func stringIn(s string, ss []string) (bool, int) {
+	for i, v := range ss {
+		if v == s {
+			return true, i
 		}
 	}
 
-	return false
+	return false, -1
 }
 
 func parseTime(s string) (time.Time, error) {
@@ -86,3 +119,54 @@ func parseTime(s string) (time.Time, error) {
 
 	return time.Time{}, errors.New("unknown time format")
 }
+
+// isJobFile reports whether file name is a name of file created by backup
+// run of the job: <FileName>_<time><f|i>[_<volume>]<ext>
+func (b *Config) isJobFile(fileName string) bool {
+	rest, ok := strings.CutPrefix(fileName, b.FileName+"_")
+	if !ok || len(rest) < len(defaulFileNameTimeFormat)+2 {
+		return false
+	}
+
+	if _, err := time.Parse(defaulFileNameTimeFormat, rest[:len(defaulFileNameTimeFormat)]); err != nil {
+		return false
+	}
+	rest = rest[len(defaulFileNameTimeFormat):]
+
+	return (rest[0] == 'f' || rest[0] == 'i') && (rest[1] == '.' || rest[1] == '_')
+}
+
+// jobFiles returns sorted names of files created by backup runs of the job
+// with extensions matching any of extMasks
+func (b *Config) jobFiles(extMasks ...string) ([]string, error) {
+	objects, err := b.storage().List(b.FileName + "_")
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, object := range objects {
+		if strings.Contains(object.Name, "/") || !b.isJobFile(object.Name) {
+			continue
+		}
+
+		for _, extMask := range extMasks {
+			if matched, _ := path.Match("*"+extMask, object.Name); matched {
+				files = append(files, object.Name)
+				break
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// shellCommand returns command line run by system shell, so quoted
+// arguments and paths with spaces are passed as written
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+
+	return exec.Command("sh", "-c", command)
+}
@@ -12,6 +12,43 @@ func TestSizeToApproxHuman(t *testing.T) {
 	assert.Equal(t, "1.1 KiB", sizeToApproxHuman(1126))
 }
 
+func TestFileSizeUnmarshalText(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected FileSize
+	}{
+		{"1024", 1024},
+		{"10 B", 10},
+		{"1 KiB", 1024},
+		{"1.5K", 1536},
+		{"10 MiB", 10 << 20},
+		{"2g", 2 << 30},
+	}
+
+	for _, test := range tests {
+		var got FileSize
+		assert.NoError(t, got.UnmarshalText([]byte(test.input)))
+		assert.Equal(t, test.expected, got)
+	}
+
+	var got FileSize
+	assert.Error(t, got.UnmarshalText([]byte("ten")))
+	assert.Error(t, got.UnmarshalText([]byte("-1")))
+}
+
+func TestPathDepth(t *testing.T) {
+	assert.Equal(t, 0, pathDepth("/etc", "/etc"))
+	assert.Equal(t, 1, pathDepth("/etc", "/etc/nginx"))
+	assert.Equal(t, 2, pathDepth("/etc", "/etc/nginx/sites"))
+}
+
+func TestArchiveBaseName(t *testing.T) {
+	assert.Equal(t, "backup_2023-01-01_00-00-00f", archiveBaseName("backup_2023-01-01_00-00-00f.tar.zst"))
+	assert.Equal(t, "backup_2023-01-01_00-00-00f", archiveBaseName("backup_2023-01-01_00-00-00f.tar"))
+	assert.Equal(t, "backup_2023-01-01_00-00-00f", archiveBaseName("backup_2023-01-01_00-00-00f_002.tar.zst"))
+	assert.Equal(t, "backup", archiveBaseName("backup"))
+}
+
 func TestParseTime(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -29,3 +66,17 @@ func TestParseTime(t *testing.T) {
 		assert.Equal(t, test.expected, got)
 	}
 }
+
+func TestIsJobFile(t *testing.T) {
+	config := &Config{FileName: "backup"}
+
+	assert.True(t, config.isJobFile("backup_2023-01-01_00-00-00f.tar.zst"))
+	assert.True(t, config.isJobFile("backup_2023-01-01_00-00-00i_002.tar.zst"))
+	assert.True(t, config.isJobFile("backup_2023-01-01_00-00-00i.snap"))
+	assert.False(t, config.isJobFile("backup_home_2023-01-01_00-00-00f.tar.zst"))
+	assert.False(t, config.isJobFile("backup_2023-01-01_00-00-00x.tar.zst"))
+	assert.False(t, config.isJobFile("backup.index.csv.zst"))
+
+	config.FileName = "backup_home"
+	assert.True(t, config.isJobFile("backup_home_2023-01-01_00-00-00f.tar.zst"))
+}
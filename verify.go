@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Number of randomly chosen archives fully read in quick verification mode
+// in addition to the latest one
+const quickVerifySampleSize = 3
+
+// VerifyProblem describes file which failed verification
+type VerifyProblem struct {
+	FileName string
+	Problem  string
+}
+
+// indexEntryKey identifies file version stored in archive
+type indexEntryKey struct {
+	ArchiveFileName string
+	FilePath        string
+}
+
+// Verify checks archives against index. Every archive read is decompressed,
+// decrypted and authenticated, tar structure and file checksums are checked
+// and archive entries are cross-checked with the index in both directions.
+// In quick mode only the latest archive and a random sample of other
+// archives are read, the rest are only checked for presence.
+func (b *Config) Verify(full bool) ([]VerifyProblem, error) {
+	var problems []VerifyProblem
+
+	// Index entries grouped by archive set
+	var indexed map[string]map[indexEntryKey]bool
+
+	index, err := b.indexFromFile()
+	if err != nil {
+		problems = append(problems, VerifyProblem{FileName: b.indexFileName(), Problem: fmt.Sprintf("read index error: %v", err)})
+	} else {
+		indexed = make(map[string]map[indexEntryKey]bool)
+		for filePath, fileHistory := range index {
+			for _, historyItem := range fileHistory {
+				archiveSet := archiveSetFileName(historyItem.ArchiveFileName)
+				if indexed[archiveSet] == nil {
+					indexed[archiveSet] = make(map[indexEntryKey]bool)
+				}
+				indexed[archiveSet][indexEntryKey{historyItem.ArchiveFileName, filePath}] = true
+			}
+		}
+	}
+
+	archiveFiles, err := b.jobFiles(archiveExtMask, snapshotExt)
+	if err != nil {
+		return nil, err
+	}
+
+	var archiveSets []string
+	for _, archiveFile := range archiveFiles {
+		// Тома, кроме первого, читаются вместе с первым
+		if _, volume, _ := parseVolumeFileName(archiveFile); volume > 1 {
+			continue
+		}
+		archiveSets = append(archiveSets, archiveFile)
+	}
+	sort.Strings(archiveSets)
+
+	var missingArchiveSets []string
+	offlineCount := 0
+	for archiveSet := range indexed {
+		if found, _ := stringIn(archiveSet, archiveSets); !found {
+			// Archives on unmounted media are not checked
+			if b.isOffline(archiveSet) {
+				offlineCount++
+				continue
+			}
+			missingArchiveSets = append(missingArchiveSets, archiveSet)
+		}
+	}
+	sort.Strings(missingArchiveSets)
+	if offlineCount > 0 {
+		b.logf(Info, "%d archives on unmounted media are skipped.", offlineCount)
+	}
+	for _, archiveSet := range missingArchiveSets {
+		problems = append(problems, VerifyProblem{FileName: archiveSet, Problem: fmt.Sprintf("missing archive with %d indexed files", len(indexed[archiveSet]))})
+	}
+
+	selected := archiveSets
+	if !full && len(archiveSets) > quickVerifySampleSize+1 {
+		latest := archiveSets[len(archiveSets)-1]
+		selected = nil
+		for _, i := range rand.Perm(len(archiveSets) - 1)[:quickVerifySampleSize] {
+			selected = append(selected, archiveSets[i])
+		}
+		sort.Strings(selected)
+		selected = append(selected, latest)
+
+		b.logf(Info, "Quick mode: verifying %d of %d archives.", len(selected), len(archiveSets))
+	}
+
+	// Chunked repository, opened on the first snapshot
+	var repo *chunkRepository
+
+	for i, archiveSet := range selected {
+		b.logf(Info, "[%3d%%] Verifying archive %s...", 100*i/len(selected), archiveSet)
+
+		var indexedEntries map[indexEntryKey]bool
+		if indexed != nil {
+			indexedEntries = indexed[archiveSet]
+			if indexedEntries == nil {
+				indexedEntries = make(map[indexEntryKey]bool)
+			}
+		}
+
+		if !isSnapshotFile(archiveSet) {
+			problems = append(problems, b.verifyArchive(archiveSet, indexedEntries)...)
+			continue
+		}
+
+		if repo == nil {
+			repo, err = b.openChunkRepository()
+			if err != nil {
+				problems = append(problems, VerifyProblem{FileName: b.FileName + chunkRepositoryDirExt, Problem: err.Error()})
+				break
+			}
+		}
+
+		problems = append(problems, b.verifySnapshot(repo, archiveSet, indexedEntries)...)
+	}
+
+	if b.Signing.Enabled() || b.Signing.PublicKey != "" {
+		b.log(Info, "Verifying signatures...")
+
+		signatureProblems, err := b.VerifySignatures()
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, signatureProblems...)
+	}
+
+	return problems, nil
+}
+
+// verifyArchive reads all entries of archive set and checks them against
+// stored checksums and index entries. If indexedEntries is nil, index
+// cross-check is skipped.
+func (b *Config) verifyArchive(archiveSet string, indexedEntries map[indexEntryKey]bool) []VerifyProblem {
+	var problems []VerifyProblem
+	addProblem := func(fileName, format string, args ...any) {
+		problems = append(problems, VerifyProblem{FileName: fileName, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	f, err := openArchiveFile(b.storage(), archiveSet)
+	if err != nil {
+		addProblem(archiveSet, "open archive error: %v", err)
+		return problems
+	}
+	defer f.Close()
+
+	decoder, err := b.newArchiveReader(f, archiveSet)
+	if err != nil {
+		addProblem(archiveSet, "init decoder error: %v", err)
+		return problems
+	}
+	defer decoder.Close()
+
+	// Checksums of read files: file path - hex SHA-256
+	digests := make(map[string]string)
+	var checksums []byte
+
+	entries := make(map[indexEntryKey]bool)
+
+	// Files stored as references to content of other entries or as delta,
+	// their checksums describe restored content
+	links := make(map[string]bool)
+
+	tarReader := tar.NewReader(decoder)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			addProblem(archiveSet, "corrupted archive: %v", err)
+			return problems
+		}
+
+		if _, ok := header.PAXRecords[paxChecksumsRecord]; ok {
+			checksums, err = io.ReadAll(tarReader)
+			if err != nil {
+				addProblem(archiveSet, "corrupted archive: %v", err)
+				return problems
+			}
+			continue
+		}
+
+		if header.Typeflag == tar.TypeLink {
+			links[header.Name] = true
+
+			linkArchive := archiveSetFileName(header.PAXRecords[paxLinkArchiveRecord])
+			if linkArchive != "" {
+				if _, err := b.storage().Stat(linkArchive); err != nil {
+					addProblem(archiveSet, "file %s refers to content in missing archive %s", header.Name, linkArchive)
+				}
+			}
+		}
+
+		if baseArchive, ok := header.PAXRecords[paxDeltaArchiveRecord]; ok {
+			links[header.Name] = true
+
+			if _, err := b.storage().Stat(archiveSetFileName(baseArchive)); err != nil {
+				addProblem(archiveSet, "file %s is a delta against missing archive %s", header.Name, archiveSetFileName(baseArchive))
+			}
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, tarReader)
+		if err != nil {
+			addProblem(archiveSet, "corrupted archive: file %s: %v", header.Name, err)
+			return problems
+		}
+		digests[header.Name] = hex.EncodeToString(h.Sum(nil))
+
+		archiveFileName := archiveSet
+		if volume, err := strconv.Atoi(header.PAXRecords[paxVolumeRecord]); err == nil {
+			base, _, ext := parseVolumeFileName(archiveSet)
+			archiveFileName = volumeFileName(base, volume, ext)
+		}
+
+		key := indexEntryKey{archiveFileName, header.Name}
+		entries[key] = true
+
+		if indexedEntries != nil && !indexedEntries[key] {
+			addProblem(archiveFileName, "file %s is not in index", header.Name)
+		}
+	}
+
+	if checksums == nil {
+		b.logf(Debug, "Archive %s has no checksums.", archiveSet)
+	}
+
+	expectedDigests, err := parseChecksums(checksums)
+	if err != nil {
+		addProblem(archiveSet, "invalid checksums: %v", err)
+	}
+
+	filePaths := make([]string, 0, len(expectedDigests))
+	for filePath := range expectedDigests {
+		filePaths = append(filePaths, filePath)
+	}
+	sort.Strings(filePaths)
+
+	for _, filePath := range filePaths {
+		actualDigest, exists := digests[filePath]
+		if !exists {
+			addProblem(archiveSet, "file %s is listed in checksums but missing", filePath)
+			continue
+		}
+		if links[filePath] {
+			continue
+		}
+		if actualDigest != expectedDigests[filePath] {
+			addProblem(archiveSet, "checksum mismatch for file %s", filePath)
+		}
+	}
+
+	return append(problems, missingIndexedEntries(indexedEntries, entries)...)
+}
+
+// missingIndexedEntries reports index entries not found among archive entries
+func missingIndexedEntries(indexedEntries, entries map[indexEntryKey]bool) []VerifyProblem {
+	var missing []indexEntryKey
+	for key := range indexedEntries {
+		if !entries[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].FilePath < missing[j].FilePath })
+
+	var problems []VerifyProblem
+	for _, key := range missing {
+		problems = append(problems, VerifyProblem{FileName: key.ArchiveFileName, Problem: fmt.Sprintf("indexed file %s is missing in archive", key.FilePath)})
+	}
+
+	return problems
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	root := t.TempDir()
+	for _, filePath := range []string{"a.txt", "sub/b.txt"} {
+		filePath = filepath.Join(root, filePath)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filePath), 0755))
+		assert.NoError(t, os.WriteFile(filePath, []byte(filePath), 0644))
+	}
+
+	dir := t.TempDir()
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(dir, "config.toml")}
+
+	assert.NoError(t, config.FullBackup())
+
+	for _, full := range []bool{true, false} {
+		problems, err := config.Verify(full)
+		assert.NoError(t, err)
+		assert.Empty(t, problems)
+	}
+
+	index, err := config.indexFromFile()
+	assert.NoError(t, err)
+	archiveFileName := index[filepath.ToSlash(filepath.Join(root, "a.txt"))][0].ArchiveFileName
+
+	// Index entries without archive entries and missing archives
+	index.AddFile("/missing.txt", archiveFileName, time.Now())
+	index.AddFile("/other.txt", "backup_2000-01-01_00-00-00f.tar.zst", time.Now())
+	assert.NoError(t, index.Save(config.storage(), config.indexFileName(), &config.Encryption))
+
+	problems, err := config.Verify(true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []VerifyProblem{
+		{FileName: "backup_2000-01-01_00-00-00f.tar.zst", Problem: "missing archive with 1 indexed files"},
+		{FileName: archiveFileName, Problem: "indexed file /missing.txt is missing in archive"}}, problems)
+
+	// Archive entries not in index
+	delete(index, filepath.ToSlash(filepath.Join(root, "a.txt")))
+	assert.NoError(t, index.Save(config.storage(), config.indexFileName(), &config.Encryption))
+
+	problems, err = config.Verify(true)
+	assert.NoError(t, err)
+	assert.Contains(t, problems, VerifyProblem{FileName: archiveFileName, Problem: "file " + filepath.ToSlash(filepath.Join(root, "a.txt")) + " is not in index"})
+
+	// Corrupted archive
+	archiveFilePath := filepath.Join(dir, archiveFileName)
+	data, err := os.ReadFile(archiveFilePath)
+	assert.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	assert.NoError(t, os.WriteFile(archiveFilePath, data, 0644))
+
+	problems, err = config.Verify(true)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, problems)
+}
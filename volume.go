@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PAX record with number of the volume from which an entry can be read
+const paxVolumeRecord = "BACKUPER.volume"
+
+// volumeSuffixRe matches volume number suffix of archive base name
+var volumeSuffixRe = regexp.MustCompile(`_(\d{3,})$`)
+
+// volumeFileName returns file name of archive volume
+func volumeFileName(baseName string, volume int, ext string) string {
+	return fmt.Sprintf("%s_%03d%s", baseName, volume, ext)
+}
+
+// parseVolumeFileName splits archive file name to volume set base name, volume number and extension.
+// Zero volume number is returned for archives without volumes.
+func parseVolumeFileName(fileName string) (base string, volume int, ext string) {
+	base = fileName
+	if strings.HasSuffix(fileName, snapshotExt) {
+		base, ext = strings.TrimSuffix(fileName, snapshotExt), snapshotExt
+	} else if i := strings.LastIndex(fileName, ".tar"); i >= 0 {
+		base, ext = fileName[:i], fileName[i:]
+	}
+
+	match := volumeSuffixRe.FindStringSubmatch(base)
+	if match == nil {
+		return base, 0, ext
+	}
+
+	volume, _ = strconv.Atoi(match[1])
+
+	return strings.TrimSuffix(base, match[0]), volume, ext
+}
+
+// volumeNumber returns volume number of archive file or zero for archives without volumes
+func volumeNumber(fileName string) int {
+	_, volume, _ := parseVolumeFileName(fileName)
+
+	return volume
+}
+
+// volumeWriter splits written data into volume objects of limited size
+type volumeWriter struct {
+	storage  Storage
+	baseName string
+	ext      string
+	maxSize  int64
+
+	// Current volume number, starting from 1
+	volume int
+
+	object ObjectWriter
+
+	// Bytes written to current volume
+	written int64
+
+	// Names of all created volumes
+	fileNames []string
+}
+
+// newVolumeWriter creates the first volume
+func newVolumeWriter(storage Storage, baseName, ext string, maxSize int64) (*volumeWriter, error) {
+	w := &volumeWriter{storage: storage, baseName: baseName, ext: ext, maxSize: maxSize}
+
+	err := w.nextVolume()
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *volumeWriter) nextVolume() error {
+	if w.object != nil {
+		err := w.object.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	w.volume++
+	fileName := volumeFileName(w.baseName, w.volume, w.ext)
+
+	object, err := w.storage.Put(fileName)
+	if err != nil {
+		return err
+	}
+
+	w.object = object
+	w.written = 0
+	w.fileNames = append(w.fileNames, fileName)
+
+	return nil
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	n := 0
+
+	for len(p) > 0 {
+		if w.written >= w.maxSize {
+			err := w.nextVolume()
+			if err != nil {
+				return n, err
+			}
+		}
+
+		chunk := p
+		if int64(len(chunk)) > w.maxSize-w.written {
+			chunk = chunk[:w.maxSize-w.written]
+		}
+
+		written, err := w.object.Write(chunk)
+		n += written
+		w.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+
+		p = p[written:]
+	}
+
+	return n, nil
+}
+
+func (w *volumeWriter) Close() error {
+	return w.object.Close()
+}
+
+// Remove deletes all created volumes
+func (w *volumeWriter) Remove() {
+	w.object.Abort()
+
+	for _, fileName := range w.fileNames {
+		w.storage.Delete(fileName)
+	}
+}
+
+// volumeReader reads volumes of archive one after another.
+// Volumes are opened on demand, so missing volumes after the last
+// needed one do not cause errors.
+type volumeReader struct {
+	storage  Storage
+	baseName string
+	ext      string
+
+	volume int
+	object io.ReadCloser
+}
+
+// openArchiveFile opens archive for reading. If archive is split into
+// volumes, reader of volumes starting from the given one is returned.
+func openArchiveFile(storage Storage, fileName string) (io.ReadCloser, error) {
+	base, volume, ext := parseVolumeFileName(fileName)
+	if volume == 0 {
+		return storage.Get(fileName, 0, -1)
+	}
+
+	r := &volumeReader{storage: storage, baseName: base, ext: ext, volume: volume - 1}
+
+	err := r.nextVolume()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *volumeReader) nextVolume() error {
+	if r.object != nil {
+		r.object.Close()
+	}
+
+	r.volume++
+
+	object, err := r.storage.Get(volumeFileName(r.baseName, r.volume, r.ext), 0, -1)
+	if err != nil {
+		r.object = nil
+		return err
+	}
+	r.object = object
+
+	return nil
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.object == nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		n, err := r.object.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+
+		err = r.nextVolume()
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, r.missingVolume()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// missingVolume returns io.EOF if current volume is after the last one
+// or error if it is missing in the middle of volume set
+func (r *volumeReader) missingVolume() error {
+	objects, err := r.storage.List(r.baseName + "_")
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		base, volume, ext := parseVolumeFileName(object.Name)
+		if base == r.baseName && ext == r.ext && volume > r.volume {
+			return fmt.Errorf("volume %s is missing", volumeFileName(r.baseName, r.volume, r.ext))
+		}
+	}
+
+	return io.EOF
+}
+
+func (r *volumeReader) Close() error {
+	if r.object == nil {
+		return nil
+	}
+
+	return r.object.Close()
+}
+
+// archiveSetFileName returns file name of the first volume for archives split into volumes
+// or archive file name itself
+func archiveSetFileName(archiveFileName string) string {
+	base, volume, ext := parseVolumeFileName(archiveFileName)
+	if volume == 0 {
+		return archiveFileName
+	}
+
+	return path.Base(volumeFileName(base, 1, ext))
+}
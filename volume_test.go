@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVolumeFileName(t *testing.T) {
+	tests := []struct {
+		fileName string
+		base     string
+		volume   int
+		ext      string
+	}{
+		{"backup_2023-01-01_00-00-00f.tar.zst", "backup_2023-01-01_00-00-00f", 0, ".tar.zst"},
+		{"backup_2023-01-01_00-00-00f_001.tar.zst", "backup_2023-01-01_00-00-00f", 1, ".tar.zst"},
+		{"backup_2023-01-01_00-00-00i_012.tar", "backup_2023-01-01_00-00-00i", 12, ".tar"},
+	}
+
+	for _, test := range tests {
+		base, volume, ext := parseVolumeFileName(test.fileName)
+		assert.Equal(t, test.base, base)
+		assert.Equal(t, test.volume, volume)
+		assert.Equal(t, test.ext, ext)
+	}
+
+	assert.Equal(t, "backup_f_001.tar.zst", archiveSetFileName("backup_f_003.tar.zst"))
+	assert.Equal(t, "backup_f.tar.zst", archiveSetFileName("backup_f.tar.zst"))
+}
+
+func TestVolumeWriterReader(t *testing.T) {
+	storage := newLocalStorage(t.TempDir())
+	data := bytes.Repeat([]byte("0123456789"), 25)
+
+	w, err := newVolumeWriter(storage, "backup_f", ".tar", 100)
+	assert.NoError(t, err)
+
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	assert.Len(t, w.fileNames, 3)
+	for i, size := range []int64{100, 100, 50} {
+		info, err := storage.Stat(w.fileNames[i])
+		assert.NoError(t, err)
+		assert.Equal(t, size, info.Size)
+	}
+
+	r, err := openArchiveFile(storage, volumeFileName("backup_f", 1, ".tar"))
+	assert.NoError(t, err)
+	got, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, data, got)
+
+	// Reading from later volume
+	r, err = openArchiveFile(storage, volumeFileName("backup_f", 2, ".tar"))
+	assert.NoError(t, err)
+	got, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, data[100:], got)
+
+	// Missing middle volume
+	assert.NoError(t, storage.Delete(w.fileNames[1]))
+	r, err = openArchiveFile(storage, volumeFileName("backup_f", 1, ".tar"))
+	assert.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorContains(t, err, "volume backup_f_002.tar is missing")
+	assert.NoError(t, r.Close())
+
+	w.Remove()
+	_, err = storage.Stat(w.fileNames[0])
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestVolumeBackup(t *testing.T) {
+	t.Setenv("BACKUPER_TEST_PASSPHRASE", "secret")
+
+	root := t.TempDir()
+	contents := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		filePath := filepath.ToSlash(filepath.Join(root, fmt.Sprintf("%03d.bin", i)))
+		data := make([]byte, 1024)
+		rand.Read(data)
+		assert.NoError(t, os.WriteFile(filePath, data, 0644))
+		contents[filePath] = data
+	}
+
+	config := &Config{
+		FileName:      "backup",
+		LogLevel:      Error,
+		Destination:   t.TempDir(),
+		MaxVolumeSize: 32 * 1024,
+		Encryption:    EncryptionConfig{PassphraseEnv: "BACKUPER_TEST_PASSPHRASE"},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(t.TempDir(), "config.toml")}
+	assert.NoError(t, config.FullBackup())
+
+	index, err := config.index(true)
+	assert.NoError(t, err)
+
+	// Entries are readable from volumes after the first one
+	lastFile, lastVolume := "", 0
+	for filePath, history := range index {
+		if volume := volumeNumber(history[0].ArchiveFileName); volume > lastVolume {
+			lastFile, lastVolume = filePath, volume
+		}
+	}
+	assert.Greater(t, lastVolume, 2)
+
+	base, _, ext := parseVolumeFileName(index[lastFile][0].ArchiveFileName)
+	assert.NoError(t, os.Remove(filepath.Join(config.Destination, volumeFileName(base, 2, ext))))
+
+	toDir := t.TempDir()
+	plan, err := config.extractionPlan(filepath.Base(lastFile), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, config.extract(plan, toDir))
+	data, err := os.ReadFile(filepath.Join(toDir, clean(lastFile)))
+	assert.NoError(t, err)
+	assert.Equal(t, contents[lastFile], data)
+
+	// Missing middle volume is an error
+	plan, err = config.extractionPlan("*", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.ErrorContains(t, config.extract(plan, t.TempDir()), "is missing")
+}
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const propfindRequest = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+// WebDAVConfig contains settings of WebDAV storage
+type WebDAVConfig struct {
+	// Collection URL, e.g. https://nas.local/dav/backups
+	URL string
+
+	// Credentials for basic or digest authentication,
+	// scheme is chosen by server challenge
+	User         string
+	Password     string
+	PasswordFile string
+}
+
+// Validate checks WebDAV settings
+func (config *WebDAVConfig) Validate() error {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid WebDAV URL %q", config.URL)
+	}
+
+	if config.Password != "" && config.PasswordFile != "" {
+		return errors.New("only one of Password and PasswordFile can be set")
+	}
+
+	return nil
+}
+
+// password returns password of WebDAV user
+func (config *WebDAVConfig) password() (string, error) {
+	if config.PasswordFile == "" {
+		return config.Password, nil
+	}
+
+	b, err := os.ReadFile(config.PasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("read password file: %v", err)
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// webdavStorage stores objects as files of WebDAV collection
+type webdavStorage struct {
+	config *WebDAVConfig
+	client *http.Client
+
+	mu sync.Mutex
+
+	// Digest authentication challenge of server
+	challenge *digestChallenge
+
+	// Digest authentication request counter
+	nonceCount uint32
+
+	// Server requested basic authentication
+	basic bool
+
+	// Collections known to exist
+	collections map[string]bool
+}
+
+func newWebDAVStorage(config *WebDAVConfig) *webdavStorage {
+	return &webdavStorage{config: config, client: http.DefaultClient, collections: make(map[string]bool)}
+}
+
+// base returns collection URL with trailing slash
+func (s *webdavStorage) base() (*url.URL, error) {
+	u, err := url.Parse(s.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	u.RawPath = ""
+
+	return u, nil
+}
+
+// objectURL returns URL of object, collection URLs end with slash
+func (s *webdavStorage) objectURL(name string) (string, error) {
+	u, err := s.base()
+	if err != nil {
+		return "", err
+	}
+
+	u.Path += name
+	u.RawPath = uriEncode(u.Path, false)
+
+	return u.String(), nil
+}
+
+// objectName returns object name of href from PROPFIND response
+func (s *webdavStorage) objectName(href string) (string, error) {
+	base, err := s.base()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+
+	name, found := strings.CutPrefix(u.Path, base.Path)
+	if !found && u.Path+"/" != base.Path {
+		return "", fmt.Errorf("href %s is out of collection", href)
+	}
+
+	return strings.TrimSuffix(name, "/"), nil
+}
+
+// digestChallenge is parsed WWW-Authenticate header of digest authentication
+type digestChallenge struct {
+	realm, nonce, opaque, algorithm, qop string
+}
+
+// parseAuthParams parses comma separated auth parameters, values may be quoted
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, ", ") {
+		name, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			v, tail, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(v))
+			s = tail
+		}
+
+		params[name] = value.String()
+	}
+
+	return params
+}
+
+// authorization returns Authorization header value for request
+func (c *digestChallenge) authorization(method, uri, user, password string, nonceCount uint32) (string, error) {
+	var newHash func() hash.Hash
+	switch strings.ToUpper(c.algorithm) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %s", c.algorithm)
+	}
+
+	digest := func(s ...string) string {
+		h := newHash()
+		h.Write([]byte(strings.Join(s, ":")))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	ha1 := digest(user, c.realm, password)
+	ha2 := digest(method, uri)
+
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, user),
+		fmt.Sprintf(`realm="%s"`, c.realm),
+		fmt.Sprintf(`nonce="%s"`, c.nonce),
+		fmt.Sprintf(`uri="%s"`, uri)}
+
+	var response string
+	if c.qop == "" {
+		response = digest(ha1, c.nonce, ha2)
+	} else {
+		b := make([]byte, 8)
+		_, err := rand.Read(b)
+		if err != nil {
+			return "", err
+		}
+		cnonce := hex.EncodeToString(b)
+		nc := fmt.Sprintf("%08x", nonceCount)
+
+		response = digest(ha1, c.nonce, nc, cnonce, "auth", ha2)
+		fields = append(fields, "qop=auth", "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+	fields = append(fields, fmt.Sprintf(`response="%s"`, response))
+
+	if c.algorithm != "" {
+		fields = append(fields, "algorithm="+c.algorithm)
+	}
+	if c.opaque != "" {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, c.opaque))
+	}
+
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+// authenticate remembers authentication scheme requested by 401 response
+// and reports whether request should be repeated
+func (s *webdavStorage) authenticate(resp *http.Response) bool {
+	if s.config.User == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, value := range resp.Header.Values("WWW-Authenticate") {
+		scheme, params, _ := strings.Cut(value, " ")
+
+		switch strings.ToLower(scheme) {
+		case "digest":
+			p := parseAuthParams(params)
+
+			qop := ""
+			for _, option := range strings.Split(p["qop"], ",") {
+				if strings.TrimSpace(option) == "auth" {
+					qop = "auth"
+				}
+			}
+
+			// Repeated challenge with the same nonce means wrong credentials
+			stale := strings.EqualFold(p["stale"], "true")
+			if s.challenge != nil && s.challenge.nonce == p["nonce"] && !stale {
+				return false
+			}
+
+			s.challenge = &digestChallenge{realm: p["realm"], nonce: p["nonce"], opaque: p["opaque"], algorithm: p["algorithm"], qop: qop}
+			s.nonceCount = 0
+
+			return true
+		case "basic":
+			if s.basic {
+				return false
+			}
+			s.basic = true
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorize adds authentication to request according to server challenge
+func (s *webdavStorage) authorize(req *http.Request) error {
+	if s.config.User == "" {
+		return nil
+	}
+
+	password, err := s.config.password()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.challenge != nil:
+		s.nonceCount++
+		authorization, err := s.challenge.authorization(req.Method, req.URL.RequestURI(), s.config.User, password, s.nonceCount)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", authorization)
+	case s.basic:
+		req.SetBasicAuth(s.config.User, password)
+	}
+
+	return nil
+}
+
+// do sends request, repeating it with authentication requested by server
+func (s *webdavStorage) do(method, u string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		err = s.authorize(req)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt < 2 && s.authenticate(resp) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// webdavError returns error of failed request and closes response body
+func webdavError(method, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("webdav %s %s: %w", method, name, fs.ErrNotExist)
+	}
+
+	return fmt.Errorf("webdav %s %s: %s", method, name, resp.Status)
+}
+
+// makeCollections creates collection and its parents
+func (s *webdavStorage) makeCollections(dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	exists := s.collections[dir]
+	s.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	err := s.makeCollections(path.Dir(dir))
+	if err != nil {
+		return err
+	}
+
+	u, err := s.objectURL(dir + "/")
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("MKCOL", u, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	// 405 Method Not Allowed is returned for existing collections
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+		return webdavError("MKCOL", dir, resp)
+	}
+	resp.Body.Close()
+
+	s.mu.Lock()
+	s.collections[dir] = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// webdavObjectWriter streams object to temporary file moved to its name on Close
+type webdavObjectWriter struct {
+	s       *webdavStorage
+	name    string
+	tmpName string
+
+	pipe   *io.PipeWriter
+	result chan error
+
+	done bool
+}
+
+func (s *webdavStorage) Put(name string) (ObjectWriter, error) {
+	err := s.makeCollections(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+
+	// Streamed body can not be repeated, so authentication scheme is
+	// requested before upload
+	s.mu.Lock()
+	known := s.challenge != nil || s.basic
+	s.mu.Unlock()
+	if s.config.User != "" && !known {
+		u, err := s.objectURL("")
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(http.MethodOptions, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &webdavObjectWriter{s: s, name: name, tmpName: name + "." + hex.EncodeToString(b) + ".tmp", result: make(chan error, 1)}
+
+	u, err := s.objectURL(w.tmpName)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPut, u, pr)
+	if err != nil {
+		return nil, err
+	}
+	err = s.authorize(req)
+	if err != nil {
+		return nil, err
+	}
+	w.pipe = pw
+
+	go func() {
+		resp, err := s.client.Do(req)
+		if err == nil {
+			if resp.StatusCode >= 300 {
+				err = webdavError(http.MethodPut, name, resp)
+			} else {
+				resp.Body.Close()
+			}
+		}
+
+		// Unblocks writer if server finished request before reading whole body
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+
+		w.result <- err
+	}()
+
+	return w, nil
+}
+
+func (w *webdavObjectWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("write to closed object")
+	}
+
+	return w.pipe.Write(p)
+}
+
+func (w *webdavObjectWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.pipe.Close()
+	err := <-w.result
+	if err != nil {
+		w.s.Delete(w.tmpName)
+		return err
+	}
+
+	source, err := w.s.objectURL(w.tmpName)
+	if err != nil {
+		return err
+	}
+	destination, err := w.s.objectURL(w.name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.s.do("MOVE", source, http.Header{"Destination": {destination}, "Overwrite": {"T"}}, nil)
+	if err != nil {
+		w.s.Delete(w.tmpName)
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		w.s.Delete(w.tmpName)
+		return webdavError("MOVE", w.name, resp)
+	}
+
+	return resp.Body.Close()
+}
+
+func (w *webdavObjectWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	w.pipe.CloseWithError(errors.New("upload aborted"))
+	<-w.result
+
+	w.s.Delete(w.tmpName)
+}
+
+// Number of attempts to resume interrupted download of object
+const webdavMaxResumes = 3
+
+// webdavObjectReader reads object, interrupted downloads are resumed from
+// the last read byte
+type webdavObjectReader struct {
+	s    *webdavStorage
+	name string
+	url  string
+
+	offset int64
+
+	// Bytes left to read, negative if object is read up to the end
+	remaining int64
+
+	body    io.ReadCloser
+	resumes int
+}
+
+func (s *webdavStorage) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	u, err := s.objectURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &webdavObjectReader{s: s, name: name, url: u, offset: offset, remaining: length}
+	err = r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *webdavObjectReader) open() error {
+	header := make(http.Header)
+	if r.remaining >= 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, r.offset+r.remaining-1))
+	} else if r.offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	}
+
+	resp, err := r.s.do(http.MethodGet, r.url, header, nil)
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Server ignored range
+		_, err = io.CopyN(io.Discard, resp.Body, r.offset)
+		if err != nil {
+			resp.Body.Close()
+			return fmt.Errorf("webdav GET %s: %v", r.name, err)
+		}
+	default:
+		return webdavError(http.MethodGet, r.name, resp)
+	}
+	r.body = resp.Body
+
+	return nil
+}
+
+func (r *webdavObjectReader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if r.remaining > 0 && int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if r.remaining > 0 {
+		r.remaining -= int64(n)
+	}
+
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil || err == io.EOF || r.resumes >= webdavMaxResumes {
+		return n, err
+	}
+
+	// Download is resumed on the next read
+	r.resumes++
+	r.body.Close()
+	if openErr := r.open(); openErr != nil {
+		r.body = io.NopCloser(bytes.NewReader(nil))
+		return n, fmt.Errorf("%v, resume error: %v", err, openErr)
+	}
+
+	return n, nil
+}
+
+func (r *webdavObjectReader) Close() error {
+	return r.body.Close()
+}
+
+// webdavResource is a resource listed by PROPFIND
+type webdavResource struct {
+	name       string
+	collection bool
+	info       ObjectInfo
+}
+
+// propfind returns collection and its members
+func (s *webdavStorage) propfind(dir string) ([]webdavResource, error) {
+	name := ""
+	if dir != "." {
+		name = dir + "/"
+	}
+
+	u, err := s.objectURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do("PROPFIND", u, http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}}, []byte(propfindRequest))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, webdavError("PROPFIND", dir, resp)
+	}
+	defer resp.Body.Close()
+
+	var multistatus struct {
+		Responses []struct {
+			Href     string `xml:"DAV: href"`
+			Propstat []struct {
+				Prop struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"DAV: collection"`
+					} `xml:"DAV: resourcetype"`
+					ContentLength int64  `xml:"DAV: getcontentlength"`
+					LastModified  string `xml:"DAV: getlastmodified"`
+				} `xml:"DAV: prop"`
+				Status string `xml:"DAV: status"`
+			} `xml:"DAV: propstat"`
+		} `xml:"DAV: response"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&multistatus)
+	if err != nil {
+		return nil, fmt.Errorf("webdav PROPFIND %s: %v", dir, err)
+	}
+
+	var resources []webdavResource
+	for _, response := range multistatus.Responses {
+		name, err := s.objectName(response.Href)
+		if err != nil {
+			return nil, err
+		}
+
+		resource := webdavResource{name: name, info: ObjectInfo{Name: name}}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+
+			resource.collection = propstat.Prop.ResourceType.Collection != nil
+			resource.info.Size = propstat.Prop.ContentLength
+			resource.info.ModTime, _ = http.ParseTime(propstat.Prop.LastModified)
+		}
+
+		resources = append(resources, resource)
+	}
+
+	return resources, nil
+}
+
+func (s *webdavStorage) List(prefix string) ([]ObjectInfo, error) {
+	// Only the collection containing prefix is listed
+	dir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir = strings.TrimSuffix(prefix, "/")
+	}
+
+	var objects []ObjectInfo
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		resources, err := s.propfind(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range resources {
+			name := resource.name
+			if name == "" || name == dir {
+				continue
+			}
+
+			if resource.collection {
+				// Collections which can not contain names with prefix are skipped
+				if strings.HasPrefix(name+"/", prefix) || strings.HasPrefix(prefix, name+"/") {
+					err = walk(name)
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			if strings.HasPrefix(name, prefix) && !strings.HasSuffix(name, ".tmp") {
+				objects = append(objects, resource.info)
+			}
+		}
+
+		return nil
+	}
+
+	err := walk(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	return objects, nil
+}
+
+func (s *webdavStorage) Delete(name string) error {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodDelete, u, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		return webdavError(http.MethodDelete, name, resp)
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *webdavStorage) Stat(name string) (ObjectInfo, error) {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	resp, err := s.do(http.MethodHead, u, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if resp.StatusCode >= 300 {
+		return ObjectInfo{}, webdavError(http.MethodHead, name, resp)
+	}
+	resp.Body.Close()
+
+	info := ObjectInfo{Name: name, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return info, nil
+}
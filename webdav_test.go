@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testWebDAVUser     = "backup"
+	testWebDAVPassword = "secret"
+)
+
+// fakeWebDAV is in-memory WebDAV server serving collection /dav/
+type fakeWebDAV struct {
+	t *testing.T
+
+	// Authentication scheme: "", "basic" or "digest"
+	auth  string
+	nonce string
+
+	mu          sync.Mutex
+	files       map[string][]byte
+	collections map[string]bool
+
+	// Number of PUT requests with chunked body
+	streamedPuts int
+
+	// Number of GET requests to interrupt in the middle of the body
+	interruptedGets int
+
+	// Range headers of GET requests
+	ranges []string
+}
+
+func newFakeWebDAV(t *testing.T, auth string) (*fakeWebDAV, *httptest.Server) {
+	s := &fakeWebDAV{t: t, auth: auth, nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", files: make(map[string][]byte), collections: map[string]bool{"/dav": true}}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	return s, server
+}
+
+func (s *fakeWebDAV) authorized(r *http.Request) bool {
+	switch s.auth {
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		return ok && user == testWebDAVUser && password == testWebDAVPassword
+	case "digest":
+		scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if scheme != "Digest" {
+			return false
+		}
+		p := parseAuthParams(params)
+
+		digest := func(s ...string) string {
+			h := md5.Sum([]byte(strings.Join(s, ":")))
+			return hex.EncodeToString(h[:])
+		}
+		ha1 := digest(p["username"], "backups", testWebDAVPassword)
+		ha2 := digest(r.Method, r.RequestURI)
+
+		return p["username"] == testWebDAVUser && p["nonce"] == s.nonce && p["uri"] == r.RequestURI &&
+			p["response"] == digest(ha1, s.nonce, p["nc"], p["cnonce"], p["qop"], ha2)
+	}
+
+	return true
+}
+
+// collectionPath returns cleaned request path without trailing slash
+func collectionPath(p string) string {
+	return strings.TrimSuffix(path.Clean(p), "/")
+}
+
+func (s *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, bodyErr := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.authorized(r) {
+		switch s.auth {
+		case "basic":
+			w.Header().Set("WWW-Authenticate", `Basic realm="backups"`)
+		case "digest":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="backups", qop="auth,auth-int", nonce="%s", opaque="5ccc069c403ebaf9f0171e9517f40e41"`, s.nonce))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	p := collectionPath(r.URL.Path)
+	if !strings.HasPrefix(p+"/", "/dav/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1")
+	case "MKCOL":
+		switch {
+		case !s.collections[path.Dir(p)]:
+			w.WriteHeader(http.StatusConflict)
+		case s.collections[p]:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			s.collections[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodPut:
+		if !s.collections[path.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if bodyErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.ContentLength < 0 {
+			s.streamedPuts++
+		}
+		s.files[p] = body
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		data, exists := s.files[p]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			s.ranges = append(s.ranges, r.Header.Get("Range"))
+		}
+		if r.Method == http.MethodGet && s.interruptedGets > 0 {
+			// Connection is closed after the first half of declared body
+			s.interruptedGets--
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.Write(data[:len(data)/2])
+			return
+		}
+		http.ServeContent(w, r, "", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(data))
+	case http.MethodDelete:
+		if _, exists := s.files[p]; !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	case "MOVE":
+		destination, err := url.Parse(r.Header.Get("Destination"))
+		data, exists := s.files[p]
+		if err != nil || !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.files, p)
+		s.files[collectionPath(destination.Path)] = data
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		s.propfind(w, p, r.Header.Get("Depth"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeWebDAV) propfind(w http.ResponseWriter, p, depth string) {
+	type resource struct {
+		href string
+		size int
+		dir  bool
+	}
+
+	var resources []resource
+	switch {
+	case s.collections[p]:
+		resources = append(resources, resource{href: p + "/", dir: true})
+		if depth != "0" {
+			for name := range s.collections {
+				if path.Dir(name) == p && name != p {
+					resources = append(resources, resource{href: name + "/", dir: true})
+				}
+			}
+			for name, data := range s.files {
+				if path.Dir(name) == p {
+					resources = append(resources, resource{href: name, size: len(data)})
+				}
+			}
+		}
+	case s.files[p] != nil:
+		resources = append(resources, resource{href: p, size: len(s.files[p])})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].href < resources[j].href })
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+	for _, resource := range resources {
+		resourceType := ""
+		if resource.dir {
+			resourceType = "<D:collection/>"
+		}
+		fmt.Fprintf(w, `<D:response><D:href>%s</D:href><D:propstat><D:prop><D:resourcetype>%s</D:resourcetype>`+
+			`<D:getcontentlength>%d</D:getcontentlength><D:getlastmodified>Sun, 01 Jan 2023 00:00:00 GMT</D:getlastmodified>`+
+			`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`,
+			(&url.URL{Path: resource.href}).EscapedPath(), resourceType, resource.size)
+	}
+	fmt.Fprint(w, `</D:multistatus>`)
+}
+
+func testWebDAVConfig(server *httptest.Server) WebDAVConfig {
+	return WebDAVConfig{URL: server.URL + "/dav", User: testWebDAVUser, Password: testWebDAVPassword}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`realm="a, \"b\"", qop="auth,auth-int", stale=TRUE, algorithm=MD5`)
+
+	assert.Equal(t, map[string]string{"realm": `a, "b"`, "qop": "auth,auth-int", "stale": "TRUE", "algorithm": "MD5"}, params)
+}
+
+func TestWebDAVStorage(t *testing.T) {
+	for _, auth := range []string{"", "basic", "digest"} {
+		fake, server := newFakeWebDAV(t, auth)
+		config := testWebDAVConfig(server)
+		assert.NoError(t, config.Validate())
+		storage := newWebDAVStorage(&config)
+
+		// Objects are streamed and appear after Close
+		w, err := storage.Put("a/b c.txt")
+		assert.NoError(t, err, auth)
+		for i := 0; i < 10; i++ {
+			_, err = w.Write([]byte{'0' + byte(i)})
+			assert.NoError(t, err)
+		}
+		assert.NotContains(t, fake.files, "/dav/a/b c.txt")
+		assert.NoError(t, w.Close())
+		assert.Equal(t, []byte("0123456789"), fake.files["/dav/a/b c.txt"])
+		assert.Equal(t, 1, fake.streamedPuts)
+
+		data, err := readObject(storage, "a/b c.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0123456789"), data)
+
+		r, err := storage.Get("a/b c.txt", 2, 5)
+		assert.NoError(t, err)
+		data, err = io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.Equal(t, []byte("23456"), data)
+
+		r, err = storage.Get("a/b c.txt", 7, -1)
+		assert.NoError(t, err)
+		data, err = io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.Equal(t, []byte("789"), data)
+
+		// Interrupted downloads are resumed from the last received byte
+		fake.interruptedGets = 1
+		fake.ranges = nil
+		data, err = readObject(storage, "a/b c.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0123456789"), data)
+		assert.Equal(t, []string{"", "bytes=5-"}, fake.ranges)
+
+		fake.interruptedGets = webdavMaxResumes + 1
+		_, err = readObject(storage, "a/b c.txt")
+		assert.Error(t, err)
+		fake.interruptedGets = 0
+
+		info, err := storage.Stat("a/b c.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), info.Size)
+
+		// Aborted upload leaves no files
+		w, err = storage.Put("a/aborted.txt")
+		assert.NoError(t, err)
+		_, err = w.Write([]byte("data"))
+		assert.NoError(t, err)
+		w.Abort()
+		assert.Len(t, fake.files, 1)
+
+		assert.NoError(t, writeObject(storage, "a/sub/d.txt", []byte("d")))
+		assert.NoError(t, writeObject(storage, "e.txt", []byte("e")))
+		objects, err := storage.List("a/")
+		assert.NoError(t, err)
+		var names []string
+		for _, object := range objects {
+			names = append(names, object.Name)
+		}
+		assert.Equal(t, []string{"a/b c.txt", "a/sub/d.txt"}, names)
+		assert.Equal(t, int64(10), objects[0].Size)
+
+		objects, err = storage.List("missing/")
+		assert.NoError(t, err)
+		assert.Empty(t, objects)
+
+		assert.NoError(t, storage.Delete("a/sub/d.txt"))
+		assert.NoError(t, storage.Delete("a/sub/d.txt"))
+		_, err = storage.Stat("a/sub/d.txt")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = storage.Get("a/sub/d.txt", 0, -1)
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		if auth != "" {
+			config.Password = "wrong"
+			wrong := newWebDAVStorage(&config)
+			_, err = readObject(wrong, "a/b c.txt")
+			assert.ErrorContains(t, err, "401")
+		}
+	}
+}
+
+func TestWebDAVBackup(t *testing.T) {
+	fake, server := newFakeWebDAV(t, "digest")
+
+	root := t.TempDir()
+	filePath := filepath.ToSlash(filepath.Join(root, "a.txt"))
+	assert.NoError(t, os.WriteFile(filePath, []byte("data"), 0644))
+
+	configDir := t.TempDir()
+	config := &Config{
+		FileName: "backup",
+		LogLevel: Error,
+		Storage:  StorageConfig{Type: storageWebDAV, WebDAV: testWebDAVConfig(server)},
+		Patterns: []*Pattern{{
+			Path:                root,
+			FileNamePatternList: PatternList{"*"},
+			FilePathPatternList: PatternList{"**"},
+			MaxDepth:            -1}},
+		filePath: filepath.Join(configDir, "config.toml")}
+
+	assert.NoError(t, config.FullBackup())
+	assert.Contains(t, fake.files, "/dav/backup"+indexFileExt)
+
+	problems, err := config.Verify(true)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Index is rebuilt from stored archives
+	delete(fake.files, "/dav/backup"+indexFileExt)
+	index, err := config.index(true)
+	assert.NoError(t, err)
+	assert.Contains(t, index, filePath)
+
+	toDir := t.TempDir()
+	plan, err := config.extractionPlan("*", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.NoError(t, config.extract(plan, toDir))
+
+	data, err := os.ReadFile(filepath.Join(toDir, clean(filePath)))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+}